@@ -1,15 +1,20 @@
 package conf
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	_ "embed"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -19,17 +24,161 @@ import (
 var permitCfg []byte
 
 type AppConfig struct {
-	HttpAddr string `yaml:"http_addr" json:"http_addr"`
-	DbConn   string `yaml:"db_conn" json:"db_conn"`
+	HttpAddr string `yaml:"http_addr" json:"http_addr" validate:"required,hostport"`
+	DbConn   string `yaml:"db_conn" json:"db_conn" validate:"required,dsn" secret:"dsn"`
+	// TlsCert and TlsKey serve http_addr over TLS, both are reloaded when changed on disk
+	TlsCert string `yaml:"tls_cert" json:"tls_cert" validate:"required_with=TlsKey,file"`
+	TlsKey  string `yaml:"tls_key" json:"tls_key" validate:"required_with=TlsCert,file"`
+	// ClientCa verifies the client certificates of machine callers
+	ClientCa   string `yaml:"client_ca" json:"client_ca" validate:"file"`
+	ClientAuth string `yaml:"client_auth" json:"client_auth" default:"verify_if_given" validate:"oneof=request verify_if_given require"`
+	// RedirectAddr listens for plain HTTP and redirects every request to HTTPS
+	RedirectAddr string `yaml:"redirect_addr" json:"redirect_addr" validate:"hostport"`
+	// UploadDir stores user uploads such as avatars
+	UploadDir string `yaml:"upload_dir" json:"upload_dir" default:"upload"`
 }
 
 type AuthConfig struct {
-	JwtKey      string        `yaml:"jwt_key" json:"jwt_key"`
-	JwtExp      int           `yaml:"jwt_exp" json:"jwt_exp"`
-	GitId       string        `yaml:"git_id" json:"git_id"`
-	GitKey      string        `yaml:"git_key" json:"git_key"`
-	RedirectUrl string        `yaml:"redirect_url" json:"redirect_url"`
-	Permits     *PermitConfig `yaml:"permits" json:"permits"`
+	JwtKey      string `yaml:"jwt_key" json:"jwt_key" validate:"required,min=16,entropy=64" secret:"true"`
+	JwtExp      int    `yaml:"jwt_exp" json:"jwt_exp" validate:"required,min=1"`
+	GitId       string `yaml:"git_id" json:"git_id"`
+	GitKey      string `yaml:"git_key" json:"git_key" secret:"true"`
+	RedirectUrl string `yaml:"redirect_url" json:"redirect_url" validate:"url"`
+	// JwtAlg signs the tokens, HS256 uses jwt_key while RS256, ES256 and EdDSA use the pem
+	// keys of jwt_key_dir, generated when missing and published at /.well-known/jwks.json
+	JwtAlg    string `yaml:"jwt_alg" json:"jwt_alg" default:"HS256" validate:"oneof=HS256 RS256 ES256 EdDSA"`
+	JwtKeyDir string `yaml:"jwt_key_dir" json:"jwt_key_dir" default:"keys"`
+	// JwtKeyRotate is the age in hours after which a new signing key is generated, 0 keeps the key
+	JwtKeyRotate int `yaml:"jwt_key_rotate" json:"jwt_key_rotate" validate:"min=0"`
+	// TokenMode "renew" re-signs expired tokens in the auth filter, "refresh" issues short
+	// access tokens renewed through /api/auth/refresh, jwt_exp then bounds a refresh token
+	// family from its sign-in
+	TokenMode string `yaml:"token_mode" json:"token_mode" default:"renew" validate:"oneof=renew refresh"`
+	// AccessExp is the lifetime in minutes of the access tokens in refresh mode
+	AccessExp int `yaml:"access_exp" json:"access_exp" default:"15" validate:"min=1"`
+	// PermitFile overrides the embedded permit.yml rules and is watched for changes
+	PermitFile string `yaml:"permit_file" json:"permit_file"`
+	// PermitDb enables route permit overrides from the sys_route_permit table
+	PermitDb bool `yaml:"permit_db" json:"permit_db"`
+	// PermitRefresh is the interval in seconds between two reads of the permit table
+	PermitRefresh int           `yaml:"permit_refresh" json:"permit_refresh" default:"60" validate:"min=1"`
+	Permits       *PermitConfig `yaml:"permits" json:"permits"`
+	// Providers are the external identity providers users can sign in with
+	Providers []ProviderConfig `yaml:"providers" json:"providers"`
+	Session   SessionConfig    `yaml:"session" json:"session"`
+	Lockout   LockoutConfig    `yaml:"lockout" json:"lockout"`
+	Password  PasswordConfig   `yaml:"password" json:"password"`
+	Mfa       MfaConfig        `yaml:"mfa" json:"mfa"`
+	ApiKey    ApiKeyConfig     `yaml:"api_key" json:"api_key"`
+}
+
+// ApiKeyConfig bounds the personal access tokens accepted through X-API-Key
+type ApiKeyConfig struct {
+	// MaxAge is the longest lifetime in days of a key, a key without an expiry gets it
+	MaxAge int `yaml:"max_age" json:"max_age" default:"365" validate:"min=1"`
+	// MaxKeys is how many live keys an owner may have
+	MaxKeys int `yaml:"max_keys" json:"max_keys" default:"20" validate:"min=1"`
+}
+
+// MfaConfig is the totp second factor, roles flagged require_mfa make it mandatory
+type MfaConfig struct {
+	// Issuer names the account in authenticator apps
+	Issuer string `yaml:"issuer" json:"issuer" default:"admin"`
+	// SecretKey encrypts the totp secrets at rest, jwt_key is used when empty, changing the
+	// key makes every enrolled secret unreadable
+	SecretKey string `yaml:"secret_key" json:"secret_key" secret:"true"`
+	// RecoveryCodes is how many one-time recovery codes an enrollment hands out
+	RecoveryCodes int `yaml:"recovery_codes" json:"recovery_codes" default:"10" validate:"min=1,max=50"`
+}
+
+// PasswordConfig hashes the passwords, hashes made with other settings keep working and
+// are upgraded on the next sign-in
+type PasswordConfig struct {
+	Algorithm string `yaml:"algorithm" json:"algorithm" default:"argon2id" validate:"oneof=argon2id bcrypt"`
+	// Pepper keys every password before hashing, changing it invalidates all passwords
+	Pepper string `yaml:"pepper" json:"pepper" secret:"true"`
+	// Memory is the argon2id memory in KiB
+	Memory      uint32 `yaml:"memory" json:"memory" default:"65536" validate:"min=8192"`
+	Iterations  uint32 `yaml:"iterations" json:"iterations" default:"3" validate:"min=1"`
+	Parallelism uint8  `yaml:"parallelism" json:"parallelism" default:"2" validate:"min=1"`
+	BcryptCost  int    `yaml:"bcrypt_cost" json:"bcrypt_cost" default:"12" validate:"min=10,max=31"`
+	// Concurrency bounds the hashes computed at once, every argon2id hash holds memory KiB
+	Concurrency int `yaml:"concurrency" json:"concurrency" default:"4" validate:"min=1"`
+	// Policy is checked whenever a password is set, existing passwords are not affected
+	Policy PasswordPolicyConfig `yaml:"policy" json:"policy"`
+}
+
+// PasswordPolicyConfig is the policy of new passwords and how long a password stays valid
+type PasswordPolicyConfig struct {
+	MinLength int `yaml:"min_length" json:"min_length" default:"8" validate:"min=1,max=200"`
+	// Classes are the kinds of characters a password must contain, an empty list requires none
+	Classes []string `yaml:"classes" json:"classes" default:"[lower, upper, digit]" validate:"oneof=lower upper digit symbol"`
+	// History is how many recent passwords of a user may not be used again
+	History int `yaml:"history" json:"history" default:"5" validate:"min=0,max=24"`
+	// MaxAge is how many days a password stays valid, 0 never expires
+	MaxAge int `yaml:"max_age" json:"max_age" validate:"min=0"`
+}
+
+// LockoutConfig locks accounts and client addresses after repeated sign-in failures, each
+// further lock within a day lasts multiplier times longer up to max_duration
+type LockoutConfig struct {
+	// Threshold is the number of failures of one account within window that locks it
+	Threshold int `yaml:"threshold" json:"threshold" default:"5" validate:"min=1"`
+	// IpThreshold is the number of failures of one address within window that locks it, 0 disables
+	IpThreshold int `yaml:"ip_threshold" json:"ip_threshold" default:"20" validate:"min=0"`
+	// Window is the time in seconds the failures are counted over
+	Window int `yaml:"window" json:"window" default:"100" validate:"min=1"`
+	// Duration is the time in seconds of a first lock
+	Duration    int     `yaml:"duration" json:"duration" default:"60" validate:"min=1"`
+	Multiplier  float64 `yaml:"multiplier" json:"multiplier" default:"2" validate:"min=1"`
+	MaxDuration int     `yaml:"max_duration" json:"max_duration" default:"3600" validate:"min=1"`
+}
+
+// SessionConfig selects where sessions, sign-in failures and locks are kept, replicas
+// behind a load balancer must share a sql or redis store
+type SessionConfig struct {
+	Store         string `yaml:"store" json:"store" default:"memory" validate:"oneof=memory sql redis"`
+	RedisAddr     string `yaml:"redis_addr" json:"redis_addr" default:"127.0.0.1:6379" validate:"hostport"`
+	RedisPassword string `yaml:"redis_password" json:"redis_password" secret:"true"`
+	RedisDb       int    `yaml:"redis_db" json:"redis_db" validate:"min=0"`
+	// RedisPrefix namespaces the keys so several deployments can share a redis
+	RedisPrefix string `yaml:"redis_prefix" json:"redis_prefix" default:"'admin:'"`
+	// MaxSessions limits the concurrent sessions of a user, 0 allows any number
+	MaxSessions int `yaml:"max_sessions" json:"max_sessions" validate:"min=0"`
+	// Overflow decides a sign-in beyond max_sessions, "reject" refuses it and "evict"
+	// signs the oldest sessions out
+	Overflow string `yaml:"overflow" json:"overflow" default:"evict" validate:"oneof=reject evict"`
+}
+
+// ProviderConfig declares one identity provider, it is served under /api/auth/oauth/<name>
+type ProviderConfig struct {
+	Name         string `yaml:"name" json:"name" validate:"required,max=10"`
+	Type         string `yaml:"type" json:"type" validate:"required,oneof=github oidc"`
+	ClientId     string `yaml:"client_id" json:"client_id" validate:"required"`
+	ClientSecret string `yaml:"client_secret" json:"client_secret" secret:"true"`
+	// CallbackUrl is the redirect_uri registered at the provider, derived from the request when empty
+	CallbackUrl string   `yaml:"callback_url" json:"callback_url" validate:"url"`
+	Scopes      []string `yaml:"scopes" json:"scopes"`
+	// Issuer is the oidc issuer, its discovery document locates every other endpoint
+	Issuer string `yaml:"issuer" json:"issuer" validate:"url"`
+	// AuthUrl, TokenUrl and ApiUrl override the github endpoints
+	AuthUrl  string `yaml:"auth_url" json:"auth_url" validate:"url"`
+	TokenUrl string `yaml:"token_url" json:"token_url" validate:"url"`
+	ApiUrl   string `yaml:"api_url" json:"api_url" validate:"url"`
+	// Claims names the oidc claims copied to a new SysUser, unset ones use the standard claims
+	Claims ClaimMapping `yaml:"claims" json:"claims"`
+	// Groups maps provider groups to SysRole codes, when set the roles of the user follow
+	// the groups at every sign-in
+	Groups map[string]string `yaml:"groups" json:"groups"`
+}
+
+type ClaimMapping struct {
+	Name   string `yaml:"name" json:"name"`
+	Nick   string `yaml:"nick" json:"nick"`
+	Email  string `yaml:"email" json:"email"`
+	Phone  string `yaml:"phone" json:"phone"`
+	Avatar string `yaml:"avatar" json:"avatar"`
+	Groups string `yaml:"groups" json:"groups"`
 }
 type AuthKV struct {
 	Url    string `yaml:"url"`
@@ -41,33 +190,100 @@ type PermitConfig struct {
 }
 
 type LogConfig struct {
-	Level      string `yaml:"level" json:"level"`
-	Filename   string `yaml:"filename" json:"filename"`
-	MaxSize    int    `yaml:"max_size" json:"max_size"`
-	MaxAge     int    `yaml:"max_age" json:"max_age"`
-	MaxBackups int    `yaml:"max_backups" json:"max_backups"`
+	Level      string `yaml:"level" json:"level" validate:"oneof=debug info warn error dpanic panic fatal"`
+	Filename   string `yaml:"filename" json:"filename" validate:"required"`
+	MaxSize    int    `yaml:"max_size" json:"max_size" validate:"min=0"`
+	MaxAge     int    `yaml:"max_age" json:"max_age" validate:"min=0"`
+	MaxBackups int    `yaml:"max_backups" json:"max_backups" validate:"min=0"`
 }
 
+// GConfig is the application configuration. The instance returned by InitConf keeps the
+// startup values and is shared without locking, a reload of the file publishes a new
+// snapshot through Current and Hot().Changes() instead. The running server only applies
+// log.level from a snapshot, every other key takes effect on restart
 type GConfig struct {
-	AppCfg  *AppConfig  `yaml:"app"`
-	AuthCfg *AuthConfig `yaml:"auth"`
-	LogCfg  *LogConfig  `yaml:"log"`
+	AppCfg  *AppConfig  `yaml:"app" validate:"required"`
+	AuthCfg *AuthConfig `yaml:"auth" validate:"required"`
+	LogCfg  *LogConfig  `yaml:"log" validate:"required"`
+	hot     *HotConfig
+}
+
+func (g *GConfig) attach(hc *HotConfig) {
+	g.hot = hc
+}
+
+// Hot returns the loader watching the config files, use Changes to follow reloads and
+// Close to stop the watcher
+func (g *GConfig) Hot() *HotConfig {
+	return g.hot
+}
+
+// Current returns the latest loaded snapshot of the configuration
+func (g *GConfig) Current() *GConfig {
+	if g.hot == nil {
+		return g
+	}
+	if current, ok := g.hot.Current().(*GConfig); ok {
+		return current
+	}
+	return g
+}
+
+// Explain reports where each value of the latest loaded snapshot came from
+func (g *GConfig) Explain() []KeyProvenance {
+	if g.hot == nil {
+		return nil
+	}
+	return g.hot.Explain(g.Current())
+}
+
+// DefaultENVPrefix prefixes every environment variable read by HotConfig. A config key
+// maps to the upper-cased yaml path joined by "_", app.http_addr is read from
+// ADMIN_APP_HTTP_ADDR. ADMIN_ENV, ADMIN_DEBUG_MODE, ADMIN_VERBOSE_MODE, ADMIN_SILENT_MODE,
+// ADMIN_MASTER_KEY and ADMIN_MASTER_KEY_FILE control the loader itself
+const DefaultENVPrefix = "ADMIN"
+
+// Override forces the value of a config key after files and env, e.g. from a command line flag
+type Override struct {
+	Key   string
+	Value string
+	Flag  string
 }
 
 type Config struct {
-	Environment          string
-	ENVPrefix            string
-	Debug                bool
-	Verbose              bool
-	Silent               bool
-	AutoReload           bool
+	Environment string
+	// ENVPrefix replaces DefaultENVPrefix, "-" reads env names without prefix
+	ENVPrefix  string
+	Debug      bool
+	Verbose    bool
+	Silent     bool
+	AutoReload bool
+	// AutoReloadInterval is the quiet period after the last file event before reloading
 	AutoReloadInterval   time.Duration
 	AutoReloadCallback   func(config interface{})
 	ErrorOnUnmatchedKeys bool
+	// MasterKey decrypts ENC(...) values, loaded from MasterKeyEnv or MasterKeyFileEnv when nil
+	MasterKey []byte
+	// Overrides are applied last on every load, including reloads
+	Overrides []Override
 }
 type HotConfig struct {
 	*Config
 	configModTimes map[string]time.Time
+	cancel         context.CancelFunc
+	done           chan struct{}
+	subLock        sync.Mutex
+	subscribers    []chan interface{}
+	stopped        bool
+	// configDigests catch a file replaced within the resolution of its mod time
+	configDigests map[string][sha256.Size]byte
+	// current is the latest loaded snapshot, see Current
+	current atomic.Value
+	// loadLock serializes loads, guarding configModTimes and the candidates being recorded
+	loadLock   sync.Mutex
+	candidates map[string][]Source
+	provLock   sync.RWMutex
+	provenance map[string][]Source
 }
 
 // New initialize a HotConfig
@@ -75,24 +291,34 @@ func New(config *Config) *HotConfig {
 	if config == nil {
 		config = &Config{}
 	}
+	hc := &HotConfig{Config: config}
 
-	if os.Getenv("HotConfig_DEBUG_MODE") != "" {
+	if hc.metaEnv("DEBUG_MODE") != "" {
 		config.Debug = true
 	}
 
-	if os.Getenv("HotConfig_VERBOSE_MODE") != "" {
+	if hc.metaEnv("VERBOSE_MODE") != "" {
 		config.Verbose = true
 	}
 
-	if os.Getenv("HotConfig_SILENT_MODE") != "" {
+	if hc.metaEnv("SILENT_MODE") != "" {
 		config.Silent = true
 	}
 
 	if config.AutoReload && config.AutoReloadInterval == 0 {
-		config.AutoReloadInterval = time.Second
+		config.AutoReloadInterval = time.Millisecond * 200
 	}
 
-	return &HotConfig{Config: config}
+	return hc
+}
+
+// metaEnv reads a variable controlling the loader, it always carries a prefix
+func (hc *HotConfig) metaEnv(name string) string {
+	prefix := hc.getENVPrefix()
+	if prefix == "-" {
+		prefix = DefaultENVPrefix
+	}
+	return os.Getenv(prefix + "_" + name)
 }
 
 var testRegexp = regexp.MustCompile(`_test|(\\.test$)`)
@@ -100,7 +326,7 @@ var testRegexp = regexp.MustCompile(`_test|(\\.test$)`)
 // GetEnvironment get environment
 func (hc *HotConfig) GetEnvironment() string {
 	if hc.Environment == "" {
-		if env := os.Getenv("HotConfig_ENV"); env != "" {
+		if env := hc.metaEnv("ENV"); env != "" {
 			return env
 		}
 
@@ -121,58 +347,54 @@ func (hc *HotConfig) GetErrorOnUnmatchedKeys() bool {
 }
 
 // Load will unmarshal configurations to struct from files that you provide
-func (hc *HotConfig) Load(config interface{}, files ...string) (err error) {
+func (hc *HotConfig) Load(config interface{}, files ...string) error {
+	return hc.LoadContext(context.Background(), config, files...)
+}
+
+// LoadContext works like Load, the file watcher started for AutoReload stops when ctx is done
+func (hc *HotConfig) LoadContext(ctx context.Context, config interface{}, files ...string) (err error) {
 	defaultValue := reflect.Indirect(reflect.ValueOf(config))
 	if !defaultValue.CanAddr() {
 		return fmt.Errorf("Config %v should be addressable", config)
 	}
-	err, _ = hc.load(config, false, files...)
+	if err, _ = hc.load(config, false, files...); err != nil {
+		return err
+	}
+	hc.current.Store(config)
 
 	if hc.Config.AutoReload {
-		go func() {
-			timer := time.NewTimer(hc.Config.AutoReloadInterval)
-			for range timer.C {
-				reflectPtr := reflect.New(reflect.ValueOf(config).Elem().Type())
-				reflectPtr.Elem().Set(defaultValue)
-
-				var changed bool
-				if err, changed = hc.load(reflectPtr.Interface(), true, files...); err == nil && changed {
-					reflect.ValueOf(config).Elem().Set(reflectPtr.Elem())
-					if hc.Config.AutoReloadCallback != nil {
-						hc.Config.AutoReloadCallback(config)
-					}
-				} else if err != nil {
-					fmt.Printf("Failed to reload configuration from %v, got error %v\n", files, err)
-				}
-				timer.Reset(hc.Config.AutoReloadInterval)
-			}
-		}()
+		err = hc.watch(ctx, config, files...)
 	}
 	return
 }
 
 func (hc *HotConfig) getENVPrefix() string {
 	if hc.Config.ENVPrefix == "" {
-		if prefix := os.Getenv("CONFIGOR_ENV_PREFIX"); prefix != "" {
-			return prefix
-		}
-		return "HotConfig"
+		return DefaultENVPrefix
 	}
 	return hc.Config.ENVPrefix
 }
 
-func getConfigurationFileWithENVPrefix(file, env string) (string, time.Time, error) {
-	var (
-		envFile string
-		extname = path.Ext(file)
-	)
-
+func envFileName(file, env string) string {
+	extname := path.Ext(file)
 	if extname == "" {
-		envFile = fmt.Sprintf("%v.%v", file, env)
-	} else {
-		envFile = fmt.Sprintf("%v.%v%v", strings.TrimSuffix(file, extname), env, extname)
+		return fmt.Sprintf("%v.%v", file, env)
+	}
+	return fmt.Sprintf("%v.%v%v", strings.TrimSuffix(file, extname), env, extname)
+}
+
+func fileDigests(files []string) map[string][sha256.Size]byte {
+	digests := map[string][sha256.Size]byte{}
+	for _, file := range files {
+		if data, err := os.ReadFile(file); err == nil {
+			digests[file] = sha256.Sum256(data)
+		}
 	}
+	return digests
+}
 
+func getConfigurationFileWithENVPrefix(file, env string) (string, time.Time, error) {
+	envFile := envFileName(file, env)
 	if fileInfo, err := os.Stat(envFile); err == nil && fileInfo.Mode().IsRegular() {
 		return envFile, fileInfo.ModTime(), nil
 	}
@@ -221,25 +443,58 @@ func (hc *HotConfig) getConfigurationFiles(watchMode bool, files ...string) ([]s
 	return resultKeys, results
 }
 
+// DecodeError lists every offending key of a configuration file with its yaml line
+type DecodeError struct {
+	File   string
+	Errors []string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("invalid configuration %v:\n  %v", e.File, strings.Join(e.Errors, "\n  "))
+}
+
+var yamlLineRegexp = regexp.MustCompile(`^line (\d+): `)
+
+func newDecodeError(file string, err error) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return fmt.Errorf("invalid configuration %v: %w", file, err)
+	}
+	decodeErr := &DecodeError{File: file}
+	for _, msg := range typeErr.Errors {
+		// "line 5: field jwt_exprie not found" -> "conf.yml:5: field jwt_exprie not found"
+		decodeErr.Errors = append(decodeErr.Errors, yamlLineRegexp.ReplaceAllString(msg, file+":$1: "))
+	}
+	return decodeErr
+}
+
 func processFile(config interface{}, file string, errorOnUnmatchedKeys bool) error {
 	data, err := os.ReadFile(file)
 	if err != nil {
 		return err
 	}
 	if errorOnUnmatchedKeys {
-		return yaml.Unmarshal(data, config)
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(config); err != nil && err != io.EOF {
+			return newDecodeError(file, err)
+		}
+		return nil
+	}
+	if err = yaml.Unmarshal(data, config); err != nil {
+		return newDecodeError(file, err)
 	}
-	return yaml.Unmarshal(data, config)
+	return nil
 }
 
 func getPrefixForStruct(prefixes []string, fieldStruct *reflect.StructField) []string {
 	if fieldStruct.Anonymous && fieldStruct.Tag.Get("anonymous") == "true" {
 		return prefixes
 	}
-	return append(prefixes, fieldStruct.Name)
+	return append(prefixes, yamlKey(fieldStruct))
 }
 
-func (hc *HotConfig) processDefaults(config interface{}) error {
+func (hc *HotConfig) processDefaults(config interface{}, keys ...string) error {
 	configValue := reflect.Indirect(reflect.ValueOf(config))
 	if configValue.Kind() != reflect.Struct {
 		return errors.New("invalid config, should be struct")
@@ -250,6 +505,7 @@ func (hc *HotConfig) processDefaults(config interface{}) error {
 		var (
 			fieldStruct = configType.Field(i)
 			field       = configValue.Field(i)
+			fieldKeys   = append(append([]string{}, keys...), yamlKey(&fieldStruct))
 		)
 
 		if !field.CanAddr() || !field.CanInterface() {
@@ -262,6 +518,7 @@ func (hc *HotConfig) processDefaults(config interface{}) error {
 				if err := yaml.Unmarshal([]byte(value), field.Addr().Interface()); err != nil {
 					return err
 				}
+				hc.record(fieldKeys, Source{Kind: SourceDefault, Value: value})
 			}
 		}
 
@@ -271,13 +528,13 @@ func (hc *HotConfig) processDefaults(config interface{}) error {
 
 		switch field.Kind() {
 		case reflect.Struct:
-			if err := hc.processDefaults(field.Addr().Interface()); err != nil {
+			if err := hc.processDefaults(field.Addr().Interface(), fieldKeys...); err != nil {
 				return err
 			}
 		case reflect.Slice:
 			for i := 0; i < field.Len(); i++ {
 				if reflect.Indirect(field.Index(i)).Kind() == reflect.Struct {
-					if err := hc.processDefaults(field.Index(i).Addr().Interface()); err != nil {
+					if err := hc.processDefaults(field.Index(i).Addr().Interface(), append(fieldKeys, fmt.Sprint(i))...); err != nil {
 						return err
 					}
 				}
@@ -288,7 +545,7 @@ func (hc *HotConfig) processDefaults(config interface{}) error {
 	return nil
 }
 
-func (hc *HotConfig) processTags(config interface{}, prefixes ...string) error {
+func (hc *HotConfig) processTags(config interface{}, keys []string, prefixes ...string) error {
 	configValue := reflect.Indirect(reflect.ValueOf(config))
 	if configValue.Kind() != reflect.Struct {
 		return errors.New("invalid config, should be struct")
@@ -300,6 +557,7 @@ func (hc *HotConfig) processTags(config interface{}, prefixes ...string) error {
 			envNames    []string
 			fieldStruct = configType.Field(i)
 			field       = configValue.Field(i)
+			fieldKeys   = getPrefixForStruct(append([]string{}, keys...), &fieldStruct)
 			envName     = fieldStruct.Tag.Get("env") // read configuration from shell env
 		)
 
@@ -308,8 +566,7 @@ func (hc *HotConfig) processTags(config interface{}, prefixes ...string) error {
 		}
 
 		if envName == "" {
-			envNames = append(envNames, strings.Join(append(prefixes, fieldStruct.Name), "_"))                  // HotConfig_DB_Name
-			envNames = append(envNames, strings.ToUpper(strings.Join(append(prefixes, fieldStruct.Name), "_"))) // CONFIGOR_DB_NAME
+			envNames = append(envNames, strings.ToUpper(strings.Join(getPrefixForStruct(append([]string{}, prefixes...), &fieldStruct), "_"))) // ADMIN_APP_HTTP_ADDR
 		} else {
 			envNames = []string{envName}
 		}
@@ -340,6 +597,7 @@ func (hc *HotConfig) processTags(config interface{}, prefixes ...string) error {
 						return err
 					}
 				}
+				hc.record(fieldKeys, Source{Kind: SourceEnv, Env: env, Value: value})
 				break
 			}
 		}
@@ -354,7 +612,7 @@ func (hc *HotConfig) processTags(config interface{}, prefixes ...string) error {
 		}
 
 		if field.Kind() == reflect.Struct {
-			if err := hc.processTags(field.Addr().Interface(), getPrefixForStruct(prefixes, &fieldStruct)...); err != nil {
+			if err := hc.processTags(field.Addr().Interface(), fieldKeys, getPrefixForStruct(prefixes, &fieldStruct)...); err != nil {
 				return err
 			}
 		}
@@ -363,7 +621,7 @@ func (hc *HotConfig) processTags(config interface{}, prefixes ...string) error {
 			if arrLen := field.Len(); arrLen > 0 {
 				for i := 0; i < arrLen; i++ {
 					if reflect.Indirect(field.Index(i)).Kind() == reflect.Struct {
-						if err := hc.processTags(field.Index(i).Addr().Interface(), append(getPrefixForStruct(prefixes, &fieldStruct), fmt.Sprint(i))...); err != nil {
+						if err := hc.processTags(field.Index(i).Addr().Interface(), append(fieldKeys, fmt.Sprint(i)), append(getPrefixForStruct(prefixes, &fieldStruct), fmt.Sprint(i))...); err != nil {
 							return err
 						}
 					}
@@ -377,7 +635,7 @@ func (hc *HotConfig) processTags(config interface{}, prefixes ...string) error {
 							idx := 0
 							for {
 								newVal = reflect.New(field.Type().Elem()).Elem()
-								if err := hc.processTags(newVal.Addr().Interface(), append(getPrefixForStruct(prefixes, &fieldStruct), fmt.Sprint(idx))...); err != nil {
+								if err := hc.processTags(newVal.Addr().Interface(), append(fieldKeys, fmt.Sprint(idx)), append(getPrefixForStruct(prefixes, &fieldStruct), fmt.Sprint(idx))...); err != nil {
 									return // err
 								} else if reflect.DeepEqual(newVal.Interface(), reflect.New(field.Type().Elem()).Elem().Interface()) {
 									break
@@ -395,7 +653,52 @@ func (hc *HotConfig) processTags(config interface{}, prefixes ...string) error {
 	return nil
 }
 
+func (hc *HotConfig) processOverrides(config interface{}) error {
+	for _, override := range hc.Config.Overrides {
+		field, err := lookupField(reflect.ValueOf(config), strings.Split(override.Key, "."))
+		if err != nil {
+			return fmt.Errorf("override %v: %w", override.Key, err)
+		}
+		if field.Kind() == reflect.String {
+			field.SetString(override.Value)
+		} else if err = yaml.Unmarshal([]byte(override.Value), field.Addr().Interface()); err != nil {
+			return fmt.Errorf("override %v: %w", override.Key, err)
+		}
+		hc.record(strings.Split(override.Key, "."), Source{Kind: SourceFlag, Flag: override.Flag, Value: override.Value})
+	}
+	return nil
+}
+
+// lookupField finds the field addressed by a yaml key path, allocating nil parents
+func lookupField(value reflect.Value, keys []string) (reflect.Value, error) {
+	for _, key := range keys {
+		for value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				value.Set(reflect.New(value.Type().Elem()))
+			}
+			value = value.Elem()
+		}
+		if value.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("%v is not a struct key", key)
+		}
+		found := false
+		for i := 0; i < value.NumField(); i++ {
+			fieldStruct := value.Type().Field(i)
+			if value.Field(i).CanSet() && yamlKey(&fieldStruct) == key {
+				value, found = value.Field(i), true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, fmt.Errorf("unknown key %v", key)
+		}
+	}
+	return value, nil
+}
+
 func (hc *HotConfig) load(config interface{}, watchMode bool, files ...string) (err error, changed bool) {
+	hc.loadLock.Lock()
+	defer hc.loadLock.Unlock()
 	defer func() {
 		if hc.Config.Debug || hc.Config.Verbose {
 			if err != nil {
@@ -407,12 +710,13 @@ func (hc *HotConfig) load(config interface{}, watchMode bool, files ...string) (
 	}()
 
 	configFiles, configModTimeMap := hc.getConfigurationFiles(watchMode, files...)
+	configDigestMap := fileDigests(configFiles)
 
 	if watchMode {
 		if len(configModTimeMap) == len(hc.configModTimes) {
 			var changed bool
 			for f, t := range configModTimeMap {
-				if v, ok := hc.configModTimes[f]; !ok || t.After(v) {
+				if v, ok := hc.configModTimes[f]; !ok || !t.Equal(v) || configDigestMap[f] != hc.configDigests[f] {
 					changed = true
 				}
 			}
@@ -423,6 +727,13 @@ func (hc *HotConfig) load(config interface{}, watchMode bool, files ...string) (
 		}
 	}
 
+	// provenance is recorded on the fresh config being loaded, so defaults are seen
+	// as blank again on every reload
+	hc.candidates = map[string][]Source{}
+	defer func() {
+		hc.candidates = nil
+	}()
+
 	// process defaults
 	_ = hc.processDefaults(config)
 
@@ -433,40 +744,84 @@ func (hc *HotConfig) load(config interface{}, watchMode bool, files ...string) (
 		if err = processFile(config, file, hc.GetErrorOnUnmatchedKeys()); err != nil {
 			return err, true
 		}
+		if err = hc.recordFile(file); err != nil {
+			return err, true
+		}
 	}
 	hc.configModTimes = configModTimeMap
+	hc.configDigests = configDigestMap
+	// sections behind pointers only exist once a file created them
+	_ = hc.processDefaults(config)
 
 	if prefix := hc.getENVPrefix(); prefix == "-" {
-		err = hc.processTags(config)
+		err = hc.processTags(config, nil)
 	} else {
-		err = hc.processTags(config, prefix)
+		err = hc.processTags(config, nil, prefix)
+	}
+	if err != nil {
+		return err, true
+	}
+	if err = hc.processOverrides(config); err != nil {
+		return err, true
+	}
+	if err = hc.decryptSecrets(config); err != nil {
+		return err, true
+	}
+	if err = validateStruct(config); err != nil {
+		return err, true
 	}
 
-	return err, true
+	hc.provLock.Lock()
+	hc.provenance = hc.candidates
+	hc.provLock.Unlock()
+	return nil, true
 }
 
-func InitConf(path string, cb func(config interface{})) (*GConfig, error) {
+// InitConf loads the configuration file, applies ADMIN_* env and flag overrides on top
+// and keeps watching the file until ctx is done
+func InitConf(ctx context.Context, path string, overrides []Override, cb func(config interface{})) (*GConfig, error) {
 	t := GConfig{}
-	err := New(&Config{
-		AutoReload:         true,
-		AutoReloadInterval: time.Second * 5,
+	hot := New(&Config{
+		Overrides:            overrides,
+		ErrorOnUnmatchedKeys: true,
+		AutoReload:           true,
+		AutoReloadInterval:   time.Millisecond * 500,
+		// the reloaded config carries decrypted secrets, so it is never dumped here
 		AutoReloadCallback: func(config interface{}) {
-			confStr, err := json.Marshal(config)
-			if err != nil {
-				return
-			}
-			fmt.Printf("new config %v \r\n", string(confStr))
+			fmt.Printf("config reloaded from %v \r\n", path)
 			cb(config)
 		},
-	}).Load(&t, path)
+	})
+	t.hot = hot
+	err := hot.LoadContext(ctx, &t, path)
 	if err != nil {
 		return nil, err
 	}
-	var permits PermitConfig
-	err = yaml.Unmarshal(permitCfg, &permits)
+	// the permit layers are merged by the authorization, only fail fast on broken ones here
+	if _, err = EmbeddedPermits(); err != nil {
+		return nil, err
+	}
+	if _, err = LoadPermitFile(t.AuthCfg.PermitFile); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ValidateFile loads a configuration file in strict mode without watching it
+func ValidateFile(file string) (*GConfig, error) {
+	if fileInfo, err := os.Stat(file); err != nil {
+		return nil, err
+	} else if !fileInfo.Mode().IsRegular() {
+		return nil, fmt.Errorf("%v is not a regular file", file)
+	}
+	t := GConfig{}
+	t.hot = New(&Config{
+		ErrorOnUnmatchedKeys: true,
+		Silent:               true,
+	})
+	err := t.hot.Load(&t, file)
 	if err != nil {
 		return nil, err
 	}
-	t.AuthCfg.Permits = &permits
 	return &t, nil
 }
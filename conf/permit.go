@@ -0,0 +1,114 @@
+package conf
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SplitPermit splits a "value|description" permit or white list entry
+func SplitPermit(entry string) (string, string) {
+	value, desc, _ := strings.Cut(entry, "|")
+	return value, desc
+}
+
+// EmbeddedPermits returns the permit rules generated into permit.yml at build time
+func EmbeddedPermits() (*PermitConfig, error) {
+	var permits PermitConfig
+	if err := yaml.Unmarshal(permitCfg, &permits); err != nil {
+		return nil, err
+	}
+	return &permits, nil
+}
+
+func permitLoader(autoReload bool) *HotConfig {
+	return New(&Config{
+		ENVPrefix:            DefaultENVPrefix + "_PERMIT",
+		Silent:               true,
+		ErrorOnUnmatchedKeys: true,
+		AutoReload:           autoReload,
+		AutoReloadInterval:   time.Millisecond * 500,
+	})
+}
+
+// LoadPermitFile reads an on-disk permit override file, a missing file is an empty layer
+func LoadPermitFile(file string) (*PermitConfig, error) {
+	permits := &PermitConfig{}
+	if file == "" {
+		return permits, nil
+	}
+	if err := permitLoader(false).Load(permits, file); err != nil {
+		return nil, err
+	}
+	return permits, nil
+}
+
+// WatchPermitFile loads the permit override file and calls onChange with a freshly decoded
+// value every time it changes on disk, until ctx is done
+func WatchPermitFile(ctx context.Context, file string, onChange func(permits *PermitConfig)) (*PermitConfig, error) {
+	permits := &PermitConfig{}
+	if file == "" {
+		return permits, nil
+	}
+	loader := permitLoader(true)
+	if err := loader.LoadContext(ctx, permits, file); err != nil {
+		return nil, err
+	}
+	changes := loader.Changes()
+	go func() {
+		// every reload is decoded into a fresh snapshot, permits itself is never written again
+		for reloaded := range changes {
+			onChange(reloaded.(*PermitConfig))
+		}
+	}()
+	return permits, nil
+}
+
+// MergePermits folds permit layers in order, a later layer wins per url:
+// a url mapped to a permit leaves the white list and a white listed url loses its permit
+func MergePermits(layers ...*PermitConfig) *PermitConfig {
+	var (
+		order     []string
+		permits   = map[string]AuthKV{}
+		whiteList = map[string]string{}
+	)
+	for _, layer := range layers {
+		if layer == nil {
+			continue
+		}
+		for _, kv := range layer.Authentications {
+			if _, ok := permits[kv.Url]; !ok {
+				order = append(order, kv.Url)
+			}
+			permits[kv.Url] = kv
+			delete(whiteList, kv.Url)
+		}
+		for _, entry := range layer.WhiteList {
+			url, _ := SplitPermit(entry)
+			if _, ok := whiteList[url]; !ok {
+				order = append(order, url)
+			}
+			whiteList[url] = entry
+			delete(permits, url)
+		}
+	}
+	merged := &PermitConfig{
+		Authentications: []AuthKV{},
+		WhiteList:       []string{},
+	}
+	seen := map[string]bool{}
+	for _, url := range order {
+		if seen[url] {
+			continue
+		}
+		seen[url] = true
+		if kv, ok := permits[url]; ok {
+			merged.Authentications = append(merged.Authentications, kv)
+		} else if entry, ok := whiteList[url]; ok {
+			merged.WhiteList = append(merged.WhiteList, entry)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,181 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+
+	redacted = "******"
+)
+
+// Source is one layer that provided a value for a config key
+type Source struct {
+	Kind  string `json:"kind"`
+	File  string `json:"file,omitempty"`
+	Line  int    `json:"line,omitempty"`
+	Env   string `json:"env,omitempty"`
+	Flag  string `json:"flag,omitempty"`
+	Value string `json:"value"`
+}
+
+func (s Source) String() string {
+	switch s.Kind {
+	case SourceFile:
+		return fmt.Sprintf("%v:%v", s.File, s.Line)
+	case SourceEnv:
+		return "env " + s.Env
+	case SourceFlag:
+		return "flag --" + s.Flag
+	}
+	return s.Kind + " tag"
+}
+
+// KeyProvenance explains where the effective value of one leaf key came from
+type KeyProvenance struct {
+	Key        string   `json:"key"`
+	Value      string   `json:"value"`
+	Source     *Source  `json:"source"`
+	Overridden []Source `json:"overridden,omitempty"`
+}
+
+func (hc *HotConfig) record(keys []string, source Source) {
+	if hc.candidates == nil {
+		return
+	}
+	key := strings.Join(keys, ".")
+	hc.candidates[key] = append(hc.candidates[key], source)
+}
+
+// recordFile collects the line of every leaf key set by a config file
+func (hc *HotConfig) recordFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var root yaml.Node
+	if err = yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	hc.recordNode(file, root.Content[0], nil)
+	return nil
+}
+
+func (hc *HotConfig) recordNode(file string, node *yaml.Node, keys []string) {
+	if node.Kind != yaml.MappingNode {
+		var value string
+		if node.Kind == yaml.ScalarNode {
+			value = node.Value
+		} else if out, err := yaml.Marshal(node); err == nil {
+			value = strings.TrimSpace(string(out))
+		}
+		hc.record(keys, Source{Kind: SourceFile, File: file, Line: node.Line, Value: value})
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		childKeys := append(append([]string{}, keys...), key.Value)
+		if value.Kind == yaml.MappingNode {
+			hc.recordNode(file, value, childKeys)
+			continue
+		}
+		// report the line of the key rather than the line of a multi-line value
+		value.Line = key.Line
+		hc.recordNode(file, value, childKeys)
+	}
+}
+
+// Explain lists every leaf key of the loaded config with its effective value and the
+// layers that set it, the last layer wins. Values of secret fields are redacted
+func (hc *HotConfig) Explain(config interface{}) []KeyProvenance {
+	hc.provLock.RLock()
+	provenance := hc.provenance
+	hc.provLock.RUnlock()
+
+	var result []KeyProvenance
+	walkLeaves(reflect.ValueOf(config), nil, "", func(key string, field reflect.Value, secret string) {
+		item := KeyProvenance{Key: key, Value: redact(formatLeaf(field), secret)}
+		if sources := provenance[key]; len(sources) > 0 {
+			for _, source := range sources {
+				source.Value = redact(source.Value, secret)
+				item.Overridden = append(item.Overridden, source)
+			}
+			winner := item.Overridden[len(item.Overridden)-1]
+			item.Source = &winner
+			item.Overridden = item.Overridden[:len(item.Overridden)-1]
+		}
+		result = append(result, item)
+	})
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// walkLeaves visits the scalar and list fields of a config, secret carries the `secret`
+// tag of the field or of its closest tagged parent
+func walkLeaves(value reflect.Value, keys []string, secret string, fn func(key string, field reflect.Value, secret string)) {
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		fn(strings.Join(keys, "."), value, secret)
+		return
+	}
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		fieldStruct := valueType.Field(i)
+		if !value.Field(i).CanInterface() {
+			continue
+		}
+		fieldSecret := secret
+		if tag := fieldStruct.Tag.Get("secret"); tag != "" {
+			fieldSecret = tag
+		}
+		walkLeaves(value.Field(i), append(append([]string{}, keys...), yamlKey(&fieldStruct)), fieldSecret, fn)
+	}
+}
+
+func formatLeaf(field reflect.Value) string {
+	switch field.Kind() {
+	case reflect.String:
+		return field.String()
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.Struct || field.Type().Elem().Kind() == reflect.Ptr {
+			return strconv.Itoa(field.Len()) + " items"
+		}
+	}
+	return fmt.Sprint(field.Interface())
+}
+
+// redact hides a secret, fields tagged `secret:"dsn"` keep everything but the password
+func redact(value string, secret string) string {
+	if secret == "" || value == "" {
+		return value
+	}
+	if secret == "dsn" && !IsEncrypted(value) {
+		if dsn, err := mysql.ParseDSN(value); err == nil {
+			dsn.Passwd = redacted
+			return dsn.FormatDSN()
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,144 @@
+package conf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"golang-ast/utils"
+)
+
+const (
+	// MasterKeyEnv holds the master key used to decrypt ENC(...) values
+	MasterKeyEnv = DefaultENVPrefix + "_MASTER_KEY"
+	// MasterKeyFileEnv points to a file holding the master key, used when MasterKeyEnv is empty
+	MasterKeyFileEnv = DefaultENVPrefix + "_MASTER_KEY_FILE"
+
+	secretPrefix = "ENC("
+	secretSuffix = ")"
+	nonceSize    = 12
+)
+
+var ErrNoMasterKey = errors.New("no master key, set " + MasterKeyEnv + " or " + MasterKeyFileEnv)
+
+// IsEncrypted reports whether a config value has the ENC(base64...) form
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, secretPrefix) && strings.HasSuffix(value, secretSuffix)
+}
+
+// LoadMasterKey reads the master key material from the environment or the key file
+// and derives the 256-bit AES key from it
+func LoadMasterKey() ([]byte, error) {
+	material := []byte(os.Getenv(MasterKeyEnv))
+	if len(material) == 0 {
+		keyFile := os.Getenv(MasterKeyFileEnv)
+		if keyFile == "" {
+			return nil, ErrNoMasterKey
+		}
+		var err error
+		if material, err = os.ReadFile(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	material = bytes.TrimSpace(material)
+	if len(material) == 0 {
+		return nil, ErrNoMasterKey
+	}
+	key := sha256.Sum256(material)
+	return key[:], nil
+}
+
+// EncryptSecret seals a plaintext with AES-GCM and returns ENC(base64(nonce|ciphertext))
+func EncryptSecret(plain string, key []byte) (string, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed, err := utils.AESEncrypt([]byte(plain), key, nonce, utils.ModeGcm, utils.PadNoPadding)
+	if err != nil {
+		return "", err
+	}
+	return secretPrefix + base64.StdEncoding.EncodeToString(append(nonce, sealed...)) + secretSuffix, nil
+}
+
+// DecryptSecret opens a value produced by EncryptSecret
+func DecryptSecret(value string, key []byte) (string, error) {
+	if !IsEncrypted(value) {
+		return "", errors.New("value is not of the form ENC(...)")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(value, secretPrefix), secretSuffix))
+	if err != nil {
+		return "", err
+	}
+	if len(raw) <= nonceSize {
+		return "", errors.New("encrypted value is too short")
+	}
+	plain, err := utils.AESDecrypt(raw[nonceSize:], key, raw[:nonceSize], utils.ModeGcm, utils.PadNoPadding)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// decryptSecrets replaces every ENC(...) string of the config in place, the master key
+// is only required when at least one encrypted value is present
+func (hc *HotConfig) decryptSecrets(config interface{}) error {
+	key := hc.Config.MasterKey
+	return walkStrings(reflect.ValueOf(config), nil, func(path string, field reflect.Value) error {
+		if !IsEncrypted(field.String()) {
+			return nil
+		}
+		if key == nil {
+			var err error
+			if key, err = LoadMasterKey(); err != nil {
+				return fmt.Errorf("%v is encrypted: %w", path, err)
+			}
+		}
+		plain, err := DecryptSecret(field.String(), key)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %v: %w", path, err)
+		}
+		field.SetString(plain)
+		return nil
+	})
+}
+
+func walkStrings(value reflect.Value, keys []string, fn func(path string, field reflect.Value) error) error {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.String:
+		if value.CanSet() {
+			return fn(strings.Join(keys, "."), value)
+		}
+	case reflect.Struct:
+		valueType := value.Type()
+		for i := 0; i < valueType.NumField(); i++ {
+			fieldStruct := valueType.Field(i)
+			if !value.Field(i).CanInterface() {
+				continue
+			}
+			if err := walkStrings(value.Field(i), append(keys, yamlKey(&fieldStruct)), fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			if err := walkStrings(value.Index(i), append(keys, strconv.Itoa(i)), fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package conf
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// ValidationError describes one field that violates a rule of its `validate` tag
+type ValidationError struct {
+	Field string
+	Rule  string
+	Msg   string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%v: %v (%v)", e.Field, e.Msg, e.Rule)
+}
+
+// ValidationErrors aggregates every violation found in one pass over the config
+type ValidationErrors []ValidationError
+
+func (es ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(es))
+	for _, e := range es {
+		msgs = append(msgs, e.Error())
+	}
+	return "invalid configuration values:\n  " + strings.Join(msgs, "\n  ")
+}
+
+type validateFunc func(field reflect.Value, param string) string
+
+// validators return an empty string when the value passes, otherwise the reason it failed
+var validators = map[string]validateFunc{
+	"required": validateRequired,
+	"hostport": validateHostPort,
+	"dsn":      validateDsn,
+	"url":      validateUrl,
+	"file":     validateFile,
+	"min":      validateMin,
+	"max":      validateMax,
+	"oneof":    validateOneOf,
+	"entropy":  validateEntropy,
+}
+
+func validateStruct(config interface{}) error {
+	var errs ValidationErrors
+	collectViolations(reflect.ValueOf(config), nil, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func collectViolations(value reflect.Value, keys []string, errs *ValidationErrors) {
+	value = reflect.Indirect(value)
+	if value.Kind() != reflect.Struct {
+		return
+	}
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		var (
+			fieldStruct = valueType.Field(i)
+			field       = value.Field(i)
+			fieldKeys   = append(append([]string{}, keys...), yamlKey(&fieldStruct))
+		)
+		if !field.CanInterface() {
+			continue
+		}
+		if rules := fieldStruct.Tag.Get("validate"); rules != "" {
+			checkRules(value, field, strings.Join(fieldKeys, "."), rules, errs)
+		}
+
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				break
+			}
+			field = field.Elem()
+		}
+		switch field.Kind() {
+		case reflect.Struct:
+			collectViolations(field, fieldKeys, errs)
+		case reflect.Slice:
+			for idx := 0; idx < field.Len(); idx++ {
+				collectViolations(field.Index(idx), append(fieldKeys, strconv.Itoa(idx)), errs)
+			}
+		}
+	}
+}
+
+func checkRules(parent, field reflect.Value, path, rules string, errs *ValidationErrors) {
+	isBlank := field.IsZero()
+	for _, rule := range strings.Split(rules, ",") {
+		name, param, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		// required_with=Field needs the sibling, the other rules only see their own value
+		if name == "required_with" {
+			if msg := validateRequiredWith(parent, param); isBlank && msg != "" {
+				*errs = append(*errs, ValidationError{Field: path, Rule: rule, Msg: msg})
+				return
+			}
+			continue
+		}
+		fn, ok := validators[name]
+		if !ok {
+			*errs = append(*errs, ValidationError{Field: path, Rule: rule, Msg: "unknown validation rule"})
+			continue
+		}
+		// optional fields are only checked when set
+		if isBlank && name != "required" {
+			continue
+		}
+		if msg := fn(reflect.Indirect(field), param); msg != "" {
+			*errs = append(*errs, ValidationError{Field: path, Rule: rule, Msg: msg})
+			if name == "required" {
+				return
+			}
+		}
+	}
+}
+
+func yamlKey(fieldStruct *reflect.StructField) string {
+	if name, _, _ := strings.Cut(fieldStruct.Tag.Get("yaml"), ","); name != "" && name != "-" {
+		return name
+	}
+	return strings.ToLower(fieldStruct.Name)
+}
+
+func validateRequired(field reflect.Value, _ string) string {
+	if !field.IsValid() || field.IsZero() {
+		return "is required"
+	}
+	return ""
+}
+
+// validateRequiredWith reports why a blank field is required when the sibling named by
+// param is set, or an empty string when that sibling is blank too
+func validateRequiredWith(parent reflect.Value, param string) string {
+	sibling, ok := parent.Type().FieldByName(param)
+	if !ok {
+		return "unknown field " + param
+	}
+	if parent.FieldByIndex(sibling.Index).IsZero() {
+		return ""
+	}
+	return "is required when " + yamlKey(&sibling) + " is set"
+}
+
+func validateHostPort(field reflect.Value, _ string) string {
+	_, port, err := net.SplitHostPort(field.String())
+	if err != nil {
+		return "must be a host:port listen address"
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 && port != "0" {
+		return "port must be a number between 0 and 65535"
+	}
+	return ""
+}
+
+func validateDsn(field reflect.Value, _ string) string {
+	if _, err := mysql.ParseDSN(field.String()); err != nil {
+		return "must be a valid mysql dsn: " + err.Error()
+	}
+	return ""
+}
+
+func validateUrl(field reflect.Value, _ string) string {
+	u, err := url.Parse(field.String())
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "must be an absolute url"
+	}
+	return ""
+}
+
+func validateFile(field reflect.Value, _ string) string {
+	if fileInfo, err := os.Stat(field.String()); err != nil || !fileInfo.Mode().IsRegular() {
+		return "must be a readable file"
+	}
+	return ""
+}
+
+func validateMin(field reflect.Value, param string) string {
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return "invalid min parameter " + param
+	}
+	if size, unit := measure(field); size < limit {
+		return fmt.Sprintf("must be at least %v%v", param, unit)
+	}
+	return ""
+}
+
+func validateMax(field reflect.Value, param string) string {
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return "invalid max parameter " + param
+	}
+	if size, unit := measure(field); size > limit {
+		return fmt.Sprintf("must be at most %v%v", param, unit)
+	}
+	return ""
+}
+
+// measure returns the length of strings and collections, or the value of numbers
+func measure(field reflect.Value) (float64, string) {
+	switch field.Kind() {
+	case reflect.String:
+		return float64(len([]rune(field.String()))), " characters"
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(field.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(field.Int()), ""
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(field.Uint()), ""
+	case reflect.Float32, reflect.Float64:
+		return field.Float(), ""
+	}
+	return 0, ""
+}
+
+func validateOneOf(field reflect.Value, param string) string {
+	if field.Kind() == reflect.Slice {
+		for i := 0; i < field.Len(); i++ {
+			if msg := validateOneOf(field.Index(i), param); msg != "" {
+				return msg
+			}
+		}
+		return ""
+	}
+	value := fmt.Sprint(field.Interface())
+	for _, option := range strings.Fields(param) {
+		if option == value {
+			return ""
+		}
+	}
+	return "must be one of [" + param + "]"
+}
+
+// validateEntropy estimates the shannon entropy of a secret in bits
+func validateEntropy(field reflect.Value, param string) string {
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return "invalid entropy parameter " + param
+	}
+	value := []rune(field.String())
+	counts := map[rune]int{}
+	for _, r := range value {
+		counts[r]++
+	}
+	var perChar float64
+	for _, n := range counts {
+		p := float64(n) / float64(len(value))
+		perChar -= p * math.Log2(p)
+	}
+	if bits := perChar * float64(len(value)); bits < limit {
+		return fmt.Sprintf("has about %.0f bits of entropy, need %v", bits, param)
+	}
+	return ""
+}
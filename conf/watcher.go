@@ -0,0 +1,167 @@
+package conf
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watch subscribes to the directories holding the configuration files instead of the
+// files themselves, so atomic rename/replace writes are seen as a Create of the target name
+func (hc *HotConfig) watch(ctx context.Context, config interface{}, files ...string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	targets := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, file := range files {
+		candidates := []string{file, envFileName(file, hc.GetEnvironment()), envFileName(file, "example")}
+		for _, candidate := range candidates {
+			abs, errAbs := filepath.Abs(candidate)
+			if errAbs != nil {
+				_ = watcher.Close()
+				return errAbs
+			}
+			targets[abs] = true
+			dirs[filepath.Dir(abs)] = true
+		}
+	}
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return err
+		}
+	}
+	ctx, hc.cancel = context.WithCancel(ctx)
+	hc.done = make(chan struct{})
+	go hc.watchLoop(ctx, watcher, targets, config, files...)
+	return nil
+}
+
+func (hc *HotConfig) watchLoop(ctx context.Context, watcher *fsnotify.Watcher, targets map[string]bool, config interface{}, files ...string) {
+	defer close(hc.done)
+	defer hc.closeSubscribers()
+	defer watcher.Close()
+
+	// bursts of events (truncate + write + chmod, or tmp + rename) collapse into one reload
+	debounce := time.NewTimer(hc.Config.AutoReloadInterval)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !targets[filepath.Clean(event.Name)] || event.Op == fsnotify.Chmod {
+				continue
+			}
+			if hc.Config.Debug || hc.Config.Verbose {
+				fmt.Printf("Configuration file event %v\n", event)
+			}
+			debounce.Reset(hc.Config.AutoReloadInterval)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Printf("Failed to watch configuration %v, got error %v\n", files, err)
+		case <-debounce.C:
+			hc.reload(config, files...)
+		}
+	}
+}
+
+// hotAware is implemented by configs keeping a reference to their loader, every snapshot
+// of a reload is attached to it as well
+type hotAware interface {
+	attach(hc *HotConfig)
+}
+
+// reload decodes into a fresh zero value and publishes it as the new snapshot on success.
+// The value passed to Load is never written again, whoever holds it or a section of it
+// keeps reading the startup values without locking
+func (hc *HotConfig) reload(config interface{}, files ...string) {
+	snapshot := reflect.New(reflect.ValueOf(config).Elem().Type()).Interface()
+
+	err, changed := hc.load(snapshot, true, files...)
+	if err != nil {
+		fmt.Printf("Failed to reload configuration from %v, got error %v\n", files, err)
+		return
+	}
+	if !changed {
+		return
+	}
+	if aware, ok := snapshot.(hotAware); ok {
+		aware.attach(hc)
+	}
+	hc.current.Store(snapshot)
+	if hc.Config.AutoReloadCallback != nil {
+		hc.Config.AutoReloadCallback(snapshot)
+	}
+	hc.publish(snapshot)
+}
+
+// Current returns the latest successfully loaded configuration, it is the value passed to
+// Load until a reload publishes a new snapshot. A snapshot must not be modified
+func (hc *HotConfig) Current() interface{} {
+	return hc.current.Load()
+}
+
+// Changes returns a channel receiving the new snapshot after every successful reload.
+// A subscriber that falls behind only sees the latest value; the channel is closed when
+// the watcher stops
+func (hc *HotConfig) Changes() <-chan interface{} {
+	ch := make(chan interface{}, 1)
+	hc.subLock.Lock()
+	defer hc.subLock.Unlock()
+	if hc.stopped {
+		close(ch)
+		return ch
+	}
+	hc.subscribers = append(hc.subscribers, ch)
+	return ch
+}
+
+func (hc *HotConfig) publish(config interface{}) {
+	hc.subLock.Lock()
+	defer hc.subLock.Unlock()
+	for _, ch := range hc.subscribers {
+		select {
+		case ch <- config:
+		default:
+			// drop the stale value so the latest one always gets through
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- config
+		}
+	}
+}
+
+func (hc *HotConfig) closeSubscribers() {
+	hc.subLock.Lock()
+	defer hc.subLock.Unlock()
+	for _, ch := range hc.subscribers {
+		close(ch)
+	}
+	hc.subscribers = nil
+	hc.stopped = true
+}
+
+// Close stops the file watcher started by Load and waits for it to exit
+func (hc *HotConfig) Close() {
+	if hc.cancel == nil {
+		return
+	}
+	hc.cancel()
+	<-hc.done
+}
@@ -0,0 +1,122 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type watchedConfig struct {
+	Name  string `yaml:"name" validate:"required"`
+	Level int    `yaml:"level"`
+}
+
+const watchInterval = 100 * time.Millisecond
+
+// watchConfig loads a config file with auto reload and counts the reloads
+func watchConfig(t *testing.T, content string) (*HotConfig, *watchedConfig, string, *int32) {
+	file := filepath.Join(t.TempDir(), "conf.yml")
+	writeConfig(t, file, content)
+	reloads := new(int32)
+	hc := New(&Config{
+		Silent:               true,
+		ErrorOnUnmatchedKeys: true,
+		AutoReload:           true,
+		AutoReloadInterval:   watchInterval,
+		AutoReloadCallback: func(interface{}) {
+			atomic.AddInt32(reloads, 1)
+		},
+	})
+	config := &watchedConfig{}
+	if err := hc.Load(config, file); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	t.Cleanup(hc.Close)
+	return hc, config, file, reloads
+}
+
+func writeConfig(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatalf("write %v: %v", file, err)
+	}
+}
+
+// nextSnapshot waits for the next reload published on changes
+func nextSnapshot(t *testing.T, changes <-chan interface{}) *watchedConfig {
+	t.Helper()
+	select {
+	case snapshot := <-changes:
+		return snapshot.(*watchedConfig)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload within 5s")
+		return nil
+	}
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	hc, config, file, reloads := watchConfig(t, "name: app\nlevel: 0\n")
+	changes := hc.Changes()
+	// a burst of writes closer together than the interval collapses into one reload
+	for level := 1; level <= 5; level++ {
+		writeConfig(t, file, "name: app\nlevel: "+string(rune('0'+level))+"\n")
+		time.Sleep(watchInterval / 10)
+	}
+	if snapshot := nextSnapshot(t, changes); snapshot.Level != 5 {
+		t.Errorf("reloaded level = %v, want 5", snapshot.Level)
+	}
+	time.Sleep(3 * watchInterval)
+	if got := atomic.LoadInt32(reloads); got != 1 {
+		t.Errorf("reloads = %v, want 1", got)
+	}
+	if config.Level != 0 {
+		t.Errorf("loaded config level = %v, the value passed to Load must keep the startup values", config.Level)
+	}
+	if current := hc.Current().(*watchedConfig); current.Level != 5 {
+		t.Errorf("Current() level = %v, want 5", current.Level)
+	}
+}
+
+func TestWatcherRenameOver(t *testing.T) {
+	hc, _, file, _ := watchConfig(t, "name: app\n")
+	changes := hc.Changes()
+	// config management tools write a temporary file and rename it over the target
+	tmp := filepath.Join(filepath.Dir(file), ".conf.yml.tmp")
+	writeConfig(t, tmp, "name: renamed\n")
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if snapshot := nextSnapshot(t, changes); snapshot.Name != "renamed" {
+		t.Errorf("reloaded name = %q, want renamed", snapshot.Name)
+	}
+	// the watch survives the replaced inode
+	writeConfig(t, file, "name: again\n")
+	if snapshot := nextSnapshot(t, changes); snapshot.Name != "again" {
+		t.Errorf("reloaded name = %q, want again", snapshot.Name)
+	}
+}
+
+func TestWatcherRejectsInvalidFile(t *testing.T) {
+	hc, _, file, reloads := watchConfig(t, "name: app\n")
+	changes := hc.Changes()
+	for _, content := range []string{
+		"name: [app\n",            // broken yaml
+		"name: app\nunknown: 1\n", // unknown key
+		"level: 3\n",              // fails validation
+	} {
+		writeConfig(t, file, content)
+		time.Sleep(3 * watchInterval)
+	}
+	if got := atomic.LoadInt32(reloads); got != 0 {
+		t.Errorf("reloads of invalid files = %v, want 0", got)
+	}
+	if current := hc.Current().(*watchedConfig); current.Name != "app" {
+		t.Errorf("Current() = %+v after invalid files, want the last good config", current)
+	}
+	writeConfig(t, file, "name: fixed\n")
+	if snapshot := nextSnapshot(t, changes); snapshot.Name != "fixed" {
+		t.Errorf("reloaded name = %q, want fixed", snapshot.Name)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang-ast/conf"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// configCmd groups the configuration maintenance tools
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Configuration tools",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:           "validate <file>",
+	Short:         "Strictly decode a config file and report every offending key",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := conf.ValidateFile(args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%v is valid\n", args[0])
+		return nil
+	},
+}
+
+var configEncryptCmd = &cobra.Command{
+	Use:           "encrypt",
+	Short:         "Encrypt a secret read from stdin or --file into an ENC(...) value with the master key",
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := conf.LoadMasterKey()
+		if err != nil {
+			return err
+		}
+		// the plaintext never goes on argv where ps and the shell history would see it
+		var data []byte
+		if file, _ := cmd.Flags().GetString("file"); file != "" {
+			data, err = os.ReadFile(file)
+		} else {
+			data, err = io.ReadAll(cmd.InOrStdin())
+		}
+		if err != nil {
+			return err
+		}
+		plain := strings.TrimRight(string(data), "\r\n")
+		if plain == "" {
+			return errors.New("nothing to encrypt, pipe the secret on stdin or pass --file")
+		}
+		value, err := conf.EncryptSecret(plain, key)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), value)
+		return nil
+	},
+}
+
+var configDecryptCmd = &cobra.Command{
+	Use:           "decrypt <ENC(...)>",
+	Short:         "Decrypt an ENC(...) value with the master key",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := conf.LoadMasterKey()
+		if err != nil {
+			return err
+		}
+		value, err := conf.DecryptSecret(args[0], key)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), value)
+		return nil
+	},
+}
+
+var configExplainCmd = &cobra.Command{
+	Use:           "explain [file]",
+	Short:         "Show the effective value of every config key and the layer it came from",
+	Args:          cobra.MaximumNArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file := cfgFile
+		if len(args) > 0 {
+			file = args[0]
+		}
+		cfg, err := conf.ValidateFile(file)
+		if err != nil {
+			return err
+		}
+		out := cmd.OutOrStdout()
+		for _, item := range cfg.Explain() {
+			fmt.Fprintf(out, "%v = %q\n", item.Key, item.Value)
+			if item.Source == nil {
+				fmt.Fprintln(out, "    from zero value")
+				continue
+			}
+			fmt.Fprintf(out, "    from %v\n", item.Source)
+			for i := len(item.Overridden) - 1; i >= 0; i-- {
+				fmt.Fprintf(out, "    overrides %v (%q)\n", item.Overridden[i], item.Overridden[i].Value)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	configEncryptCmd.Flags().String("file", "", "read the secret from this file instead of stdin")
+	configCmd.AddCommand(configValidateCmd, configEncryptCmd, configDecryptCmd, configExplainCmd)
+	rootCmd.AddCommand(configCmd)
+}
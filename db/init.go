@@ -23,12 +23,19 @@ func Init(conf *conf.GConfig, log *zap.Logger) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	return New(dbIns, log)
+}
+
+// New wraps an opened gorm connection and migrates the tables
+func New(dbIns *gorm.DB, log *zap.Logger) (*DB, error) {
 	dbms := &DB{
 		log: log.Named("\u001B[33m[DB]\u001B[0m"),
 		orm: dbIns,
 	}
-	err = dbIns.AutoMigrate(
-		&SysUser{}, &SysRole{}, &SysMenu{}, &SysPermission{})
+	err := dbIns.AutoMigrate(
+		&SysUser{}, &SysRole{}, &SysMenu{}, &SysPermission{}, &SysRoutePermit{},
+		&SysSession{}, &SysAuthCounter{}, &SysTokenRevocation{}, &SysTokenCutoff{}, &SysLockEvent{},
+		&SysPasswordHistory{}, &SysRecoveryCode{}, &SysApiKey{})
 	if err != nil {
 		return nil, err
 	}
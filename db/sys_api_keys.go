@@ -0,0 +1,112 @@
+package db
+
+import (
+	"math"
+	"time"
+
+	"golang-ast/utils"
+)
+
+// SysApiKey is a personal access token of a user or a service account, only the digest
+// of its secret is kept
+type SysApiKey struct {
+	Id    string `json:"id" gorm:"type:varchar(21);primaryKey"`
+	Uid   string `json:"uid" gorm:"type:varchar(21);index"`
+	Owner string `json:"owner" gorm:"type:varchar(50);index"`
+	Name  string `json:"name" gorm:"type:varchar(50)"`
+	Hash  string `json:"-" gorm:"type:varchar(64)"`
+	// Permits narrow the authorities of the owner, an empty list keeps all of them
+	Permits []string `json:"permits" gorm:"type:varchar(2000);serializer:json"`
+	// AllowIps are the addresses and cidr ranges the key is accepted from, empty allows any
+	AllowIps []string   `json:"allow_ips" gorm:"type:varchar(1000);serializer:json"`
+	Exp      *time.Time `json:"exp" gorm:"type:datetime"`
+	LastUsed *time.Time `json:"last_used" gorm:"type:datetime"`
+	LastIp   string     `json:"last_ip" gorm:"type:varchar(50)"`
+	Revoked  *time.Time `json:"revoked" gorm:"type:datetime"`
+	Ct       time.Time  `json:"ct" gorm:"type:datetime not null;default:CURRENT_TIMESTAMP"`
+}
+
+type ApiKeyFilter struct {
+	Owner string `json:"owner" query:"type:equal,field:owner,omitempty"`
+}
+
+func (d *DB) CreateApiKey(k *SysApiKey) (*SysApiKey, error) {
+	k.Id = utils.MustNanoId()
+	k.Ct = time.Now()
+	if err := d.orm.Create(k).Error; err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (d *DB) FindApiKey(id string) (*SysApiKey, error) {
+	var k SysApiKey
+	if err := d.orm.Where("id = ?", id).First(&k).Error; err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// QueryApiKeys pages the keys newest first
+func (d *DB) QueryApiKeys(filter ApiKeyFilter, size int32, off int32) (*Page, error) {
+	keys := make([]SysApiKey, 0)
+	query := BuildWhere(d.orm.Model(&SysApiKey{}), filter)
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		err := query.Order("ct desc").Limit(int(size)).Offset(int(off * size)).Find(&keys).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	var pages int64 = 1
+	if count > 0 && size > 0 {
+		pages = int64(math.Ceil(float64(count) / float64(size)))
+	}
+	return &Page{
+		TotalPages:    pages,
+		TotalElements: count,
+		Content:       keys,
+	}, nil
+}
+
+// UpdateApiKey saves the name, permits, address allowlist and expiry of a key
+func (d *DB) UpdateApiKey(k *SysApiKey) error {
+	return d.orm.Model(&SysApiKey{}).Where("id = ?", k.Id).
+		Select("name", "permits", "allow_ips", "exp").
+		Updates(k).Error
+}
+
+// RevokeApiKey rejects a key from now on and reports false when it was revoked before
+func (d *DB) RevokeApiKey(id string) (bool, error) {
+	result := d.orm.Model(&SysApiKey{}).
+		Where("id = ? and revoked is null", id).
+		Update("revoked", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (d *DB) DeleteApiKey(id string) error {
+	return d.orm.Where("id = ?", id).Delete(&SysApiKey{}).Error
+}
+
+// TouchApiKey records when and where a key was last used
+func (d *DB) TouchApiKey(id string, at time.Time, ip string) error {
+	return d.orm.Model(&SysApiKey{}).Where("id = ?", id).Updates(map[string]any{
+		"last_used": at,
+		"last_ip":   ip,
+	}).Error
+}
+
+// CountLiveApiKeys counts the keys of a user that are neither revoked nor expired
+func (d *DB) CountLiveApiKeys(uid string) (int64, error) {
+	var count int64
+	err := d.orm.Model(&SysApiKey{}).
+		Where("uid = ? and revoked is null and (exp is null or exp > ?)", uid, time.Now()).
+		Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"math"
+	"time"
+)
+
+// SysLockEvent audits the locks caused by sign-in failures and their release
+type SysLockEvent struct {
+	Id int64 `json:"id" gorm:"primaryKey;autoIncrement"`
+	// Identify is the account name or the client address of an address lock
+	Identify string     `json:"identify" gorm:"type:varchar(100);index"`
+	Kind     string     `json:"kind" gorm:"type:varchar(10)"`
+	Action   string     `json:"action" gorm:"type:varchar(20)"`
+	Ip       string     `json:"ip" gorm:"type:varchar(50)"`
+	Fails    int        `json:"fails" gorm:"type:int not null"`
+	Until    *time.Time `json:"until" gorm:"type:datetime"`
+	Operator string     `json:"operator" gorm:"type:varchar(50)"`
+	Ct       time.Time  `json:"ct" gorm:"type:datetime not null;default:CURRENT_TIMESTAMP;index"`
+}
+
+type LockEventFilter struct {
+	Identify string `json:"identify" query:"type:equal,field:identify,omitempty"`
+	Action   string `json:"action" query:"type:equal,field:action,omitempty"`
+}
+
+func (d *DB) CreateLockEvent(e *SysLockEvent) error {
+	if e.Ct.IsZero() {
+		e.Ct = time.Now()
+	}
+	return d.orm.Create(e).Error
+}
+
+// QueryLockEvents pages the audit newest first
+func (d *DB) QueryLockEvents(filter LockEventFilter, size int32, off int32) (*Page, error) {
+	events := make([]SysLockEvent, 0)
+	query := BuildWhere(d.orm.Model(&SysLockEvent{}), filter)
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		err := query.Order("id desc").Limit(int(size)).Offset(int(off * size)).Find(&events).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	var pages int64 = 1
+	if count > 0 && size > 0 {
+		pages = int64(math.Ceil(float64(count) / float64(size)))
+	}
+	return &Page{
+		TotalPages:    pages,
+		TotalElements: count,
+		Content:       events,
+	}, nil
+}
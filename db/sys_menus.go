@@ -40,6 +40,38 @@ func (d *DB) GetMenuById(mid int, preload bool) (*SysMenu, error) {
 	return &menu, nil
 }
 
+func (d *DB) GetMenusByIds(ids []int) ([]SysMenu, error) {
+	menus := make([]SysMenu, 0)
+	if len(ids) == 0 {
+		return menus, nil
+	}
+	err := d.orm.Model(&SysMenu{}).
+		Where("id in (?)", ids).
+		Find(&menus).Error
+	if err != nil {
+		return nil, err
+	}
+	return menus, nil
+}
+
+// GetMenusByRoleCodes returns the flat list of menus assigned to any of the roles
+func (d *DB) GetMenusByRoleCodes(codes []string) ([]SysMenu, error) {
+	menus := make([]SysMenu, 0)
+	if len(codes) == 0 {
+		return menus, nil
+	}
+	err := d.orm.Model(&SysMenu{}).Distinct("sys_menus.*").
+		Joins("JOIN sys_role_menu ON sys_role_menu.sys_menu_id = sys_menus.id").
+		Joins("JOIN sys_roles ON sys_roles.id = sys_role_menu.sys_role_id").
+		Where("sys_roles.code in (?)", codes).
+		Order("sys_menus.sort asc").
+		Find(&menus).Error
+	if err != nil {
+		return nil, err
+	}
+	return menus, nil
+}
+
 func (d *DB) GetMenuByName(com string) (*SysMenu, error) {
 	var menu SysMenu
 	err := d.orm.Model(&SysMenu{}).
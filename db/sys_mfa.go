@@ -0,0 +1,109 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SysRecoveryCode is a one-time code that replaces a totp code, only its digest is kept
+type SysRecoveryCode struct {
+	Id   int64      `json:"id" gorm:"primaryKey;autoIncrement"`
+	Uid  string     `json:"uid" gorm:"type:varchar(21);index"`
+	Hash string     `json:"-" gorm:"type:varchar(64)"`
+	Used *time.Time `json:"used" gorm:"type:datetime"`
+	Ct   time.Time  `json:"ct" gorm:"type:datetime not null;default:CURRENT_TIMESTAMP"`
+}
+
+// SaveMfaSecret starts an enrollment, the secret is unused until EnableMfa confirms it
+func (d *DB) SaveMfaSecret(uid, secret string) error {
+	return d.orm.Model(&SysUser{}).Where("id = ?", uid).Updates(map[string]any{
+		"mfa_secret":  secret,
+		"mfa_enabled": false,
+		"mfa_step":    0,
+		"ut":          time.Now(),
+	}).Error
+}
+
+// EnableMfa confirms an enrollment at the time step of the confirming code and replaces
+// the recovery codes of the user
+func (d *DB) EnableMfa(uid string, step int64, hashes []string) error {
+	return d.orm.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&SysUser{}).Where("id = ?", uid).Updates(map[string]any{
+			"mfa_enabled": true,
+			"mfa_step":    step,
+			"ut":          time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		return replaceRecoveryCodes(tx, uid, hashes)
+	})
+}
+
+// ResetMfa removes the second factor and the recovery codes of a user
+func (d *DB) ResetMfa(uid string) error {
+	return d.orm.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&SysUser{}).Where("id = ?", uid).Updates(map[string]any{
+			"mfa_secret":  "",
+			"mfa_enabled": false,
+			"mfa_step":    0,
+			"ut":          time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("uid = ?", uid).Delete(&SysRecoveryCode{}).Error
+	})
+}
+
+// AdvanceMfaStep records that a code of the time step was used and reports false when a
+// code of the same or a later step was used before
+func (d *DB) AdvanceMfaStep(uid string, step int64) (bool, error) {
+	result := d.orm.Model(&SysUser{}).
+		Where("id = ? and mfa_step < ?", uid, step).
+		Update("mfa_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (d *DB) ReplaceRecoveryCodes(uid string, hashes []string) error {
+	return d.orm.Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, uid, hashes)
+	})
+}
+
+// UseRecoveryCode spends an unused recovery code of a user and reports whether there was one
+func (d *DB) UseRecoveryCode(uid, hash string) (bool, error) {
+	result := d.orm.Model(&SysRecoveryCode{}).
+		Where("uid = ? and hash = ? and used is null", uid, hash).
+		Update("used", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (d *DB) CountRecoveryCodes(uid string) (int64, error) {
+	var count int64
+	err := d.orm.Model(&SysRecoveryCode{}).
+		Where("uid = ? and used is null", uid).
+		Count(&count).Error
+	return count, err
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, uid string, hashes []string) error {
+	if err := tx.Where("uid = ?", uid).Delete(&SysRecoveryCode{}).Error; err != nil {
+		return err
+	}
+	codes := make([]SysRecoveryCode, 0, len(hashes))
+	for _, hash := range hashes {
+		codes = append(codes, SysRecoveryCode{Uid: uid, Hash: hash, Ct: time.Now()})
+	}
+	if len(codes) == 0 {
+		return nil
+	}
+	return tx.Create(&codes).Error
+}
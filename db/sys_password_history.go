@@ -0,0 +1,72 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SysPasswordHistory keeps the hashes of the recent passwords of a user so they aren't reused
+type SysPasswordHistory struct {
+	Id   int64     `json:"id" gorm:"primaryKey;autoIncrement"`
+	Uid  string    `json:"uid" gorm:"type:varchar(21);index"`
+	Hash string    `json:"-" gorm:"type:varchar(200)"`
+	Ct   time.Time `json:"ct" gorm:"type:datetime not null;default:CURRENT_TIMESTAMP"`
+}
+
+// GetPasswordHistory lists the last size password hashes of a user, newest first
+func (d *DB) GetPasswordHistory(uid string, size int) ([]SysPasswordHistory, error) {
+	history := make([]SysPasswordHistory, 0)
+	err := d.orm.Model(&SysPasswordHistory{}).
+		Where("uid = ?", uid).
+		Order("id desc").
+		Limit(size).
+		Find(&history).Error
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// AddPasswordHistory records a password hash of a user and keeps the last keep of them
+func (d *DB) AddPasswordHistory(uid, hash string, keep int) error {
+	return d.orm.Transaction(func(tx *gorm.DB) error {
+		return addPasswordHistory(tx, uid, hash, keep)
+	})
+}
+
+// SetUserPassword replaces the password of a user and records it in the history
+func (d *DB) SetUserPassword(uid, hash string, keep int) error {
+	return d.orm.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Model(&SysUser{}).Where("id = ?", uid).Updates(map[string]any{
+			"password":    hash,
+			"pwd_changed": now,
+			"ut":          now,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return addPasswordHistory(tx, uid, hash, keep)
+	})
+}
+
+func addPasswordHistory(tx *gorm.DB, uid, hash string, keep int) error {
+	query := tx.Where("uid = ?", uid)
+	if keep > 0 {
+		if err := tx.Create(&SysPasswordHistory{Uid: uid, Hash: hash, Ct: time.Now()}).Error; err != nil {
+			return err
+		}
+		var kept []int64
+		err := tx.Model(&SysPasswordHistory{}).
+			Where("uid = ?", uid).
+			Order("id desc").
+			Limit(keep).
+			Pluck("id", &kept).Error
+		if err != nil {
+			return err
+		}
+		query = query.Where("id not in ?", kept)
+	}
+	return query.Delete(&SysPasswordHistory{}).Error
+}
@@ -57,6 +57,20 @@ func (d *DB) GetPermissionById(pid int, preload bool) (*SysPermission, error) {
 	return &permit, nil
 }
 
+func (d *DB) GetPermissionsByIds(ids []int) ([]SysPermission, error) {
+	permits := make([]SysPermission, 0)
+	if len(ids) == 0 {
+		return permits, nil
+	}
+	err := d.orm.Model(&SysPermission{}).
+		Where("id in (?)", ids).
+		Find(&permits).Error
+	if err != nil {
+		return nil, err
+	}
+	return permits, nil
+}
+
 func (d *DB) GetPermissionByName(name string, preload bool) (*SysPermission, error) {
 	var permit SysPermission
 	ctx := d.orm.Model(&SysPermission{}).
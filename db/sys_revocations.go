@@ -0,0 +1,72 @@
+package db
+
+import (
+	"time"
+)
+
+// SysTokenRevocation revokes one token by its jwt id until the token can no longer be used
+type SysTokenRevocation struct {
+	Jti       string    `json:"jti" gorm:"type:varchar(64);primaryKey"`
+	Principal string    `json:"principal" gorm:"type:varchar(50);index"`
+	Reason    string    `json:"reason" gorm:"type:varchar(50)"`
+	Ct        time.Time `json:"ct" gorm:"type:datetime;index"`
+	Exp       time.Time `json:"exp" gorm:"type:datetime;index"`
+}
+
+// SysTokenCutoff revokes every token of a principal issued up to Before
+type SysTokenCutoff struct {
+	Principal string    `json:"principal" gorm:"type:varchar(50);primaryKey"`
+	Before    time.Time `json:"before" gorm:"type:datetime"`
+	Exp       time.Time `json:"exp" gorm:"type:datetime;index"`
+}
+
+func (d *DB) RevokeToken(r *SysTokenRevocation) error {
+	return d.orm.Save(r).Error
+}
+
+func (d *DB) IsTokenRevoked(jti string) (bool, error) {
+	var count int64
+	err := d.orm.Model(&SysTokenRevocation{}).
+		Where("jti = ? and exp > ?", jti, time.Now()).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// GetRevocationsSince lists the live revocations created after since
+func (d *DB) GetRevocationsSince(since time.Time) ([]SysTokenRevocation, error) {
+	revocations := make([]SysTokenRevocation, 0)
+	err := d.orm.Model(&SysTokenRevocation{}).
+		Where("ct > ? and exp > ?", since, time.Now()).
+		Find(&revocations).Error
+	if err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+func (d *DB) SaveTokenCutoff(c *SysTokenCutoff) error {
+	return d.orm.Save(c).Error
+}
+
+func (d *DB) GetTokenCutoffs() ([]SysTokenCutoff, error) {
+	cutoffs := make([]SysTokenCutoff, 0)
+	err := d.orm.Model(&SysTokenCutoff{}).
+		Where("exp > ?", time.Now()).
+		Find(&cutoffs).Error
+	if err != nil {
+		return nil, err
+	}
+	return cutoffs, nil
+}
+
+// PurgeRevocations removes the revocations and cutoffs of tokens that have all expired
+func (d *DB) PurgeRevocations() error {
+	now := time.Now()
+	if err := d.orm.Where("exp <= ?", now).Delete(&SysTokenRevocation{}).Error; err != nil {
+		return err
+	}
+	return d.orm.Where("exp <= ?", now).Delete(&SysTokenCutoff{}).Error
+}
@@ -12,6 +12,8 @@ type SysRole struct {
 	Ct          time.Time       `json:"ct" gorm:"type:datetime not null;default:CURRENT_TIMESTAMP"`
 	Menus       []SysMenu       `json:"menus" gorm:"many2many:sys_role_menu"`
 	Permissions []SysPermission `json:"permissions" gorm:"many2many:sys_role_permission"`
+	// RequireMfa makes the members of the role sign in with a second factor
+	RequireMfa bool `json:"require_mfa" gorm:"type:tinyint(1)"`
 }
 
 type SysRoleMenu struct {
@@ -73,6 +75,34 @@ func (d *DB) GetRoleById(id int, preload bool) (*SysRole, error) {
 	return &role, nil
 }
 
+func (d *DB) GetRolesByIds(ids []int) ([]SysRole, error) {
+	roles := make([]SysRole, 0)
+	if len(ids) == 0 {
+		return roles, nil
+	}
+	err := d.orm.Model(&SysRole{}).
+		Where("id in (?)", ids).
+		Find(&roles).Error
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (d *DB) GetRolesByCodes(codes []string) ([]SysRole, error) {
+	roles := make([]SysRole, 0)
+	if len(codes) == 0 {
+		return roles, nil
+	}
+	err := d.orm.Model(&SysRole{}).
+		Where("code in (?)", codes).
+		Find(&roles).Error
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
 func (d *DB) GetRoleByName(name string) (*SysRole, error) {
 	var role SysRole
 	err := d.orm.Model(&SysRole{}).
@@ -0,0 +1,25 @@
+package db
+
+import "time"
+
+// SysRoutePermit overrides the permit of one route at runtime, white listed routes need no token
+type SysRoutePermit struct {
+	Id        int       `json:"id" gorm:"type:int not null;autoIncrement;primaryKey;unique;uniqueIndex"`
+	Url       string    `json:"url" gorm:"type:varchar(255);uniqueIndex"`
+	Permit    string    `json:"permit" gorm:"type:varchar(100)"`
+	WhiteList bool      `json:"white_list" gorm:"type:tinyint(1)"`
+	Enable    bool      `json:"enable" gorm:"type:tinyint(1)"`
+	Ut        time.Time `json:"ut" gorm:"type:datetime not null;default:CURRENT_TIMESTAMP"`
+}
+
+func (d *DB) GetRoutePermits() ([]SysRoutePermit, error) {
+	var permits []SysRoutePermit
+	err := d.orm.Model(&SysRoutePermit{}).
+		Where("enable = ?", true).
+		Order("id asc").
+		Find(&permits).Error
+	if err != nil {
+		return nil, err
+	}
+	return permits, nil
+}
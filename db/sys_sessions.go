@@ -0,0 +1,124 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SysSession persists one signed-in token, the session itself is stored as json in Data
+type SysSession struct {
+	Id        string    `json:"id" gorm:"type:varchar(64);primaryKey"`
+	Principal string    `json:"principal" gorm:"type:varchar(50);index"`
+	Data      string    `json:"data" gorm:"type:text"`
+	Exp       time.Time `json:"exp" gorm:"type:datetime;index"`
+	Version   int64     `json:"version" gorm:"type:bigint not null;default:0"`
+}
+
+// SysAuthCounter holds expiring counters and deadlines such as sign-in failures and locks
+type SysAuthCounter struct {
+	Key   string    `json:"key" gorm:"type:varchar(150);primaryKey"`
+	Count int       `json:"count" gorm:"type:int not null"`
+	Exp   time.Time `json:"exp" gorm:"type:datetime;index"`
+}
+
+func (d *DB) SaveSession(s *SysSession) error {
+	return d.orm.Save(s).Error
+}
+
+// SwapSession updates a live session only while it is still stored at version, it reports
+// whether the row was updated
+func (d *DB) SwapSession(s *SysSession, version int64) (bool, error) {
+	result := d.orm.Model(&SysSession{}).
+		Where("id = ? and version = ? and exp > ?", s.Id, version, time.Now()).
+		Updates(map[string]any{
+			"data":    s.Data,
+			"exp":     s.Exp,
+			"version": s.Version,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (d *DB) GetSession(id string) (*SysSession, error) {
+	var s SysSession
+	err := d.orm.Model(&SysSession{}).
+		Where("id = ? and exp > ?", id, time.Now()).
+		First(&s).Error
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (d *DB) GetSessions(principal string) ([]SysSession, error) {
+	sessions := make([]SysSession, 0)
+	ctx := d.orm.Model(&SysSession{}).
+		Where("exp > ?", time.Now())
+	if principal != "" {
+		ctx = ctx.Where("principal = ?", principal)
+	}
+	err := ctx.Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (d *DB) DeleteSession(id string) error {
+	return d.orm.Where("id = ?", id).Delete(&SysSession{}).Error
+}
+
+// IncrCounter adds one to a counter, a counter past its expiry restarts at one with a new ttl
+func (d *DB) IncrCounter(key string, ttl time.Duration) (int, error) {
+	var counter SysAuthCounter
+	err := d.orm.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.OnConflict{
+			DoUpdates: clause.Assignments(map[string]any{
+				"count": gorm.Expr("CASE WHEN exp < ? THEN 1 ELSE count + 1 END", now),
+				"exp":   gorm.Expr("CASE WHEN exp < ? THEN ? ELSE exp END", now, now.Add(ttl)),
+			}),
+		}).Create(&SysAuthCounter{Key: key, Count: 1, Exp: now.Add(ttl)}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("`key` = ?", key).First(&counter).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return counter.Count, nil
+}
+
+// SetCounter overwrites a counter and its expiry
+func (d *DB) SetCounter(key string, count int, exp time.Time) error {
+	return d.orm.Save(&SysAuthCounter{Key: key, Count: count, Exp: exp}).Error
+}
+
+func (d *DB) GetCounter(key string) (*SysAuthCounter, error) {
+	var counter SysAuthCounter
+	err := d.orm.Model(&SysAuthCounter{}).
+		Where("`key` = ? and exp > ?", key, time.Now()).
+		First(&counter).Error
+	if err != nil {
+		return nil, err
+	}
+	return &counter, nil
+}
+
+func (d *DB) DeleteCounter(key string) error {
+	return d.orm.Where("`key` = ?", key).Delete(&SysAuthCounter{}).Error
+}
+
+// PurgeExpired removes the sessions and counters past their expiry
+func (d *DB) PurgeExpired() error {
+	now := time.Now()
+	if err := d.orm.Where("exp <= ?", now).Delete(&SysSession{}).Error; err != nil {
+		return err
+	}
+	return d.orm.Where("exp <= ?", now).Delete(&SysAuthCounter{}).Error
+}
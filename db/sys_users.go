@@ -19,12 +19,22 @@ type SysUser struct {
 	Enable      bool      `json:"enable" gorm:"type:tinyint(1)"`
 	GrantBy     string    `json:"grant_by" gorm:"type:varchar(10)"`
 	LoginTimes  int       `json:"login_times" gorm:"type:int not null"`
-	LockBy      string    `json:"lock_by" gorm:"type:varchar(10)"`
+	LockBy      string    `json:"lock_by" gorm:"type:varchar(20)"`
 	Header      string    `json:"header" gorm:"type:varchar(300)"`
+	OpenId      string    `json:"open_id" gorm:"type:varchar(100);index"`
 	Ct          time.Time `json:"ct" gorm:"type:datetime not null;default:CURRENT_TIMESTAMP"`
 	Ut          time.Time `json:"ut" gorm:"type:datetime not null;default:CURRENT_TIMESTAMP"`
 	Roles       []SysRole `json:"roles" gorm:"many2many:sys_user_role"`
 	Authorities []string  `json:"authorities" gorm:"-:all"`
+	// LockedUntil is when a lock by repeated sign-in failures ends
+	LockedUntil *time.Time `json:"locked_until" gorm:"type:datetime;index"`
+	// PwdChanged is when the password was last set, the password ages from Ct when it is nil
+	PwdChanged *time.Time `json:"pwd_changed" gorm:"type:datetime"`
+	// MfaSecret is the encrypted totp secret, MfaEnabled is set once the enrollment is confirmed
+	MfaSecret  string `json:"-" gorm:"type:varchar(200)"`
+	MfaEnabled bool   `json:"mfa_enabled" gorm:"type:tinyint(1)"`
+	// MfaStep is the last totp time step a code was accepted for, every code is good once
+	MfaStep int64 `json:"-" gorm:"type:bigint not null;default:0"`
 }
 
 type UserFilter struct {
@@ -135,6 +145,24 @@ func (d *DB) FindUserByIdentify(identify string, preload bool) (*SysUser, error)
 	return &u, nil
 }
 
+// FindUserByOpenId finds the user linked to an external account, open ids have the form provider:subject
+func (d *DB) FindUserByOpenId(openId string, preload bool) (*SysUser, error) {
+	var u SysUser
+	ctx := d.orm.Model(&SysUser{}).
+		Where("open_id = ?", openId)
+	if preload {
+		ctx = ctx.Preload(clause.Associations, Preload)
+	}
+	err := ctx.First(&u).Error
+	if err != nil {
+		return nil, err
+	}
+	if preload {
+		u.Authorities = fillAuthorities(u.Roles)
+	}
+	return &u, nil
+}
+
 func (d *DB) QueryUserBy(name, email, phone string) (*SysUser, error) {
 	var u SysUser
 	ctx := d.orm.Model(&SysUser{})
@@ -142,10 +170,10 @@ func (d *DB) QueryUserBy(name, email, phone string) (*SysUser, error) {
 		ctx = ctx.Or("name = ?", name)
 	}
 	if email != "" {
-		ctx = ctx.Or("email = ?", name)
+		ctx = ctx.Or("email = ?", email)
 	}
 	if phone != "" {
-		ctx = ctx.Or("phone = ?", name)
+		ctx = ctx.Or("phone = ?", phone)
 	}
 	err := ctx.First(&u).Error
 	if err != nil {
@@ -195,6 +223,40 @@ func (d *DB) UpdateUserWithId(u *SysUser, m map[string]any, aso any) (*SysUser,
 	return &ux, nil
 }
 
+// LockUserByFails disables a user until the lock ends
+func (d *DB) LockUserByFails(uid string, until time.Time) error {
+	return d.orm.Model(&SysUser{}).Where("id = ?", uid).Updates(map[string]any{
+		"enable":       false,
+		"lock_by":      "lockByFails",
+		"locked_until": until,
+		"ut":           time.Now(),
+	}).Error
+}
+
+// UnlockUserByFails enables a user locked by sign-in failures, it reports false when the
+// user wasn't locked that way, for instance because another replica unlocked it first
+func (d *DB) UnlockUserByFails(uid string) (bool, error) {
+	result := d.orm.Model(&SysUser{}).Where("id = ? and lock_by = ?", uid, "lockByFails").Updates(map[string]any{
+		"enable":       true,
+		"lock_by":      "none",
+		"locked_until": nil,
+		"ut":           time.Now(),
+	})
+	return result.RowsAffected > 0, result.Error
+}
+
+// FindExpiredLockedUsers lists the users whose sign-in failure lock has ended
+func (d *DB) FindExpiredLockedUsers() ([]SysUser, error) {
+	var users []SysUser
+	err := d.orm.Model(&SysUser{}).
+		Where("lock_by = ? and locked_until <= ?", "lockByFails", time.Now()).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 func (d *DB) DeleteUserById(uid string) (string, error) {
 	u, err := d.FindUserById(uid, false)
 	if err != nil {
@@ -0,0 +1,166 @@
+package infra
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"golang-ast/db"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emirpasic/gods/sets/hashset"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	// ApiKeyPrefix starts every personal access token, pat_<id>_<secret>
+	ApiKeyPrefix     = "pat_"
+	apiKeyIdSize     = 21
+	apiKeySecretSize = 32
+)
+
+var (
+	ErrApiKeyInvalid  = errors.New("invalid api key")
+	ErrApiKeyAddress  = errors.New("api key is not allowed from this address")
+	ErrTooManyApiKeys = errors.New("too many api keys, revoke one first")
+)
+
+// CreateApiKey stores a new key of the owner and returns its token, the token is shown
+// once and can't be recovered from the stored digest
+func (a *Authorization) CreateApiKey(owner *db.SysUser, key *db.SysApiKey) (string, error) {
+	live, err := a.db.CountLiveApiKeys(owner.Id)
+	if err != nil {
+		return "", err
+	}
+	if live >= int64(a.cfg.ApiKey.MaxKeys) {
+		return "", ErrTooManyApiKeys
+	}
+	raw := make([]byte, apiKeySecretSize)
+	if _, err = rand.Read(raw); err != nil {
+		return "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	key.Uid, key.Owner, key.Hash = owner.Id, owner.Name, hashApiKeySecret(secret)
+	if _, err = a.db.CreateApiKey(key); err != nil {
+		return "", err
+	}
+	return ApiKeyPrefix + key.Id + "_" + secret, nil
+}
+
+// AuthenticateApiKey checks a token and returns the authentication of its owner narrowed
+// to the permits of the key. The key and the roles of its owner are read on every request,
+// so a revocation or a role change made on any replica applies at once
+func (a *Authorization) AuthenticateApiKey(token, ip string) (*Authentication, error) {
+	id, secret, ok := parseApiKey(token)
+	if !ok {
+		return nil, ErrApiKeyInvalid
+	}
+	key, err := a.db.FindApiKey(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrApiKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashApiKeySecret(secret)), []byte(key.Hash)) != 1 {
+		return nil, ErrApiKeyInvalid
+	}
+	now := time.Now()
+	if key.Revoked != nil || key.Exp != nil && now.After(*key.Exp) {
+		return nil, ErrApiKeyInvalid
+	}
+	if !addressAllowed(key.AllowIps, ip) {
+		return nil, ErrApiKeyAddress
+	}
+	authentication, err := a.apiKeyAuthentication(key)
+	if err != nil {
+		return nil, err
+	}
+	// the last use is written at most once a minute
+	if key.LastUsed == nil || now.Sub(*key.LastUsed) > seenInterval {
+		if err = a.db.TouchApiKey(key.Id, now, ip); err != nil {
+			a.log.Error("AuthenticateApiKey().TouchApiKey error", zap.Error(err))
+		}
+	}
+	return authentication, nil
+}
+
+// apiKeyAuthentication loads the owner of a key and narrows its authorities to the key
+func (a *Authorization) apiKeyAuthentication(key *db.SysApiKey) (*Authentication, error) {
+	owner, err := a.db.FindUserById(key.Uid, true)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrApiKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !owner.Enable || owner.LockBy != "none" {
+		return nil, ErrApiKeyInvalid
+	}
+	// a permit the owner lost is not granted by the key
+	authorities := hashset.New()
+	for _, name := range authorityNames(owner.Roles) {
+		if len(key.Permits) == 0 || containsString(key.Permits, name) {
+			authorities.Add(name)
+		}
+	}
+	return &Authentication{
+		apiKeyId:        key.Id,
+		principal:       owner.Name,
+		isAuthenticated: true,
+		authorities:     authorities,
+		roles:           roleCodes(owner.Roles),
+	}, nil
+}
+
+// parseApiKey splits pat_<id>_<secret>, the id has a fixed size as it may contain '_'
+func parseApiKey(token string) (string, string, bool) {
+	if !strings.HasPrefix(token, ApiKeyPrefix) {
+		return "", "", false
+	}
+	rest := token[len(ApiKeyPrefix):]
+	if len(rest) <= apiKeyIdSize+1 || rest[apiKeyIdSize] != '_' {
+		return "", "", false
+	}
+	return rest[:apiKeyIdSize], rest[apiKeyIdSize+1:], true
+}
+
+// hashApiKeySecret digests a secret, the secrets are random enough for a plain sha256
+func hashApiKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func addressAllowed(allowed []string, ip string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range allowed {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if other := net.ParseIP(entry); other != nil && other.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
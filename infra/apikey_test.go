@@ -0,0 +1,180 @@
+package infra
+
+import (
+	"errors"
+	"golang-ast/conf"
+	"golang-ast/db"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestParseApiKey(t *testing.T) {
+	id := strings.Repeat("a", apiKeyIdSize)
+	tests := []struct {
+		name   string
+		token  string
+		id     string
+		secret string
+		ok     bool
+	}{
+		{name: "valid", token: "pat_" + id + "_secret", id: id, secret: "secret", ok: true},
+		{name: "underscores in id and secret", token: "pat_a_b" + id[3:] + "_s_t", id: "a_b" + id[3:], secret: "s_t", ok: true},
+		{name: "no prefix", token: id + "_secret"},
+		{name: "other prefix", token: "tok_" + id + "_secret"},
+		{name: "short id", token: "pat_" + id[1:] + "_secret"},
+		{name: "no separator", token: "pat_" + id + "secret"},
+		{name: "no secret", token: "pat_" + id + "_"},
+		{name: "empty", token: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, secret, ok := parseApiKey(tt.token)
+			if id != tt.id || secret != tt.secret || ok != tt.ok {
+				t.Errorf("parseApiKey(%q) = %q, %q, %v, want %q, %q, %v", tt.token, id, secret, ok, tt.id, tt.secret, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAddressAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		ip      string
+		want    bool
+	}{
+		{name: "no allowlist", ip: "203.0.113.9", want: true},
+		{name: "exact address", allowed: []string{"203.0.113.9"}, ip: "203.0.113.9", want: true},
+		{name: "other address", allowed: []string{"203.0.113.9"}, ip: "203.0.113.10"},
+		{name: "in range", allowed: []string{"10.0.0.0/8"}, ip: "10.20.30.40", want: true},
+		{name: "out of range", allowed: []string{"10.0.0.0/8"}, ip: "11.0.0.1"},
+		{name: "second entry", allowed: []string{"10.0.0.0/8", "192.168.1.1"}, ip: "192.168.1.1", want: true},
+		{name: "ipv6 range", allowed: []string{"2001:db8::/32"}, ip: "2001:db8::1", want: true},
+		{name: "ipv4 mapped ipv6", allowed: []string{"203.0.113.9"}, ip: "::ffff:203.0.113.9", want: true},
+		{name: "invalid entry", allowed: []string{"not an address"}, ip: "203.0.113.9"},
+		{name: "invalid client", allowed: []string{"0.0.0.0/0"}, ip: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addressAllowed(tt.allowed, tt.ip); got != tt.want {
+				t.Errorf("addressAllowed(%v, %q) = %v, want %v", tt.allowed, tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func newApiKeyAuthorization(t *testing.T) (*Authorization, *db.SysUser) {
+	t.Helper()
+	cfg := &conf.AuthConfig{ApiKey: conf.ApiKeyConfig{MaxAge: 365, MaxKeys: 3}}
+	a := &Authorization{cfg: cfg, log: zap.NewNop(), db: testDB(t)}
+	// the int ids of roles and permits don't auto increment in sqlite, and its join tables
+	// migrate with a unique index per column, so the owner holds a single permit
+	owner, err := a.db.CreateUser(&db.SysUser{Name: "alice", Enable: true, LockBy: "none", Roles: []db.SysRole{{
+		Id:          1,
+		Code:        "OPS",
+		Permissions: []db.SysPermission{{Id: 1, Name: "USER_READ"}},
+	}}})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	return a, owner
+}
+
+func sortedAuthorities(authentication *Authentication) []string {
+	var names []string
+	for _, value := range authentication.Authorities().Values() {
+		names = append(names, value.(string))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestAuthenticateApiKey(t *testing.T) {
+	a, owner := newApiKeyAuthorization(t)
+	past := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name        string
+		key         db.SysApiKey
+		ip          string
+		authorities string
+		err         error
+	}{
+		{name: "all permits of the owner", key: db.SysApiKey{Name: "all"}, ip: "10.0.0.1", authorities: "USER_READ"},
+		{name: "permit subset", key: db.SysApiKey{Name: "read", Permits: []string{"USER_READ"}}, ip: "10.0.0.1", authorities: "USER_READ"},
+		// a permit the owner doesn't hold is never granted by the key
+		{name: "permit beyond the owner", key: db.SysApiKey{Name: "admin", Permits: []string{"USER_READ", "ROLE_WRITE"}}, ip: "10.0.0.1", authorities: "USER_READ"},
+		{name: "no permit of the owner", key: db.SysApiKey{Name: "roles", Permits: []string{"ROLE_WRITE"}}, ip: "10.0.0.1"},
+		{name: "allowed address", key: db.SysApiKey{Name: "ci", AllowIps: []string{"10.0.0.0/24"}}, ip: "10.0.0.1", authorities: "USER_READ"},
+		{name: "other address", key: db.SysApiKey{Name: "ci", AllowIps: []string{"10.0.0.0/24"}}, ip: "10.0.1.1", err: ErrApiKeyAddress},
+		{name: "expired", key: db.SysApiKey{Name: "old", Exp: &past}, ip: "10.0.0.1", err: ErrApiKeyInvalid},
+		{name: "revoked", key: db.SysApiKey{Name: "gone", Revoked: &past}, ip: "10.0.0.1", err: ErrApiKeyInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := tt.key
+			token, err := a.CreateApiKey(owner, &key)
+			if err != nil {
+				t.Fatalf("CreateApiKey() error = %v", err)
+			}
+			// the keys count towards max_keys, the tests only keep the live ones they need
+			defer func() {
+				_, _ = a.db.RevokeApiKey(key.Id)
+			}()
+			authentication, err := a.AuthenticateApiKey(token, tt.ip)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("AuthenticateApiKey() error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if got := strings.Join(sortedAuthorities(authentication), ","); got != tt.authorities {
+				t.Errorf("AuthenticateApiKey() authorities = %v, want %v", got, tt.authorities)
+			}
+			if authentication.Principal() != "alice" || authentication.ApiKeyId() != key.Id {
+				t.Errorf("AuthenticateApiKey() = %v of key %v, want alice of %v",
+					authentication.Principal(), authentication.ApiKeyId(), key.Id)
+			}
+			if stored, _ := a.db.FindApiKey(key.Id); stored.LastUsed == nil || stored.LastIp != tt.ip {
+				t.Errorf("key after use = %+v, want last used from %v", stored, tt.ip)
+			}
+		})
+	}
+}
+
+func TestAuthenticateApiKeyRejects(t *testing.T) {
+	a, owner := newApiKeyAuthorization(t)
+	key := &db.SysApiKey{Name: "ci"}
+	token, err := a.CreateApiKey(owner, key)
+	if err != nil {
+		t.Fatalf("CreateApiKey() error = %v", err)
+	}
+	if key.Hash == "" || strings.Contains(token, key.Hash) || !strings.HasPrefix(token, ApiKeyPrefix+key.Id+"_") {
+		t.Errorf("CreateApiKey() = %v with hash %v, want pat_<id>_<secret> and only the digest stored", token, key.Hash)
+	}
+	for _, forged := range []string{"", "pat_", token[:len(token)-1], token + "x", ApiKeyPrefix + strings.Repeat("x", apiKeyIdSize) + "_secret"} {
+		if _, err = a.AuthenticateApiKey(forged, "10.0.0.1"); !errors.Is(err, ErrApiKeyInvalid) {
+			t.Errorf("AuthenticateApiKey(%q) error = %v, want ErrApiKeyInvalid", forged, err)
+		}
+	}
+
+	// the owner is read on every request, disabling it stops its keys at once
+	if err = a.db.LockUserByFails(owner.Id, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("LockUserByFails() error = %v", err)
+	}
+	if _, err = a.AuthenticateApiKey(token, "10.0.0.1"); !errors.Is(err, ErrApiKeyInvalid) {
+		t.Errorf("AuthenticateApiKey(locked owner) error = %v, want ErrApiKeyInvalid", err)
+	}
+
+	for i := 0; i < a.cfg.ApiKey.MaxKeys-1; i++ {
+		if _, err = a.CreateApiKey(owner, &db.SysApiKey{Name: "more"}); err != nil {
+			t.Fatalf("CreateApiKey() error = %v", err)
+		}
+	}
+	if _, err = a.CreateApiKey(owner, &db.SysApiKey{Name: "one too many"}); !errors.Is(err, ErrTooManyApiKeys) {
+		t.Errorf("CreateApiKey(over max_keys) error = %v, want ErrTooManyApiKeys", err)
+	}
+}
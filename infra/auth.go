@@ -1,15 +1,20 @@
 package infra
 
 import (
+	"context"
 	"errors"
 	"golang-ast/conf"
 	"golang-ast/db"
 	"golang-ast/utils"
+	"math"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/emirpasic/gods/sets/hashset"
 	"github.com/gofiber/fiber/v2"
@@ -25,9 +30,12 @@ func GetAuthHandler() *Authorization {
 }
 
 type Authentication struct {
+	sessionId       string
+	scope           string
+	apiKeyId        string
 	authorities     *hashset.Set
+	roles           []string
 	principal       string
-	credentials     string
 	isAuthenticated bool
 }
 
@@ -39,12 +47,28 @@ func (a *Authentication) SetAuthorities(authorities *hashset.Set) {
 	a.authorities = authorities
 }
 
-func (a *Authentication) Principal() string {
-	return a.principal
+// Roles returns the codes of the roles the authorities were created from
+func (a *Authentication) Roles() []string {
+	return a.roles
+}
+
+// SessionId is the jwt id of the session the authentication was loaded from
+func (a *Authentication) SessionId() string {
+	return a.sessionId
+}
+
+// ApiKeyId is the id of the api key a request was authenticated with, it is empty for a session
+func (a *Authentication) ApiKeyId() string {
+	return a.apiKeyId
 }
 
-func (a *Authentication) Credentials() string {
-	return a.credentials
+// Scope is the scope of a restricted session, it is empty for a full session
+func (a *Authentication) Scope() string {
+	return a.scope
+}
+
+func (a *Authentication) Principal() string {
+	return a.principal
 }
 
 func (a *Authentication) IsAuthenticated() bool {
@@ -55,68 +79,183 @@ func (a *Authentication) SetIsAuthenticated(isAuthenticated bool) {
 	a.isAuthenticated = isAuthenticated
 }
 
-type FailStatus struct {
-	times int
-	ut    time.Time
+const (
+	seenInterval   = time.Minute
+	maxAgentLength = 200
+	// maxSessionSwaps bounds the retries of a session update losing against other writers
+	maxSessionSwaps = 5
+)
+
+// scopeStatus is the sign-in status reported with a scoped token
+var scopeStatus = map[string]string{
+	ScopeMfa:            "Mfa required",
+	ScopeMfaSetup:       "Mfa setup required",
+	ScopePasswordChange: "Password expired",
 }
 
+var (
+	ErrTooManySessions = errors.New("too many active sessions, sign out on another device first")
+	ErrSessionConflict = errors.New("session is updated concurrently, please retry")
+)
+
 type Authorization struct {
-	jwt           *JWT
-	cfg           *conf.AuthConfig
-	log           *zap.Logger
-	db            *db.DB
-	lock          *sync.RWMutex
-	trie          *Trie
-	tokenStore    sync.Map
-	monitor       *time.Ticker
-	quit          chan bool
-	authorizes    map[string]*Authentication
-	loginList     *hashset.Set
-	lockList      map[string]time.Time
-	loginFailList map[string]FailStatus
-}
-
-func NewAuthorization(cfg *conf.AuthConfig, db *db.DB, log *zap.Logger) {
+	jwt             *JWT
+	cfg             *conf.AuthConfig
+	log             *zap.Logger
+	db              *db.DB
+	trie            atomic.Pointer[Trie]
+	permitLock      sync.Mutex
+	embeddedPermits *conf.PermitConfig
+	filePermits     *conf.PermitConfig
+	dbPermits       *conf.PermitConfig
+	permitTicker    *time.Ticker
+	permitCancel    context.CancelFunc
+	store           SessionStore
+	passwords       *PasswordHasher
+	policy          *PasswordPolicy
+	revocations     *RevocationList
+	monitor         *time.Ticker
+	quit            chan bool
+}
+
+func NewAuthorization(cfg *conf.AuthConfig, db *db.DB, log *zap.Logger) error {
+	token, err := NewJWT(cfg)
+	if err != nil {
+		return err
+	}
+	store, err := NewSessionStore(&cfg.Session, db)
+	if err != nil {
+		return err
+	}
+	revocations, err := NewRevocationList(db)
+	if err != nil {
+		_ = store.Close()
+		return err
+	}
 	authHandler = &Authorization{
-		jwt:           NewJWT(cfg),
-		db:            db,
-		log:           log,
-		cfg:           cfg,
-		tokenStore:    sync.Map{},
-		lock:          &sync.RWMutex{},
-		trie:          NewTrie(),
-		loginList:     hashset.New(),
-		lockList:      map[string]time.Time{},
-		loginFailList: map[string]FailStatus{},
-		authorizes:    make(map[string]*Authentication),
-		monitor:       time.NewTicker(time.Minute),
-		quit:          make(chan bool, 1),
-	}
-	for _, v := range cfg.Permits.Authentications {
-		authHandler.trie.Parse("/api"+v.Url, strings.Split(v.Permit, "|")[0])
-	}
-	for _, k := range cfg.Permits.WhiteList {
-		authHandler.trie.Parse("/api"+k, "*")
+		jwt:         token,
+		db:          db,
+		log:         log,
+		cfg:         cfg,
+		store:       store,
+		passwords:   NewPasswordHasher(&cfg.Password),
+		policy:      NewPasswordPolicy(&cfg.Password.Policy),
+		revocations: revocations,
+		monitor:     time.NewTicker(time.Minute),
+		quit:        make(chan bool, 1),
 	}
+	authHandler.initPermits()
 	go authHandler.monitorTick()
+	return nil
 }
 
 func (a *Authorization) Close() {
+	a.permitCancel()
 	a.quit <- true
+	if err := a.store.Close(); err != nil {
+		a.log.Error("Close().store close error", zap.Error(err))
+	}
 }
 
-func (a *Authorization) IsAlreadyLogin(username string) bool {
-	a.lock.RLock()
-	defer a.lock.RUnlock()
-	return a.loginList.Contains(username)
+// Sessions lists the live sessions of a user, or of everyone when username is empty,
+// oldest first
+func (a *Authorization) Sessions(username string) ([]*Session, error) {
+	sessions, err := a.store.Sessions(context.Background(), username)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Ct.Before(sessions[j].Ct)
+	})
+	return sessions, nil
 }
 
-func (a *Authorization) CreateToken(jwtId string, user *db.SysUser) (string, error) {
+// KickSession signs one session out and revokes its token
+func (a *Authorization) KickSession(id, reason string) (*Session, error) {
+	ctx := context.Background()
+	session, err := a.store.GetSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = a.revocations.Revoke(session.Id, session.Principal, reason, session.Ct.Add(a.tokenLifetime())); err != nil {
+		return nil, err
+	}
+	return session, a.store.DeleteSession(ctx, session.Id)
+}
+
+// KickOtherSessions signs a user out of every session but keep, their tokens and refresh
+// families are revoked
+func (a *Authorization) KickOtherSessions(username, keep, reason string) error {
+	sessions, err := a.store.Sessions(context.Background(), username)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.Id == keep {
+			continue
+		}
+		if _, err = a.KickSession(session.Id, reason); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateSession applies update to a session and swaps it into the store, the update is
+// retried on the stored state when another writer changed the session in between
+func (a *Authorization) updateSession(ctx context.Context, session *Session, update func(session *Session) error) error {
+	for i := 0; i < maxSessionSwaps; i++ {
+		if err := update(session); err != nil {
+			return err
+		}
+		swapped, err := a.store.SwapSession(ctx, session)
+		if err != nil || swapped {
+			return err
+		}
+		if session, err = a.store.GetSession(ctx, session.Id); err != nil {
+			return err
+		}
+	}
+	return ErrSessionConflict
+}
+
+// admitSession applies the concurrent session limit to a new sign-in of the user
+func (a *Authorization) admitSession(username string) error {
+	limit := a.cfg.Session.MaxSessions
+	if limit <= 0 {
+		return nil
+	}
+	all, err := a.Sessions(username)
+	if err != nil {
+		return err
+	}
+	// the short-lived sessions of unfinished sign-ins, such as a pending mfa step, don't count
+	sessions := all[:0]
+	for _, session := range all {
+		if session.Scope == "" {
+			sessions = append(sessions, session)
+		}
+	}
+	if len(sessions) < limit {
+		return nil
+	}
+	if a.cfg.Session.Overflow == "reject" {
+		return ErrTooManySessions
+	}
+	for _, session := range sessions[:len(sessions)-limit+1] {
+		if _, err = a.KickSession(session.Id, "evicted"); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Authorization) CreateToken(jwtId string, user *db.SysUser, scope string) (string, error) {
 	var roles []string
 	for _, role := range user.Roles {
 		roles = append(roles, role.Code)
 	}
-	return a.jwt.CreateToken(jwtId, user.Id, user.Name, roles)
+	return a.jwt.CreateToken(jwtId, user.Id, user.Name, roles, scope)
 }
 
 func (a *Authorization) ParseToken(token string) (*JWTClaims, error) {
@@ -124,7 +263,7 @@ func (a *Authorization) ParseToken(token string) (*JWTClaims, error) {
 }
 
 func (a *Authorization) TrieSearch(path string) (bool, any, map[string]string) {
-	match, err := a.trie.Match(path)
+	match, err := a.trie.Load().Match(path)
 	if err != nil || match == nil {
 		return false, nil, nil
 	}
@@ -139,32 +278,77 @@ func (a *Authorization) RefreshToken(token string) (string, error) {
 }
 
 func (a *Authorization) OnAuthSuccessHandler(user *db.SysUser, ctx *fiber.Ctx) error {
-	if tokenObj, ok := a.tokenStore.Load(user.Id); ok {
-		_, err := a.ParseToken(tokenObj.(string))
-		if err == nil {
-			return OkWithMessage(map[string]string{
-				"username": user.Name,
-				"tk":       tokenObj.(string),
-				"status":   "Login success",
-			}, ctx)
+	return a.onAuthSuccess(user, false, ctx)
+}
+
+// OnMfaSuccessHandler completes a sign-in whose second factor was verified
+func (a *Authorization) OnMfaSuccessHandler(user *db.SysUser, ctx *fiber.Ctx) error {
+	return a.onAuthSuccess(user, true, ctx)
+}
+
+func (a *Authorization) onAuthSuccess(user *db.SysUser, mfaVerified bool, ctx *fiber.Ctx) error {
+	// an unfinished sign-in only gets a token for its next step
+	scope, exp := "", time.Duration(a.cfg.JwtExp)*time.Hour
+	switch {
+	case !mfaVerified && user.MfaEnabled:
+		scope = ScopeMfa
+	case !mfaVerified && a.MfaRequired(user):
+		scope = ScopeMfaSetup
+	case a.PasswordExpired(user):
+		scope = ScopePasswordChange
+	}
+	if scope != "" {
+		exp = scopedTokenExp
+	} else {
+		// only a finished sign-in takes a session slot, an unfinished one neither evicts nor is refused
+		if err := a.admitSession(user.Name); errors.Is(err, ErrTooManySessions) {
+			return FailWithMessage(http.StatusConflict, err.Error(), ctx)
+		} else if err != nil {
+			a.log.Error("OnAuthSuccessHandler().admitSession error", zap.Error(err))
+			return Fail(http.StatusInternalServerError, ctx)
+		}
+		if !a.RefreshEnabled() {
+			// renewed tokens keep the jwt id, the session has to outlive every renewal
+			exp = a.tokenLifetime()
 		}
 	}
 	jwtId := utils.MustNanoId()
-	token, err := a.CreateToken(jwtId, user)
+	token, err := a.CreateToken(jwtId, user, scope)
 	if err != nil {
-		return FailWithMessage(http.StatusForbidden, "token gen failed:"+err.Error(), ctx)
+		a.log.Error("OnAuthSuccessHandler().CreateToken error", zap.Error(err))
+		return Fail(http.StatusInternalServerError, ctx)
 	}
-	a.tokenStore.Store(jwtId, token)
-	a.lock.Lock()
-	a.authorizes[jwtId] = &Authentication{
-		principal:       user.Name,
-		credentials:     user.Password,
-		isAuthenticated: true,
-		authorities:     createAuthorities(user.Roles),
+	now := time.Now()
+	session := &Session{
+		Id:          jwtId,
+		Uid:         user.Id,
+		Principal:   user.Name,
+		Roles:       roleCodes(user.Roles),
+		Authorities: authorityNames(user.Roles),
+		Ip:          ctx.IP(),
+		Agent:       truncate(ctx.Get(fiber.HeaderUserAgent), maxAgentLength),
+		Ct:          now,
+		Seen:        now,
+		Exp:         now.Add(exp),
+		Scope:       scope,
 	}
-	a.loginList.Add(user.Name)
-	a.lock.Unlock()
-	a.SetAuthentication(ctx, jwtId)
+	var refresh string
+	if a.RefreshEnabled() && scope == "" {
+		if refresh, err = a.rotateRefreshToken(session); err != nil {
+			a.log.Error("OnAuthSuccessHandler().rotateRefreshToken error", zap.Error(err))
+			return Fail(http.StatusInternalServerError, ctx)
+		}
+	}
+	if err = a.store.SaveSession(ctx.UserContext(), session); err != nil {
+		a.log.Error("OnAuthSuccessHandler().SaveSession error", zap.Error(err))
+		return FailWithMessage(http.StatusInternalServerError, "session save failed", ctx)
+	}
+	for _, identify := range []string{user.Name, user.Email, user.Phone} {
+		if identify != "" {
+			_ = a.store.ResetFails(ctx.UserContext(), identify)
+		}
+	}
+	ctx.Locals("auth", newAuthentication(session))
 	go func() {
 		_, err = a.db.UpdateUserWithId(user, map[string]any{
 			"id":          user.Id,
@@ -174,119 +358,162 @@ func (a *Authorization) OnAuthSuccessHandler(user *db.SysUser, ctx *fiber.Ctx) e
 			a.log.Error("update login times error", zap.Error(err))
 		}
 	}()
-	if user.GrantBy == "github" {
-		return ctx.Redirect(a.cfg.RedirectUrl + "?grant=git&tk=" + token)
+	// oauth logins come from a browser redirect, hand the token back to the front end
+	if user.OpenId != "" {
+		grant := user.GrantBy
+		if grant == "github" {
+			grant = "git"
+		}
+		target := a.cfg.RedirectUrl + "?grant=" + url.QueryEscape(grant) + "&tk=" + token
+		if scope != "" {
+			target += "&scope=" + scope
+		}
+		if refresh != "" {
+			target += "&rt=" + url.QueryEscape(refresh)
+		}
+		return ctx.Redirect(target)
 	}
-	return OkWithMessage(map[string]string{
+	result := map[string]any{
 		"username": user.Name,
 		"tk":       token,
 		"status":   "Login success",
-	}, ctx)
+	}
+	if scope != "" {
+		result["status"] = scopeStatus[scope]
+		result["scope"] = scope
+	}
+	if refresh != "" {
+		result["refresh_token"] = refresh
+		result["expires_in"] = int(a.jwt.Expires.Seconds())
+	}
+	return OkWithMessage(result, ctx)
 }
 
 func (a *Authorization) OnAuthFailedHandler(identify string, err error, ctx *fiber.Ctx) error {
-	a.lock.RLock()
-	defer a.lock.RUnlock()
-	if totalFails, ok := a.loginFailList[identify]; ok {
-		totalFails.times = totalFails.times + 1
-		totalFails.ut = time.Now()
-		a.loginFailList[identify] = totalFails
-		if totalFails.times >= 5 {
-			user, _ := a.db.FindUserByIdentify(identify, false)
-			if user != nil {
-				_, errLock := a.db.UpdateUserWithId(user, map[string]any{
-					"id":      user.Id,
-					"enable":  false,
-					"lock_by": "lockByFails",
-				}, nil)
-				if errLock != nil {
-					a.log.Error("OnAuthFailedHandler().UpdateUser(). update user lock error", zap.Error(errLock))
-					return errLock
-				}
-				delete(a.loginFailList, identify)
-				a.lockList[identify] = time.Now().Add(time.Second * 60)
-				go a.unlockJob(identify)
-				err = errors.New("错误次数过多，账户已锁定，解锁时间60秒后")
-			}
-		}
-	} else {
-		a.loginFailList[identify] = FailStatus{
-			times: 1,
-			ut:    time.Now(),
-		}
-	}
-	if exp, ok := a.lockList[identify]; ok && identify != "" {
-		remain := int(time.Until(exp).Seconds())
+	a.recordFailure(ctx.UserContext(), identify, ctx.IP())
+	if exp, ok := a.LockedUntil(identify, ctx.IP()); ok {
+		remain := int(math.Ceil(time.Until(exp).Seconds()))
 		err = errors.New("错误次数过多，账户已锁定，" + strconv.Itoa(remain) + "秒后解锁")
-		if remain == 0 {
-			err = errors.New("账户锁定已解除")
-		}
 	}
-	return FailWithMessage(http.StatusUnauthorized, err, ctx)
+	return FailWithMessage(http.StatusUnauthorized, err.Error(), ctx)
 }
 
 func (a *Authorization) OnSignOutHandler(claim *JWTClaims, ctx *fiber.Ctx) error {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	delete(a.authorizes, claim.ID)
-	a.loginList.Remove(claim.Name)
-	a.tokenStore.Delete(claim.ID)
+	// the token stays rejected on every replica even if a session is rebuilt for it
+	if err := a.revocations.Revoke(claim.ID, claim.Name, "logout", a.tokenExpiry(claim)); err != nil {
+		a.log.Error("OnSignOutHandler().Revoke error", zap.Error(err))
+		return Fail(http.StatusInternalServerError, ctx)
+	}
+	if err := a.store.DeleteSession(ctx.UserContext(), claim.ID); err != nil {
+		a.log.Error("OnSignOutHandler().DeleteSession error", zap.Error(err))
+		return Fail(http.StatusInternalServerError, ctx)
+	}
 	return OkWithMessage(claim.Name, ctx)
 }
 
-func (a *Authorization) SetAuthentication(ctx *fiber.Ctx, id string) {
-	a.lock.RLock()
-	defer a.lock.RUnlock()
-	ctx.Locals("auth", a.authorizes[id])
-}
-
+// GetAuthentication loads the session of a token, a session whose roles changed gets its
+// authorities reloaded from the database
 func (a *Authorization) GetAuthentication(claim *JWTClaims) (*Authentication, error) {
-	a.lock.RLock()
-	permit, ok := a.authorizes[claim.ID]
-	a.lock.RUnlock()
-	if ok {
-		return permit, nil
-	} else {
-		u, err := a.db.FindUserByIdentify(claim.Name, true)
-		if err != nil {
-			a.log.Error("GetAuthentication().loadUserByName error", zap.Error(err))
-			return nil, err
+	ctx := context.Background()
+	session, err := a.store.GetSession(ctx, claim.ID)
+	if err != nil {
+		return nil, err
+	}
+	dirty := false
+	if session.Authorities == nil {
+		u, errUser := a.db.FindUserByIdentify(claim.Name, true)
+		if errUser != nil {
+			a.log.Error("GetAuthentication().loadUserByName error", zap.Error(errUser))
+			return nil, errUser
 		}
 		if !u.Enable || u.LockBy != "none" {
 			a.log.Error("GetAuthentication().Try load disabled or locked user")
 			return nil, errors.New("user has been disabled")
 		}
-		jwtId := utils.MustNanoId()
-		permit = &Authentication{
-			principal:       u.Name,
-			credentials:     u.Password,
-			isAuthenticated: true,
-			authorities:     createAuthorities(u.Roles),
+		session.Roles, session.Authorities = roleCodes(u.Roles), authorityNames(u.Roles)
+		dirty = true
+	}
+	// a renewed token outlives the session it was issued with, a refresh family keeps the
+	// expiry of its sign-in
+	if !a.RefreshEnabled() && claim.ExpiresAt != nil && claim.ExpiresAt.After(session.Exp) {
+		session.Exp = claim.ExpiresAt.Time
+		dirty = true
+	}
+	if now := time.Now(); now.Sub(session.Seen) > seenInterval {
+		session.Seen = now
+		dirty = true
+	}
+	// a session changed in between, by a refresh or an invalidation, is not written over,
+	// the next request catches up
+	if dirty {
+		if _, err = a.store.SwapSession(ctx, session); err != nil {
+			a.log.Error("GetAuthentication().SwapSession error", zap.Error(err))
 		}
-		a.lock.Lock()
-		a.authorizes[jwtId] = permit
-		a.lock.Unlock()
-		return permit, nil
 	}
+	return newAuthentication(session), nil
 }
 
+// RemoveAuthentication signs a user out of every session
 func (a *Authorization) RemoveAuthentication(username string) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	if a.loginList.Contains(username) {
-		a.loginList.Remove(username)
-	}
-	for k, v := range a.authorizes {
-		if v.principal == username {
-			delete(a.authorizes, k)
-			a.tokenStore.Delete(k)
-			break
+	ctx := context.Background()
+	sessions, err := a.store.Sessions(ctx, username)
+	if err != nil {
+		a.log.Error("RemoveAuthentication().Sessions error", zap.Error(err))
+		return
+	}
+	for _, session := range sessions {
+		if err = a.store.DeleteSession(ctx, session.Id); err != nil {
+			a.log.Error("RemoveAuthentication().DeleteSession error", zap.Error(err))
+		}
+	}
+}
+
+// InvalidateRoles marks the sessions of every user holding one of the roles, their next
+// request reloads the authorities from the database without signing in again
+func (a *Authorization) InvalidateRoles(codes ...string) {
+	a.invalidateSessions(func(session *Session) bool {
+		return session.hasAnyRole(codes)
+	})
+}
+
+// InvalidateAuthorities marks the sessions holding one of the permissions like InvalidateRoles,
+// after a permission was renamed or deleted
+func (a *Authorization) InvalidateAuthorities(names ...string) {
+	a.invalidateSessions(func(session *Session) bool {
+		return session.hasAnyAuthority(names)
+	})
+}
+
+// invalidateSessions clears the authorities of the matching sessions through a swap, so a
+// request saving the same session concurrently can't write the stale authorities back
+func (a *Authorization) invalidateSessions(match func(session *Session) bool) {
+	ctx := context.Background()
+	sessions, err := a.store.Sessions(ctx, "")
+	if err != nil {
+		a.log.Error("invalidateSessions().Sessions error", zap.Error(err))
+		return
+	}
+	for _, session := range sessions {
+		if !match(session) {
+			continue
+		}
+		err = a.updateSession(ctx, session, func(session *Session) error {
+			session.Authorities = nil
+			return nil
+		})
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			a.log.Error("invalidateSessions().updateSession error", zap.String("session", session.Id), zap.Error(err))
 		}
 	}
 }
 
 func (a *Authorization) monitorTick() {
 	defer a.monitor.Stop()
+	var permitTick <-chan time.Time
+	if a.permitTicker != nil {
+		defer a.permitTicker.Stop()
+		permitTick = a.permitTicker.C
+	}
 	for {
 		select {
 		case <-a.quit:
@@ -294,44 +521,206 @@ func (a *Authorization) monitorTick() {
 			return
 		case <-a.monitor.C:
 			a.cleanList()
+			a.releaseLocks()
+			a.rotateKeys()
+		case <-permitTick:
+			a.ReloadPermits()
 		}
 	}
 }
 
 func (a *Authorization) cleanList() {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	for k, v := range a.loginFailList {
-		if _, ok := a.lockList[k]; !ok && time.Since(v.ut).Seconds() > 100 {
-			delete(a.loginFailList, k)
+	if err := a.store.Purge(context.Background()); err != nil {
+		a.log.Error("cleanList().Purge error", zap.Error(err))
+	}
+	if err := a.revocations.Sync(); err != nil {
+		a.log.Error("cleanList().revocations sync error", zap.Error(err))
+	}
+	if err := a.revocations.Purge(); err != nil {
+		a.log.Error("cleanList().revocations purge error", zap.Error(err))
+	}
+}
+
+// IsRevoked reports whether the token was signed out or revoked by an administrator
+func (a *Authorization) IsRevoked(claim *JWTClaims) (bool, error) {
+	return a.revocations.IsRevoked(claim)
+}
+
+// RevokeUser rejects every token issued to a user so far and signs the user out
+func (a *Authorization) RevokeUser(username string) error {
+	now := time.Now()
+	if err := a.revocations.RevokeBefore(username, now, now.Add(a.tokenLifetime())); err != nil {
+		return err
+	}
+	a.RemoveAuthentication(username)
+	return nil
+}
+
+// tokenLifetime is how long a token stays usable after it was issued, renewals included
+func (a *Authorization) tokenLifetime() time.Duration {
+	if a.RefreshEnabled() {
+		return a.jwt.Expires
+	}
+	return (maxRenewals + 1) * a.jwt.Expires
+}
+
+func (a *Authorization) tokenExpiry(claim *JWTClaims) time.Time {
+	if claim.IssuedAt != nil {
+		return claim.IssuedAt.Add(a.tokenLifetime())
+	}
+	return time.Now().Add(a.tokenLifetime())
+}
+
+// rotateKeys picks up the keys of other replicas and rotates the signing key when due
+func (a *Authorization) rotateKeys() {
+	if a.jwt.Keys == nil {
+		return
+	}
+	if err := a.jwt.Keys.Reload(); err != nil {
+		a.log.Error("rotateKeys().Reload error", zap.Error(err))
+		return
+	}
+	if err := a.jwt.Keys.Rotate(); err != nil {
+		a.log.Error("rotateKeys().Rotate error", zap.Error(err))
+	}
+}
+
+// JWKS is the public key set tokens are verified with, it is empty for HS256
+func (a *Authorization) JWKS() (*JSONWebKeySet, error) {
+	if a.jwt.Keys == nil {
+		return &JSONWebKeySet{Keys: []JSONWebKey{}}, nil
+	}
+	return a.jwt.Keys.JWKS()
+}
+
+// HashPassword hashes a new password of a user
+func (a *Authorization) HashPassword(password string) (string, error) {
+	return a.passwords.Hash(password)
+}
+
+// CheckPassword returns every policy rule a new password of the user violates, the
+// history is checked for users that already exist
+func (a *Authorization) CheckPassword(user *db.SysUser, password string) ([]string, error) {
+	violations := a.policy.Check(user.Name, password)
+	keep := a.cfg.Password.Policy.History
+	if keep == 0 || user.Id == "" {
+		return violations, nil
+	}
+	history, err := a.db.GetPasswordHistory(user.Id, keep)
+	if err != nil {
+		return nil, err
+	}
+	// the current password is checked as well, it has no history when set before the policy
+	hashes := []string{user.Password}
+	for _, record := range history {
+		hashes = append(hashes, record.Hash)
+	}
+	for _, hash := range hashes {
+		if ok, _ := a.passwords.Verify(hash, password); ok {
+			violations = append(violations, "history="+strconv.Itoa(keep))
+			break
 		}
 	}
+	return violations, nil
 }
 
-func (a *Authorization) unlockJob(identify string) {
-	time.Sleep(time.Second * 60)
-	user, _ := a.db.FindUserByIdentify(identify, false)
-	if user != nil {
-		_, err := a.db.UpdateUserWithId(user, map[string]any{
-			"id":      user.Id,
-			"enable":  true,
-			"lock_by": "none",
-		}, nil)
+// SetPassword replaces the password of a user, the policy must have been checked before
+func (a *Authorization) SetPassword(user *db.SysUser, password string) error {
+	hash, err := a.passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	if err = a.db.SetUserPassword(user.Id, hash, a.cfg.Password.Policy.History); err != nil {
+		return err
+	}
+	now := time.Now()
+	user.Password, user.PwdChanged = hash, &now
+	return nil
+}
+
+// RecordPassword adds the password hash of a created user to its history
+func (a *Authorization) RecordPassword(user *db.SysUser) error {
+	return a.db.AddPasswordHistory(user.Id, user.Password, a.cfg.Password.Policy.History)
+}
+
+// PasswordExpired reports whether the password of a user is older than the max age, users
+// of an oauth login have no password to expire
+func (a *Authorization) PasswordExpired(user *db.SysUser) bool {
+	maxAge := a.cfg.Password.Policy.MaxAge
+	if maxAge == 0 || user.OpenId != "" {
+		return false
+	}
+	changed := user.Ct
+	if user.PwdChanged != nil {
+		changed = *user.PwdChanged
+	}
+	return time.Since(changed) > time.Duration(maxAge)*24*time.Hour
+}
+
+// VerifyPassword checks the password of a user, a hash made with outdated settings or a
+// legacy plaintext password is replaced by a current hash
+func (a *Authorization) VerifyPassword(user *db.SysUser, password string) bool {
+	ok, rehash := a.passwords.Verify(user.Password, password)
+	if ok && rehash {
+		hash, err := a.passwords.Hash(password)
+		if err == nil {
+			_, err = a.db.UpdateUserWithId(user, map[string]any{"id": user.Id, "password": hash}, nil)
+		}
 		if err != nil {
-			a.log.Error("unlockJob().UpdateUser(). update user lock error", zap.Error(err))
+			a.log.Error("VerifyPassword().rehash error", zap.Error(err))
+		} else {
+			user.Password = hash
 		}
 	}
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	delete(a.lockList, identify)
+	return ok
+}
+
+// VerifyUnknownPassword takes as long as VerifyPassword for a sign-in that has no user or
+// no usable password to check, so response times don't tell which accounts exist
+func (a *Authorization) VerifyUnknownPassword(password string) {
+	a.passwords.VerifyDummy(password)
+}
+
+func roleCodes(roles []db.SysRole) []string {
+	codes := make([]string, 0, len(roles))
+	for _, role := range roles {
+		codes = append(codes, role.Code)
+	}
+	return codes
 }
 
-func createAuthorities(roles []db.SysRole) *hashset.Set {
-	auths := hashset.New()
+func authorityNames(roles []db.SysRole) []string {
+	names := make([]string, 0)
 	for _, role := range roles {
 		for _, permit := range role.Permissions {
-			auths.Add(permit.Name)
+			names = append(names, permit.Name)
 		}
 	}
-	return auths
+	return names
+}
+
+// truncate cuts a string to at most size bytes without splitting a rune
+func truncate(value string, size int) string {
+	if len(value) <= size {
+		return value
+	}
+	for size > 0 && !utf8.RuneStart(value[size]) {
+		size--
+	}
+	return value[:size]
+}
+
+func newAuthentication(session *Session) *Authentication {
+	authorities := hashset.New()
+	for _, name := range session.Authorities {
+		authorities.Add(name)
+	}
+	return &Authentication{
+		sessionId:       session.Id,
+		scope:           session.Scope,
+		principal:       session.Principal,
+		isAuthenticated: true,
+		authorities:     authorities,
+		roles:           session.Roles,
+	}
 }
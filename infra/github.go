@@ -0,0 +1,147 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang-ast/conf"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	gitAuthUrl  = "https://github.com/login/oauth/authorize"
+	gitTokenUrl = "https://github.com/login/oauth/access_token"
+	gitApiUrl   = "https://api.github.com"
+	gitScope    = "read:user user:email"
+)
+
+// gitProfile is the part of the github user we keep
+type gitProfile struct {
+	Id        int64  `json:"id"`
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	AvatarUrl string `json:"avatar_url"`
+}
+
+// GitHub signs users in with a github oauth app
+type GitHub struct {
+	cfg    conf.ProviderConfig
+	client *http.Client
+}
+
+func NewGitHub(cfg conf.ProviderConfig) *GitHub {
+	if cfg.AuthUrl == "" {
+		cfg.AuthUrl = gitAuthUrl
+	}
+	if cfg.TokenUrl == "" {
+		cfg.TokenUrl = gitTokenUrl
+	}
+	if cfg.ApiUrl == "" {
+		cfg.ApiUrl = gitApiUrl
+	}
+	return &GitHub{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (g *GitHub) Name() string {
+	return g.cfg.Name
+}
+
+func (g *GitHub) AuthCodeURL(_ context.Context, req *AuthRequest) (string, error) {
+	scope := gitScope
+	if len(g.cfg.Scopes) > 0 {
+		scope = strings.Join(g.cfg.Scopes, " ")
+	}
+	query := url.Values{
+		"client_id":             {g.cfg.ClientId},
+		"redirect_uri":          {req.RedirectUri},
+		"scope":                 {scope},
+		"state":                 {req.State},
+		"code_challenge":        {req.Challenge()},
+		"code_challenge_method": {"S256"},
+	}
+	return g.cfg.AuthUrl + "?" + query.Encode(), nil
+}
+
+func (g *GitHub) Exchange(ctx context.Context, req *AuthRequest, code string) (*Identity, error) {
+	token, err := g.accessToken(ctx, req, code)
+	if err != nil {
+		return nil, err
+	}
+	var profile gitProfile
+	if err = g.api(ctx, token, "/user", &profile); err != nil {
+		return nil, err
+	}
+	if profile.Id == 0 || profile.Login == "" {
+		return nil, errors.New("github returned an empty profile")
+	}
+	// the public email is often hidden, fall back to the verified primary address
+	if profile.Email == "" {
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		if g.api(ctx, token, "/user/emails", &emails) == nil {
+			for _, email := range emails {
+				if email.Primary && email.Verified {
+					profile.Email = email.Email
+				}
+			}
+		}
+	}
+	return &Identity{
+		Provider: g.cfg.Name,
+		Subject:  strconv.FormatInt(profile.Id, 10),
+		Name:     profile.Login,
+		Nick:     profile.Name,
+		Email:    profile.Email,
+		Avatar:   profile.AvatarUrl,
+	}, nil
+}
+
+func (g *GitHub) accessToken(ctx context.Context, authReq *AuthRequest, code string) (string, error) {
+	form := url.Values{
+		"client_id":     {g.cfg.ClientId},
+		"client_secret": {g.cfg.ClientSecret},
+		"code":          {code},
+		"redirect_uri":  {authReq.RedirectUri},
+		"code_verifier": {authReq.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.cfg.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var body struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err = fetchJSON(g.client, req, &body); err != nil {
+		return "", err
+	}
+	if body.Error != "" {
+		return "", fmt.Errorf("github token exchange failed: %v %v", body.Error, body.Description)
+	}
+	if body.AccessToken == "" {
+		return "", errors.New("github returned no access token")
+	}
+	return body.AccessToken, nil
+}
+
+func (g *GitHub) api(ctx context.Context, token, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(g.cfg.ApiUrl, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return fetchJSON(g.client, req, out)
+}
@@ -0,0 +1,160 @@
+package infra
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"golang-ast/conf"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// fakeGitHub serves the oauth and api endpoints of github for one client
+type fakeGitHub struct {
+	*httptest.Server
+	challenge string
+	code      string
+	token     string
+}
+
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+	f := &fakeGitHub{code: "code-1", token: "gho_token"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parse token form: %v", err)
+		}
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		switch {
+		case r.PostForm.Get("client_id") != "id" || r.PostForm.Get("client_secret") != "secret":
+			writeJSON(w, map[string]string{"error": "incorrect_client_credentials"})
+		case r.PostForm.Get("code") != f.code:
+			writeJSON(w, map[string]string{"error": "bad_verification_code"})
+		case base64.RawURLEncoding.EncodeToString(sum[:]) != f.challenge:
+			writeJSON(w, map[string]string{"error": "invalid_grant", "error_description": "pkce"})
+		default:
+			writeJSON(w, map[string]string{"access_token": f.token, "token_type": "bearer"})
+		}
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+f.token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, gitProfile{Id: 42, Login: "octocat", Name: "The Octocat", AvatarUrl: "https://avatars/42"})
+	})
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, []map[string]any{
+			{"email": "old@example.com", "primary": false, "verified": true},
+			{"email": "octocat@example.com", "primary": true, "verified": true},
+		})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func newGitHubProviders(f *fakeGitHub) *Providers {
+	return NewProviders(&conf.AuthConfig{Providers: []conf.ProviderConfig{{
+		Name:         "github",
+		Type:         "github",
+		ClientId:     "id",
+		ClientSecret: "secret",
+		AuthUrl:      f.URL + "/login/oauth/authorize",
+		TokenUrl:     f.URL + "/login/oauth/access_token",
+		ApiUrl:       f.URL,
+	}}})
+}
+
+// authorize starts a login and hands the pkce challenge of the consent url to the fake
+func authorize(t *testing.T, p *Providers, name string) (string, *url.URL) {
+	target, state, err := p.Authorize(context.Background(), name, "http://localhost/callback")
+	if err != nil {
+		t.Fatalf("Authorize() error = %v", err)
+	}
+	consent, err := url.Parse(target)
+	if err != nil {
+		t.Fatalf("parse consent url: %v", err)
+	}
+	query := consent.Query()
+	if query.Get("state") != state {
+		t.Errorf("consent state = %q, want %q", query.Get("state"), state)
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Errorf("consent url misses the pkce challenge: %v", target)
+	}
+	return state, consent
+}
+
+func TestGitHubExchange(t *testing.T) {
+	f := newFakeGitHub(t)
+	p := newGitHubProviders(f)
+	state, consent := authorize(t, p, "github")
+	if consent.Path != "/login/oauth/authorize" || consent.Query().Get("client_id") != "id" {
+		t.Errorf("consent url = %v", consent)
+	}
+	f.challenge = consent.Query().Get("code_challenge")
+
+	identity, err := p.Exchange(context.Background(), "github", state, f.code)
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	want := Identity{Provider: "github", Subject: "42", Name: "octocat", Nick: "The Octocat",
+		Email: "octocat@example.com", Avatar: "https://avatars/42"}
+	if identity.OpenId() != "github:42" || identity.Name != want.Name || identity.Email != want.Email ||
+		identity.Nick != want.Nick || identity.Avatar != want.Avatar || identity.Roles != nil {
+		t.Errorf("Exchange() = %+v, want %+v", identity, want)
+	}
+}
+
+func TestGitHubState(t *testing.T) {
+	f := newFakeGitHub(t)
+	p := newGitHubProviders(f)
+	ctx := context.Background()
+
+	if _, err := p.Exchange(ctx, "github", "forged", f.code); !errors.Is(err, ErrOAuthStateInvalid) {
+		t.Errorf("Exchange(unknown state) error = %v, want ErrOAuthStateInvalid", err)
+	}
+	state, consent := authorize(t, p, "github")
+	f.challenge = consent.Query().Get("code_challenge")
+	if _, err := p.Exchange(ctx, "gitlab", state, f.code); !errors.Is(err, ErrOAuthStateInvalid) {
+		t.Errorf("Exchange(other provider) error = %v, want ErrOAuthStateInvalid", err)
+	}
+	// the failed attempt above consumed the state
+	if _, err := p.Exchange(ctx, "github", state, f.code); !errors.Is(err, ErrOAuthStateInvalid) {
+		t.Errorf("Exchange(consumed state) error = %v, want ErrOAuthStateInvalid", err)
+	}
+
+	state, consent = authorize(t, p, "github")
+	f.challenge = consent.Query().Get("code_challenge")
+	if _, err := p.Exchange(ctx, "github", state, f.code); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if _, err := p.Exchange(ctx, "github", state, f.code); !errors.Is(err, ErrOAuthStateInvalid) {
+		t.Errorf("Exchange(replayed state) error = %v, want ErrOAuthStateInvalid", err)
+	}
+	if _, _, err := p.Authorize(ctx, "gitlab", "http://localhost/callback"); !errors.Is(err, ErrProviderNotFound) {
+		t.Errorf("Authorize(unknown provider) error = %v, want ErrProviderNotFound", err)
+	}
+}
+
+func TestGitHubPKCE(t *testing.T) {
+	f := newFakeGitHub(t)
+	p := newGitHubProviders(f)
+	state, _ := authorize(t, p, "github")
+	// the challenge of another login doesn't match the verifier of this one
+	_, other := authorize(t, p, "github")
+	f.challenge = other.Query().Get("code_challenge")
+	if _, err := p.Exchange(context.Background(), "github", state, f.code); err == nil {
+		t.Error("Exchange() with a mismatching pkce verifier succeeded")
+	}
+}
@@ -11,7 +11,9 @@ import (
 
 type JWT struct {
 	SigningKey []byte
-	Expires    int
+	// Keys signs the tokens instead of SigningKey with an asymmetric algorithm
+	Keys    *KeySet
+	Expires time.Duration
 }
 
 type JWTClaims struct {
@@ -19,9 +21,24 @@ type JWTClaims struct {
 	Name         string `json:"name,omitempty"`
 	Role         string `json:"role,omitempty"`
 	RefreshTimes int    `json:"refreshTimes"`
+	// Scope restricts a token to one step of the sign-in, it is empty for a full token
+	Scope string `json:"scope,omitempty"`
 	jwt.RegisteredClaims
 }
 
+const (
+	// maxRenewals is how many times an expired token is re-signed in renew mode
+	maxRenewals = 8
+	// scopedTokenExp is the lifetime of a scoped token, it is never renewed
+	scopedTokenExp = 10 * time.Minute
+	// ScopePasswordChange is the scope of a sign-in with an expired password
+	ScopePasswordChange = "pwd_change"
+	// ScopeMfa is the scope of a sign-in waiting for its second factor
+	ScopeMfa = "mfa"
+	// ScopeMfaSetup is the scope of a sign-in that must enroll a second factor first
+	ScopeMfaSetup = "mfa_setup"
+)
+
 var (
 	ErrTokenExpired     = errors.New("token is expired")
 	ErrTokenNotValidYet = errors.New("token not active yet")
@@ -29,39 +46,82 @@ var (
 	ErrTokenInvalid     = errors.New("couldn't handle this token")
 )
 
-func NewJWT(config *conf.AuthConfig) *JWT {
-	return &JWT{
+func NewJWT(config *conf.AuthConfig) (*JWT, error) {
+	expires := time.Duration(config.JwtExp) * time.Hour
+	if config.TokenMode == "refresh" {
+		expires = time.Duration(config.AccessExp) * time.Minute
+	}
+	j := &JWT{
 		SigningKey: []byte(config.JwtKey),
-		Expires:    config.JwtExp,
+		Expires:    expires,
+	}
+	if config.JwtAlg != "" && config.JwtAlg != jwt.SigningMethodHS256.Alg() {
+		keys, err := NewKeySet(config.JwtKeyDir, config.JwtAlg,
+			time.Duration(config.JwtKeyRotate)*time.Hour, expires)
+		if err != nil {
+			return nil, err
+		}
+		j.Keys = keys
 	}
+	return j, nil
 }
 
-func (j *JWT) CreateToken(jwtId, uid, name string, roles []string) (string, error) {
+func (j *JWT) CreateToken(jwtId, uid, name string, roles []string, scope string) (string, error) {
 	claims := JWTClaims{
 		Uid:          uid,
 		Name:         name,
 		Role:         strings.Join(roles, ","),
 		RefreshTimes: 0,
+		Scope:        scope,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ID:       jwtId,
 			IssuedAt: jwt.NewNumericDate(time.Now()),
 			// 签名生效时间
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(int64(j.Expires) * int64(time.Hour)))), // 过期时间 7天  配置文件
-			Issuer:    "gateway",                                                                              // 签名的发行者
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(j.Expires)), // 过期时间 配置文件
+			Issuer:    "gateway",                                     // 签名的发行者
 		},
 	}
+	if scope != "" && j.Expires > scopedTokenExp {
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(scopedTokenExp))
+	}
+	return j.sign(&claims)
+}
+
+func (j *JWT) sign(claims *JWTClaims) (string, error) {
+	if j.Keys != nil {
+		return j.Keys.Sign(jwt.NewWithClaims(j.Keys.Method(), claims))
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(j.SigningKey)
 }
 
-func (j *JWT) ParseToken(tokenString string) (*JWTClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (i interface{}, e error) {
-		return j.SigningKey, nil
+func (j *JWT) parse(tokenString string) (*jwt.Token, error) {
+	method := jwt.SigningMethodHS256.Alg()
+	if j.Keys != nil {
+		method = j.Keys.Method().Alg()
+	}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{method}))
+	return parser.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if j.Keys == nil {
+			return j.SigningKey, nil
+		}
+		kid, _ := token.Header["kid"].(string)
+		if key, ok := j.Keys.PublicKey(kid); ok {
+			return key, nil
+		}
+		return nil, errors.New("unknown signing key " + kid)
 	})
+}
+
+func (j *JWT) ParseToken(tokenString string) (*JWTClaims, error) {
+	token, err := j.parse(tokenString)
 	if err != nil {
 		if ve, ok := err.(*jwt.ValidationError); ok {
 			if ve.Errors&jwt.ValidationErrorMalformed != 0 {
 				return nil, ErrTokenMalformed
+			} else if ve.Errors&^(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
+				// a forged token is invalid even when it is expired as well
+				return nil, ErrTokenInvalid
 			} else if ve.Errors&jwt.ValidationErrorExpired != 0 {
 				return nil, ErrTokenExpired
 			} else if ve.Errors&jwt.ValidationErrorNotValidYet != 0 {
@@ -85,20 +145,21 @@ func (j *JWT) ParseToken(tokenString string) (*JWTClaims, error) {
 
 func (j *JWT) RefreshToken(tokenString string) (string, error) {
 	jwt.TimeFunc = time.Now
-	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return j.SigningKey, nil
-	})
+	token, err := j.parse(tokenString)
 	if token == nil {
 		return "", err
 	}
+	// only a token whose sole fault is its age may be renewed
+	if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&^jwt.ValidationErrorExpired != 0 {
+		return "", ErrTokenInvalid
+	}
 	if claims, ok := token.Claims.(*JWTClaims); ok {
-		if claims.RefreshTimes > 7 {
+		if claims.RefreshTimes >= maxRenewals || claims.Scope != "" {
 			return "", ErrTokenExpired
 		}
 		claims.RefreshTimes = claims.RefreshTimes + 1
-		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Duration(int64(j.Expires) * int64(time.Hour))))
-		token = jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		return token.SignedString(j.SigningKey)
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(j.Expires))
+		return j.sign(claims)
 	}
 	return "", ErrTokenInvalid
 }
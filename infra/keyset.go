@@ -0,0 +1,320 @@
+package infra
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang-ast/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// keyLockFile is held by the replica generating a key, a lock older than keyLockStale
+	// was left behind by a replica that died while generating
+	keyLockFile  = ".generate.lock"
+	keyLockStale = time.Minute
+	keyLockPoll  = 100 * time.Millisecond
+)
+
+// signingKey is one private key of the key set, its kid is the name of its pem file
+type signingKey struct {
+	kid string
+	key crypto.Signer
+	ct  time.Time
+}
+
+// KeySet holds the asymmetric keys tokens are signed with. The newest key signs, the
+// older ones only verify until the last token they signed has expired. Replicas sharing
+// the key directory pick up the keys the others generate on Reload
+type KeySet struct {
+	dir    string
+	alg    string
+	method jwt.SigningMethod
+	// rotate is the age of the signing key after which a new one is generated, 0 never rotates
+	rotate time.Duration
+	// retain is how long a replaced key still verifies, the lifetime of the tokens it signed
+	retain time.Duration
+	lock   sync.RWMutex
+	keys   []*signingKey
+}
+
+func NewKeySet(dir, alg string, rotate, retain time.Duration) (*KeySet, error) {
+	method := jwt.GetSigningMethod(alg)
+	if method == nil || alg == jwt.SigningMethodHS256.Alg() {
+		return nil, errors.New("unsupported key set algorithm " + alg)
+	}
+	k := &KeySet{dir: dir, alg: alg, method: method, rotate: rotate, retain: retain}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	if k.signer() == nil {
+		if err := k.generate(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Reload reads the pem files of the key directory, keys of another algorithm are ignored
+func (k *KeySet) Reload() error {
+	entries, err := os.ReadDir(k.dir)
+	if err != nil {
+		return err
+	}
+	keys := make([]*signingKey, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".pem" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		signer, err := readPrivateKey(filepath.Join(k.dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("%v: %w", entry.Name(), err)
+		}
+		if !keyMatches(k.alg, signer) {
+			continue
+		}
+		keys = append(keys, &signingKey{
+			kid: strings.TrimSuffix(entry.Name(), ".pem"),
+			key: signer,
+			ct:  info.ModTime(),
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ct.Before(keys[j].ct)
+	})
+	k.lock.Lock()
+	k.keys = keys
+	k.lock.Unlock()
+	return nil
+}
+
+// Rotate generates a new signing key once the current one is older than the rotation
+// period and deletes the keys whose tokens have all expired
+func (k *KeySet) Rotate() error {
+	if k.rotate <= 0 {
+		return nil
+	}
+	if k.due() {
+		if err := k.generate(); err != nil {
+			return err
+		}
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	keep := k.keys[:0]
+	for i, key := range k.keys {
+		// a key stops signing when the next one is created
+		if i < len(k.keys)-1 && time.Since(k.keys[i+1].ct) > k.retain {
+			if err := os.Remove(filepath.Join(k.dir, key.kid+".pem")); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		keep = append(keep, key)
+	}
+	k.keys = keep
+	return nil
+}
+
+// Method is the jwt signing method of the keys
+func (k *KeySet) Method() jwt.SigningMethod {
+	return k.method
+}
+
+// Sign signs the token with the newest key and names it in the kid header
+func (k *KeySet) Sign(token *jwt.Token) (string, error) {
+	current := k.signer()
+	if current == nil {
+		return "", errors.New("no signing key")
+	}
+	token.Header["kid"] = current.kid
+	return token.SignedString(current.key)
+}
+
+// PublicKey returns the verification key of a kid
+func (k *KeySet) PublicKey(kid string) (crypto.PublicKey, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	for _, key := range k.keys {
+		if key.kid == kid {
+			return key.key.Public(), true
+		}
+	}
+	return nil, false
+}
+
+// JWKS publishes the public keys for the services verifying our tokens
+func (k *KeySet) JWKS() (*JSONWebKeySet, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	set := &JSONWebKeySet{Keys: make([]JSONWebKey, 0, len(k.keys))}
+	for _, key := range k.keys {
+		jwk, err := NewJSONWebKey(key.kid, k.alg, key.key.Public())
+		if err != nil {
+			return nil, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+func (k *KeySet) signer() *signingKey {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return k.keys[len(k.keys)-1]
+}
+
+// due reports whether a new signing key is needed
+func (k *KeySet) due() bool {
+	current := k.signer()
+	return current == nil || k.rotate > 0 && time.Since(current.ct) >= k.rotate
+}
+
+// generate creates a new signing key. Replicas sharing the key directory take turns
+// through a lock file and re-read the directory once they hold it, so a key generated
+// by another replica in the meantime is used instead of generating a second one
+func (k *KeySet) generate() error {
+	unlock, err := k.lockDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err = k.Reload(); err != nil {
+		return err
+	}
+	if !k.due() {
+		return nil
+	}
+	var signer crypto.Signer
+	switch k.alg {
+	case jwt.SigningMethodRS256.Alg():
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	kid := now.UTC().Format("20060102150405") + "-" + utils.MustNanoId(8)
+	if err = writeExclusive(filepath.Join(k.dir, kid), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		return err
+	}
+	k.lock.Lock()
+	k.keys = append(k.keys, &signingKey{kid: kid, key: signer, ct: now})
+	k.lock.Unlock()
+	return nil
+}
+
+// lockDir waits until this replica holds the lock file of the key directory
+func (k *KeySet) lockDir() (func(), error) {
+	lock := filepath.Join(k.dir, keyLockFile)
+	for {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			_ = f.Close()
+			return func() {
+				_ = os.Remove(lock)
+			}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if info, errStat := os.Stat(lock); errStat == nil && time.Since(info.ModTime()) > keyLockStale {
+			_ = os.Remove(lock)
+			continue
+		}
+		time.Sleep(keyLockPoll)
+	}
+}
+
+// writeExclusive writes name.pem without ever replacing an existing key, the content
+// goes to a temporary file first so other replicas never read a partial key
+func writeExclusive(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	// unlike a rename, a link fails when the target already exists
+	return os.Link(tmp, name+".pem")
+}
+
+// readPrivateKey decodes a PKCS8, PKCS1 or SEC1 pem private key
+func readPrivateKey(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem block")
+	}
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+	return signer, nil
+}
+
+func keyMatches(alg string, signer crypto.Signer) bool {
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		return alg == jwt.SigningMethodRS256.Alg()
+	case *ecdsa.PrivateKey:
+		return alg == jwt.SigningMethodES256.Alg() && key.Curve == elliptic.P256()
+	case ed25519.PrivateKey:
+		return alg == jwt.SigningMethodEdDSA.Alg()
+	}
+	return false
+}
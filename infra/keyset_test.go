@@ -0,0 +1,173 @@
+package infra
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func newTestKeySet(t *testing.T, dir, alg string, rotate, retain time.Duration) *KeySet {
+	t.Helper()
+	keys, err := NewKeySet(dir, alg, rotate, retain)
+	if err != nil {
+		t.Fatalf("NewKeySet(%v) error = %v", alg, err)
+	}
+	return keys
+}
+
+// signedKid signs a token with the key set and returns the kid of its header
+func signedKid(t *testing.T, j *JWT) (string, string) {
+	t.Helper()
+	token, err := j.CreateToken("jti-1", "uid-1", "alice", []string{"ADMIN"}, "")
+	if err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &JWTClaims{})
+	if err != nil {
+		t.Fatalf("ParseUnverified() error = %v", err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return token, kid
+}
+
+// backdate makes a key look older, its age is the mod time of its pem file
+func backdate(t *testing.T, keys *KeySet, kid string, age time.Duration) {
+	t.Helper()
+	then := time.Now().Add(-age)
+	if err := os.Chtimes(filepath.Join(keys.dir, kid+".pem"), then, then); err != nil {
+		t.Fatalf("backdate %v: %v", kid, err)
+	}
+	if err := keys.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+}
+
+func TestKeySetSignAndVerify(t *testing.T) {
+	tests := []struct {
+		alg string
+		kty string
+	}{
+		{alg: "RS256", kty: "RSA"},
+		{alg: "ES256", kty: "EC"},
+		{alg: "EdDSA", kty: "OKP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alg, func(t *testing.T) {
+			keys := newTestKeySet(t, t.TempDir(), tt.alg, 0, time.Hour)
+			j := &JWT{Keys: keys, Expires: time.Hour}
+			token, kid := signedKid(t, j)
+			if claim, err := j.ParseToken(token); err != nil || claim.Name != "alice" {
+				t.Errorf("ParseToken() = %+v, %v", claim, err)
+			}
+
+			set, err := keys.JWKS()
+			if err != nil {
+				t.Fatalf("JWKS() error = %v", err)
+			}
+			if len(set.Keys) != 1 {
+				t.Fatalf("JWKS() = %+v, want one key", set)
+			}
+			jwk := set.Keys[0]
+			if jwk.Kid != kid || jwk.Kty != tt.kty || jwk.Alg != tt.alg || jwk.Use != "sig" {
+				t.Errorf("JWKS() key = %+v, want kid %v kty %v alg %v", jwk, kid, tt.kty, tt.alg)
+			}
+			// a verifier holding only the jwks accepts the token
+			public, err := jwk.PublicKey()
+			if err != nil {
+				t.Fatalf("PublicKey() error = %v", err)
+			}
+			if _, err = jwt.ParseWithClaims(token, &JWTClaims{}, func(*jwt.Token) (interface{}, error) {
+				return public, nil
+			}); err != nil {
+				t.Errorf("verify with the jwks key error = %v", err)
+			}
+		})
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	keys := newTestKeySet(t, t.TempDir(), "ES256", 3*time.Hour, time.Hour)
+	j := &JWT{Keys: keys, Expires: time.Hour}
+	oldToken, oldKid := signedKid(t, j)
+
+	// the signing key is older than the rotation period, a new one takes over
+	backdate(t, keys, oldKid, 4*time.Hour)
+	if err := keys.Rotate(); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	newToken, newKid := signedKid(t, j)
+	if newKid == oldKid {
+		t.Fatalf("kid after rotation = %v, want a new key", newKid)
+	}
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		if _, err := j.ParseToken(token); err != nil {
+			t.Errorf("ParseToken(%v key) error = %v", name, err)
+		}
+	}
+	if set, _ := keys.JWKS(); len(set.Keys) != 2 {
+		t.Errorf("JWKS() after rotation = %+v, want both keys", set)
+	}
+
+	// once the new key signed for longer than the token lifetime the old one is dropped
+	backdate(t, keys, newKid, 2*time.Hour)
+	if err := keys.Rotate(); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(keys.dir, oldKid+".pem")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat retired key error = %v, want it deleted", err)
+	}
+	if _, err := j.ParseToken(oldToken); err == nil {
+		t.Error("ParseToken() accepted a token of a retired key")
+	}
+	if _, kid := signedKid(t, j); kid != newKid {
+		t.Errorf("signing kid = %v, want %v", kid, newKid)
+	}
+	if set, _ := keys.JWKS(); len(set.Keys) != 1 || set.Keys[0].Kid != newKid {
+		t.Errorf("JWKS() after retirement = %+v, want only %v", set, newKid)
+	}
+}
+
+func TestKeySetUnknownKid(t *testing.T) {
+	j := &JWT{Keys: newTestKeySet(t, t.TempDir(), "ES256", 0, time.Hour), Expires: time.Hour}
+	// a key set of another directory signs with a kid this one doesn't know
+	other := &JWT{Keys: newTestKeySet(t, t.TempDir(), "ES256", 0, time.Hour), Expires: time.Hour}
+	token, _ := signedKid(t, other)
+	if _, err := j.ParseToken(token); err == nil {
+		t.Error("ParseToken() accepted a token of an unknown kid")
+	}
+}
+
+func TestKeySetSharedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	const replicas = 4
+	var wg sync.WaitGroup
+	sets := make([]*KeySet, replicas)
+	errs := make([]error, replicas)
+	for i := range sets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sets[i], errs[i] = NewKeySet(dir, "ES256", 0, time.Hour)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("NewKeySet(replica %v) error = %v", i, err)
+		}
+	}
+	pems, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil || len(pems) != 1 {
+		t.Fatalf("pem files = %v, %v, want exactly one key for replicas starting together", pems, err)
+	}
+	for i, keys := range sets {
+		if signer := keys.signer(); signer == nil || signer.kid+".pem" != filepath.Base(pems[0]) {
+			t.Errorf("replica %v signs with %+v, want %v", i, signer, pems[0])
+		}
+	}
+}
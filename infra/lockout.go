@@ -0,0 +1,178 @@
+package infra
+
+import (
+	"context"
+	"golang-ast/db"
+	"math"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	ipLockPrefix    = "ip:"
+	lockCountPrefix = "locks:"
+	// lockMemory is how long a served lock makes the next lock of the same identify longer
+	lockMemory = 24 * time.Hour
+)
+
+// lockoutDuration grows the lock exponentially with the number of recent locks
+func (a *Authorization) lockoutDuration(locks int) time.Duration {
+	cfg := &a.cfg.Lockout
+	seconds := float64(cfg.Duration) * math.Pow(cfg.Multiplier, float64(locks-1))
+	if seconds > float64(cfg.MaxDuration) || math.IsInf(seconds, 0) {
+		seconds = float64(cfg.MaxDuration)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// recordFailure counts a failed sign-in of the account and of the client address, and
+// locks whichever reached its threshold within the window
+func (a *Authorization) recordFailure(ctx context.Context, identify, ip string) {
+	cfg := &a.cfg.Lockout
+	window := time.Duration(cfg.Window) * time.Second
+	if identify != "" {
+		fails, err := a.store.IncrFails(ctx, identify, window)
+		if err != nil {
+			a.log.Error("recordFailure().IncrFails error", zap.Error(err))
+		} else if fails >= cfg.Threshold {
+			a.lockIdentify(ctx, identify, "account", ip, fails)
+		}
+	}
+	if cfg.IpThreshold > 0 && ip != "" {
+		fails, err := a.store.IncrFails(ctx, ipLockPrefix+ip, window)
+		if err != nil {
+			a.log.Error("recordFailure().IncrFails error", zap.Error(err))
+		} else if fails >= cfg.IpThreshold {
+			a.lockIdentify(ctx, ipLockPrefix+ip, "ip", ip, fails)
+		}
+	}
+}
+
+func (a *Authorization) lockIdentify(ctx context.Context, key, kind, ip string, fails int) {
+	locks, err := a.store.IncrFails(ctx, lockCountPrefix+key, lockMemory)
+	if err != nil {
+		a.log.Error("lockIdentify().IncrFails error", zap.Error(err))
+		locks = 1
+	}
+	until := time.Now().Add(a.lockoutDuration(locks))
+	if err = a.store.ResetFails(ctx, key); err != nil {
+		a.log.Error("lockIdentify().ResetFails error", zap.Error(err))
+	}
+	if err = a.store.Lock(ctx, key, until); err != nil {
+		a.log.Error("lockIdentify().Lock error", zap.Error(err))
+	}
+	identify := key
+	if kind == "account" {
+		// unknown names are locked as well so a lock doesn't tell which accounts exist
+		if user, _ := a.db.FindUserByIdentify(key, false); user != nil {
+			if err = a.db.LockUserByFails(user.Id, until); err != nil {
+				a.log.Error("lockIdentify().LockUserByFails error", zap.Error(err))
+			}
+		}
+	} else {
+		identify = ip
+	}
+	a.audit(&db.SysLockEvent{
+		Identify: identify,
+		Kind:     kind,
+		Action:   "lock",
+		Ip:       ip,
+		Fails:    fails,
+		Until:    &until,
+	})
+}
+
+// LockedUntil returns when the lock of an account or of the client address ends, the
+// later of the two when both are locked
+func (a *Authorization) LockedUntil(identify, ip string) (time.Time, bool) {
+	var (
+		until  time.Time
+		locked bool
+	)
+	for _, key := range []string{identify, ipLockPrefix + ip} {
+		if key == "" || key == ipLockPrefix {
+			continue
+		}
+		exp, ok, err := a.store.LockedUntil(context.Background(), key)
+		if err != nil {
+			a.log.Error("LockedUntil().store error", zap.Error(err))
+		}
+		if ok && exp.After(until) {
+			until, locked = exp, true
+		}
+	}
+	return until, locked
+}
+
+// Unlock lifts the locks of an account and of a client address before they end, either
+// may be empty, the operator is recorded in the audit
+func (a *Authorization) Unlock(identify, ip, operator string) error {
+	ctx := context.Background()
+	if identify != "" {
+		if err := a.clearLock(ctx, identify); err != nil {
+			return err
+		}
+		if user, _ := a.db.FindUserByIdentify(identify, false); user != nil {
+			if _, err := a.db.UnlockUserByFails(user.Id); err != nil {
+				return err
+			}
+		}
+		a.audit(&db.SysLockEvent{Identify: identify, Kind: "account", Action: "unlock", Operator: operator})
+	}
+	if ip != "" {
+		if err := a.clearLock(ctx, ipLockPrefix+ip); err != nil {
+			return err
+		}
+		a.audit(&db.SysLockEvent{Identify: ip, Kind: "ip", Action: "unlock", Ip: ip, Operator: operator})
+	}
+	return nil
+}
+
+func (a *Authorization) clearLock(ctx context.Context, key string) error {
+	if err := a.store.Unlock(ctx, key); err != nil {
+		return err
+	}
+	if err := a.store.ResetFails(ctx, key); err != nil {
+		return err
+	}
+	return a.store.ResetFails(ctx, lockCountPrefix+key)
+}
+
+// ReleaseExpiredLock enables a user whose lock by sign-in failures has ended and reports
+// whether the user is usable again
+func (a *Authorization) ReleaseExpiredLock(user *db.SysUser) bool {
+	if user.LockBy != "lockByFails" || user.LockedUntil == nil || time.Now().Before(*user.LockedUntil) {
+		return false
+	}
+	released, err := a.db.UnlockUserByFails(user.Id)
+	if err != nil {
+		a.log.Error("ReleaseExpiredLock().UnlockUserByFails error", zap.Error(err))
+		return false
+	}
+	// another replica may have released it first, only the one that did audits it
+	if released {
+		a.audit(&db.SysLockEvent{Identify: user.Name, Kind: "account", Action: "expire", Until: user.LockedUntil})
+	}
+	user.Enable, user.LockBy, user.LockedUntil = true, "none", nil
+	return true
+}
+
+// releaseLocks is the unlock scheduler, the lock ends are kept with the users so the
+// locks are released after a restart as well
+func (a *Authorization) releaseLocks() {
+	users, err := a.db.FindExpiredLockedUsers()
+	if err != nil {
+		a.log.Error("releaseLocks().FindExpiredLockedUsers error", zap.Error(err))
+		return
+	}
+	for i := range users {
+		a.ReleaseExpiredLock(&users[i])
+	}
+}
+
+func (a *Authorization) audit(event *db.SysLockEvent) {
+	if err := a.db.CreateLockEvent(event); err != nil {
+		a.log.Error("audit().CreateLockEvent error", zap.Error(err))
+	}
+}
@@ -0,0 +1,191 @@
+package infra
+
+import (
+	"context"
+	"golang-ast/conf"
+	"golang-ast/db"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newLockoutAuthorization locks an account after 3 failures and an address after 5
+func newLockoutAuthorization(t *testing.T) *Authorization {
+	t.Helper()
+	cfg := &conf.AuthConfig{Lockout: conf.LockoutConfig{
+		Threshold:   3,
+		IpThreshold: 5,
+		Window:      100,
+		Duration:    60,
+		Multiplier:  2,
+		MaxDuration: 3600,
+	}}
+	return &Authorization{cfg: cfg, log: zap.NewNop(), db: testDB(t), store: NewMemorySessionStore()}
+}
+
+func createLockoutUser(t *testing.T, a *Authorization, name string) *db.SysUser {
+	t.Helper()
+	user, err := a.db.CreateUser(&db.SysUser{Name: name, Enable: true, LockBy: "none"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	return user
+}
+
+// assertLockedFor checks the lock of an account or address ends about d from now, 0 for no lock
+func assertLockedFor(t *testing.T, a *Authorization, identify, ip string, d time.Duration) {
+	t.Helper()
+	until, locked := a.LockedUntil(identify, ip)
+	if locked != (d > 0) {
+		t.Fatalf("LockedUntil(%q, %q) locked = %v, want %v", identify, ip, locked, d > 0)
+	}
+	if left := time.Until(until); locked && (left > d || left < d-5*time.Second) {
+		t.Errorf("LockedUntil(%q, %q) ends in %v, want %v", identify, ip, left, d)
+	}
+}
+
+func lockActions(t *testing.T, a *Authorization, identify string) []string {
+	t.Helper()
+	page, err := a.db.QueryLockEvents(db.LockEventFilter{Identify: identify}, 100, 0)
+	if err != nil {
+		t.Fatalf("QueryLockEvents() error = %v", err)
+	}
+	var actions []string
+	for _, event := range page.Content.([]db.SysLockEvent) {
+		actions = append([]string{event.Action}, actions...)
+	}
+	return actions
+}
+
+func TestLockoutDuration(t *testing.T) {
+	a := newLockoutAuthorization(t)
+	tests := []struct {
+		locks int
+		want  time.Duration
+	}{
+		{locks: 1, want: time.Minute},
+		{locks: 2, want: 2 * time.Minute},
+		{locks: 3, want: 4 * time.Minute},
+		{locks: 6, want: 32 * time.Minute},
+		{locks: 7, want: time.Hour},
+		{locks: 5000, want: time.Hour},
+	}
+	for _, tt := range tests {
+		if got := a.lockoutDuration(tt.locks); got != tt.want {
+			t.Errorf("lockoutDuration(%v) = %v, want %v", tt.locks, got, tt.want)
+		}
+	}
+}
+
+func TestLockoutThresholds(t *testing.T) {
+	a := newLockoutAuthorization(t)
+	ctx := context.Background()
+	user := createLockoutUser(t, a, "alice")
+
+	for i := 0; i < 2; i++ {
+		a.recordFailure(ctx, "alice", "10.0.0.1")
+	}
+	assertLockedFor(t, a, "alice", "", 0)
+	a.recordFailure(ctx, "alice", "10.0.0.1")
+	assertLockedFor(t, a, "alice", "", time.Minute)
+	if locked, _ := a.db.FindUserById(user.Id, false); locked.LockBy != "lockByFails" || locked.Enable {
+		t.Errorf("locked user = %+v, want disabled by fails", locked)
+	}
+	// the failures were reset by the lock, the next lock within a day lasts twice as long
+	_ = a.store.Unlock(ctx, "alice")
+	for i := 0; i < 3; i++ {
+		a.recordFailure(ctx, "alice", "10.0.0.3")
+	}
+	assertLockedFor(t, a, "alice", "", 2*time.Minute)
+
+	// unknown names are locked like accounts
+	for i := 0; i < 3; i++ {
+		a.recordFailure(ctx, "nobody", "10.0.0.4")
+	}
+	assertLockedFor(t, a, "nobody", "", time.Minute)
+
+	// spraying names below the account threshold locks the address
+	for _, name := range []string{"u1", "u2", "u3", "u4"} {
+		a.recordFailure(ctx, name, "10.0.0.2")
+	}
+	assertLockedFor(t, a, "bob", "10.0.0.2", 0)
+	a.recordFailure(ctx, "u5", "10.0.0.2")
+	assertLockedFor(t, a, "bob", "10.0.0.2", time.Minute)
+	assertLockedFor(t, a, "bob", "10.0.0.5", 0)
+
+	if got := lockActions(t, a, "alice"); len(got) != 2 || got[0] != "lock" || got[1] != "lock" {
+		t.Errorf("audit of alice = %v, want two locks", got)
+	}
+	if got := lockActions(t, a, "10.0.0.2"); len(got) != 1 || got[0] != "lock" {
+		t.Errorf("audit of 10.0.0.2 = %v, want one lock", got)
+	}
+}
+
+func TestLockoutUnlock(t *testing.T) {
+	a := newLockoutAuthorization(t)
+	ctx := context.Background()
+	user := createLockoutUser(t, a, "alice")
+	for i := 0; i < 5; i++ {
+		a.recordFailure(ctx, "alice", "10.0.0.1")
+	}
+	assertLockedFor(t, a, "alice", "10.0.0.1", time.Minute)
+
+	if err := a.Unlock("alice", "10.0.0.1", "admin"); err != nil {
+		t.Fatalf("Unlock() error = %v", err)
+	}
+	assertLockedFor(t, a, "alice", "10.0.0.1", 0)
+	if unlocked, _ := a.db.FindUserById(user.Id, false); unlocked.LockBy != "none" || !unlocked.Enable {
+		t.Errorf("unlocked user = %+v, want enabled", unlocked)
+	}
+	// the lock count is reset as well, the next lock is a first one again
+	for i := 0; i < 3; i++ {
+		a.recordFailure(ctx, "alice", "")
+	}
+	assertLockedFor(t, a, "alice", "", time.Minute)
+
+	page, err := a.db.QueryLockEvents(db.LockEventFilter{Action: "unlock"}, 10, 0)
+	if err != nil {
+		t.Fatalf("QueryLockEvents() error = %v", err)
+	}
+	for _, event := range page.Content.([]db.SysLockEvent) {
+		if event.Operator != "admin" {
+			t.Errorf("unlock event = %+v, want operator admin", event)
+		}
+	}
+	if page.TotalElements != 2 {
+		t.Errorf("unlock events = %v, want the account and the address", page.TotalElements)
+	}
+}
+
+func TestLockoutRelease(t *testing.T) {
+	a := newLockoutAuthorization(t)
+	expired := createLockoutUser(t, a, "alice")
+	live := createLockoutUser(t, a, "bob")
+	_ = a.db.LockUserByFails(expired.Id, time.Now().Add(-time.Second))
+	_ = a.db.LockUserByFails(live.Id, time.Now().Add(time.Hour))
+
+	a.releaseLocks()
+	for _, tt := range []struct {
+		user   *db.SysUser
+		enable bool
+	}{{user: expired, enable: true}, {user: live, enable: false}} {
+		if user, _ := a.db.FindUserById(tt.user.Id, false); user.Enable != tt.enable {
+			t.Errorf("%v after releaseLocks() enable = %v, want %v", user.Name, user.Enable, tt.enable)
+		}
+	}
+	if got := lockActions(t, a, "alice"); len(got) != 1 || got[0] != "expire" {
+		t.Errorf("audit of alice = %v, want one expire", got)
+	}
+	// a replica releasing it again neither fails nor audits twice
+	user, _ := a.db.FindUserById(live.Id, false)
+	*user.LockedUntil = time.Now().Add(-time.Second)
+	if !a.ReleaseExpiredLock(user) || !user.Enable || user.LockBy != "none" {
+		t.Errorf("ReleaseExpiredLock() user = %+v, want released", user)
+	}
+	user.LockBy, user.LockedUntil = "lockByFails", new(time.Time)
+	a.ReleaseExpiredLock(user)
+	if got := lockActions(t, a, "bob"); len(got) != 1 {
+		t.Errorf("audit of bob = %v, want one expire", got)
+	}
+}
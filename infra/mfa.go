@@ -0,0 +1,161 @@
+package infra
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"golang-ast/conf"
+	"golang-ast/db"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const mfaQrSize = 256
+
+var (
+	ErrMfaEnrolled    = errors.New("second factor is already enabled")
+	ErrMfaNotEnrolled = errors.New("second factor is not enabled")
+	ErrMfaCodeInvalid = errors.New("invalid verification code")
+)
+
+// MfaEnrollment is a new totp secret waiting for its confirmation, QrCode is a png data uri
+// of Uri
+type MfaEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+	QrCode string `json:"qr_code"`
+}
+
+// MfaRequired reports whether a role of the user requires a second factor
+func (a *Authorization) MfaRequired(user *db.SysUser) bool {
+	for _, role := range user.Roles {
+		if role.RequireMfa {
+			return true
+		}
+	}
+	return false
+}
+
+// EnrollMfa generates a totp secret for the user, it replaces an unconfirmed enrollment
+func (a *Authorization) EnrollMfa(user *db.SysUser) (*MfaEnrollment, error) {
+	if user.MfaEnabled {
+		return nil, ErrMfaEnrolled
+	}
+	secret, err := newTotpSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := a.sealMfaSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if err = a.db.SaveMfaSecret(user.Id, sealed); err != nil {
+		return nil, err
+	}
+	uri := totpURI(a.cfg.Mfa.Issuer, user.Name, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, mfaQrSize)
+	if err != nil {
+		return nil, err
+	}
+	return &MfaEnrollment{
+		Secret: secret,
+		Uri:    uri,
+		QrCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}, nil
+}
+
+// ConfirmMfa enables the enrolled secret with one of its codes and returns the recovery codes
+func (a *Authorization) ConfirmMfa(user *db.SysUser, code string) ([]string, error) {
+	if user.MfaEnabled {
+		return nil, ErrMfaEnrolled
+	}
+	if user.MfaSecret == "" {
+		return nil, ErrMfaNotEnrolled
+	}
+	secret, err := a.openMfaSecret(user.MfaSecret)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := matchTotp(secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return nil, ErrMfaCodeInvalid
+	}
+	codes, hashes, err := newRecoveryCodes(a.cfg.Mfa.RecoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+	if err = a.db.EnableMfa(user.Id, step, hashes); err != nil {
+		return nil, err
+	}
+	user.MfaEnabled, user.MfaStep = true, step
+	return codes, nil
+}
+
+// VerifyMfa checks a totp code or spends a recovery code of the user, a totp code is
+// rejected when a code of the same time step was accepted before
+func (a *Authorization) VerifyMfa(user *db.SysUser, code string) (bool, error) {
+	if !user.MfaEnabled {
+		return false, ErrMfaNotEnrolled
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return a.db.UseRecoveryCode(user.Id, hashRecoveryCode(code))
+	}
+	secret, err := a.openMfaSecret(user.MfaSecret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := matchTotp(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return a.db.AdvanceMfaStep(user.Id, step)
+}
+
+// RenewRecoveryCodes replaces the recovery codes of the user
+func (a *Authorization) RenewRecoveryCodes(user *db.SysUser) ([]string, error) {
+	if !user.MfaEnabled {
+		return nil, ErrMfaNotEnrolled
+	}
+	codes, hashes, err := newRecoveryCodes(a.cfg.Mfa.RecoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, a.db.ReplaceRecoveryCodes(user.Id, hashes)
+}
+
+// ResetMfa removes the second factor of the user, the next sign-in enrolls again when a
+// role requires it
+func (a *Authorization) ResetMfa(user *db.SysUser) error {
+	if err := a.db.ResetMfa(user.Id); err != nil {
+		return err
+	}
+	user.MfaSecret, user.MfaEnabled, user.MfaStep = "", false, 0
+	return nil
+}
+
+// mfaKey derives the aes key of the totp secrets
+func (a *Authorization) mfaKey() []byte {
+	material := a.cfg.Mfa.SecretKey
+	if material == "" {
+		material = a.cfg.JwtKey
+	}
+	key := sha256.Sum256([]byte(material))
+	return key[:]
+}
+
+// sealMfaSecret encrypts a secret in the ENC(...) envelope of the encrypted config values
+func (a *Authorization) sealMfaSecret(secret string) (string, error) {
+	return conf.EncryptSecret(secret, a.mfaKey())
+}
+
+// openMfaSecret opens a sealed secret, secrets sealed before the envelope was adopted are
+// the bare base64 of the same nonce and ciphertext
+func (a *Authorization) openMfaSecret(sealed string) (string, error) {
+	if !conf.IsEncrypted(sealed) {
+		sealed = "ENC(" + sealed + ")"
+	}
+	return conf.DecryptSecret(sealed, a.mfaKey())
+}
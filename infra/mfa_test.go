@@ -0,0 +1,156 @@
+package infra
+
+import (
+	"errors"
+	"golang-ast/conf"
+	"golang-ast/db"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// enrolledMfaUser enrolls and confirms the second factor of a new user, it returns the
+// user with its secret and the recovery codes
+func enrolledMfaUser(t *testing.T, a *Authorization) (*db.SysUser, string, []string) {
+	t.Helper()
+	user, err := a.db.CreateUser(&db.SysUser{Name: "alice", Enable: true, LockBy: "none"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	enrollment, err := a.EnrollMfa(user)
+	if err != nil {
+		t.Fatalf("EnrollMfa() error = %v", err)
+	}
+	if user, err = a.db.FindUserById(user.Id, false); err != nil {
+		t.Fatalf("FindUserById() error = %v", err)
+	}
+	if _, err = a.ConfirmMfa(user, "000000x"); !errors.Is(err, ErrMfaCodeInvalid) {
+		t.Fatalf("ConfirmMfa(wrong code) error = %v, want ErrMfaCodeInvalid", err)
+	}
+	codes, err := a.ConfirmMfa(user, totpAt(t, enrollment.Secret, time.Now()))
+	if err != nil {
+		t.Fatalf("ConfirmMfa() error = %v", err)
+	}
+	return user, enrollment.Secret, codes
+}
+
+func totpAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	return totpCode(key, totpStep(at))
+}
+
+func newMfaAuthorization(t *testing.T) *Authorization {
+	cfg := &conf.AuthConfig{
+		JwtKey: "0123456789abcdef0123456789abcdef",
+		Mfa:    conf.MfaConfig{Issuer: "admin", RecoveryCodes: 3},
+	}
+	return &Authorization{cfg: cfg, log: zap.NewNop(), db: testDB(t)}
+}
+
+func TestMfaEnrollment(t *testing.T) {
+	a := newMfaAuthorization(t)
+	user, secret, codes := enrolledMfaUser(t, a)
+	if !user.MfaEnabled || len(codes) != 3 {
+		t.Errorf("ConfirmMfa() enabled = %v with %v codes, want 3", user.MfaEnabled, len(codes))
+	}
+	// the secret is kept sealed
+	stored, _ := a.db.FindUserById(user.Id, false)
+	if !conf.IsEncrypted(stored.MfaSecret) || strings.Contains(stored.MfaSecret, secret) {
+		t.Errorf("stored secret = %v, want it sealed", stored.MfaSecret)
+	}
+	if opened, err := a.openMfaSecret(stored.MfaSecret); err != nil || opened != secret {
+		t.Errorf("openMfaSecret() = %v, %v, want %v", opened, err, secret)
+	}
+	// secrets sealed before the ENC(...) envelope are the bare base64
+	legacy := strings.TrimSuffix(strings.TrimPrefix(stored.MfaSecret, "ENC("), ")")
+	if opened, err := a.openMfaSecret(legacy); err != nil || opened != secret {
+		t.Errorf("openMfaSecret(legacy) = %v, %v, want %v", opened, err, secret)
+	}
+
+	if _, err := a.EnrollMfa(user); !errors.Is(err, ErrMfaEnrolled) {
+		t.Errorf("EnrollMfa(enrolled) error = %v, want ErrMfaEnrolled", err)
+	}
+	if _, err := a.ConfirmMfa(user, "123456"); !errors.Is(err, ErrMfaEnrolled) {
+		t.Errorf("ConfirmMfa(enrolled) error = %v, want ErrMfaEnrolled", err)
+	}
+	if _, err := a.VerifyMfa(&db.SysUser{}, "123456"); !errors.Is(err, ErrMfaNotEnrolled) {
+		t.Errorf("VerifyMfa(not enrolled) error = %v, want ErrMfaNotEnrolled", err)
+	}
+}
+
+func TestMfaStepReplay(t *testing.T) {
+	a := newMfaAuthorization(t)
+	user, secret, _ := enrolledMfaUser(t, a)
+	// the codes are taken relative to the step of the confirmation, not the clock
+	now := time.Unix(user.MfaStep*totpPeriod, 0)
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{name: "code of the confirmation", code: totpAt(t, secret, now)},
+		{name: "next step", code: totpAt(t, secret, now.Add(totpPeriod*time.Second)), ok: true},
+		{name: "next step again", code: totpAt(t, secret, now.Add(totpPeriod*time.Second))},
+		{name: "earlier step", code: totpAt(t, secret, now.Add(-totpPeriod*time.Second))},
+	}
+	for _, tt := range tests {
+		ok, err := a.VerifyMfa(user, tt.code)
+		if err != nil {
+			t.Fatalf("VerifyMfa(%v) error = %v", tt.name, err)
+		}
+		if ok != tt.ok {
+			t.Errorf("VerifyMfa(%v) = %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+}
+
+func TestMfaRecoveryCodes(t *testing.T) {
+	a := newMfaAuthorization(t)
+	user, _, codes := enrolledMfaUser(t, a)
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{name: "first code", code: codes[0], ok: true},
+		{name: "first code again", code: codes[0]},
+		{name: "typed differently", code: strings.ToUpper(strings.ReplaceAll(codes[1], "-", "")), ok: true},
+		{name: "unknown code", code: "abcde-fghij"},
+	}
+	for _, tt := range tests {
+		ok, err := a.VerifyMfa(user, tt.code)
+		if err != nil {
+			t.Fatalf("VerifyMfa(%v) error = %v", tt.name, err)
+		}
+		if ok != tt.ok {
+			t.Errorf("VerifyMfa(%v) = %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+	if left, err := a.db.CountRecoveryCodes(user.Id); err != nil || left != 1 {
+		t.Errorf("CountRecoveryCodes() = %v, %v, want 1", left, err)
+	}
+
+	renewed, err := a.RenewRecoveryCodes(user)
+	if err != nil {
+		t.Fatalf("RenewRecoveryCodes() error = %v", err)
+	}
+	if ok, _ := a.VerifyMfa(user, codes[2]); ok {
+		t.Error("VerifyMfa() accepted a code replaced by RenewRecoveryCodes()")
+	}
+	if ok, _ := a.VerifyMfa(user, renewed[2]); !ok {
+		t.Error("VerifyMfa() rejected a renewed code")
+	}
+
+	if err = a.ResetMfa(user); err != nil {
+		t.Fatalf("ResetMfa() error = %v", err)
+	}
+	if left, _ := a.db.CountRecoveryCodes(user.Id); left != 0 || user.MfaEnabled {
+		t.Errorf("after ResetMfa() enabled = %v with %v codes, want none", user.MfaEnabled, left)
+	}
+}
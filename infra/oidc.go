@@ -0,0 +1,325 @@
+package infra
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"golang-ast/conf"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwksRefresh limits how often an unknown kid triggers a new read of the jwks document
+const jwksRefresh = time.Minute
+
+var idTokenMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	JwksUri               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// OIDC signs users in with an OpenID Connect provider using the code flow with PKCE,
+// the id_token is verified against the keys of the provider jwks
+type OIDC struct {
+	cfg       conf.ProviderConfig
+	client    *http.Client
+	lock      sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+}
+
+func NewOIDC(cfg conf.ProviderConfig) *OIDC {
+	claims := &cfg.Claims
+	for _, claim := range []struct {
+		name     *string
+		standard string
+	}{
+		{&claims.Name, "preferred_username"},
+		{&claims.Nick, "name"},
+		{&claims.Email, "email"},
+		{&claims.Phone, "phone_number"},
+		{&claims.Avatar, "picture"},
+		{&claims.Groups, "groups"},
+	} {
+		if *claim.name == "" {
+			*claim.name = claim.standard
+		}
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	return &OIDC{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (o *OIDC) Name() string {
+	return o.cfg.Name
+}
+
+func (o *OIDC) AuthCodeURL(ctx context.Context, req *AuthRequest) (string, error) {
+	discovery, err := o.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.cfg.ClientId},
+		"redirect_uri":          {req.RedirectUri},
+		"scope":                 {strings.Join(o.cfg.Scopes, " ")},
+		"state":                 {req.State},
+		"nonce":                 {req.Nonce},
+		"code_challenge":        {req.Challenge()},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+func (o *OIDC) Exchange(ctx context.Context, req *AuthRequest, code string) (*Identity, error) {
+	discovery, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, idToken, err := o.token(ctx, discovery, req, code)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := o.verify(ctx, discovery, idToken, req.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	// the id_token may only carry the subject, the profile comes from userinfo
+	if discovery.UserinfoEndpoint != "" && accessToken != "" {
+		info := jwt.MapClaims{}
+		infoReq, errReq := http.NewRequestWithContext(ctx, http.MethodGet, discovery.UserinfoEndpoint, nil)
+		if errReq != nil {
+			return nil, errReq
+		}
+		infoReq.Header.Set("Authorization", "Bearer "+accessToken)
+		if fetchJSON(o.client, infoReq, &info) == nil && info["sub"] == claims["sub"] {
+			for k, v := range info {
+				if _, ok := claims[k]; !ok {
+					claims[k] = v
+				}
+			}
+		}
+	}
+	return o.identity(claims)
+}
+
+func (o *OIDC) discover(ctx context.Context) (*oidcDiscovery, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+	issuer := strings.TrimSuffix(o.cfg.Issuer, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var discovery oidcDiscovery
+	if err = fetchJSON(o.client, req, &discovery); err != nil {
+		return nil, fmt.Errorf("oidc discovery of %v failed: %w", issuer, err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc discovery returned issuer %v, expected %v", discovery.Issuer, o.cfg.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksUri == "" {
+		return nil, errors.New("oidc discovery document misses an endpoint")
+	}
+	o.discovery = &discovery
+	return o.discovery, nil
+}
+
+func (o *OIDC) token(ctx context.Context, discovery *oidcDiscovery, authReq *AuthRequest, code string) (string, string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {authReq.RedirectUri},
+		"client_id":     {o.cfg.ClientId},
+		"code_verifier": {authReq.Verifier},
+	}
+	basic := o.cfg.ClientSecret != "" && supportsBasic(discovery.TokenAuthMethods)
+	if o.cfg.ClientSecret != "" && !basic {
+		form.Set("client_secret", o.cfg.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(o.cfg.ClientId), url.QueryEscape(o.cfg.ClientSecret))
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		IdToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err = fetchJSON(o.client, req, &body); err != nil {
+		return "", "", err
+	}
+	if body.Error != "" {
+		return "", "", fmt.Errorf("oidc token exchange failed: %v %v", body.Error, body.Description)
+	}
+	if body.IdToken == "" {
+		return "", "", errors.New("oidc provider returned no id_token")
+	}
+	return body.AccessToken, body.IdToken, nil
+}
+
+// supportsBasic reports whether client_secret_basic is allowed, it is the default of the spec
+func supportsBasic(methods []string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, method := range methods {
+		if method == "client_secret_basic" {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *OIDC) verify(ctx context.Context, discovery *oidcDiscovery, idToken, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods(idTokenMethods))
+	_, err := parser.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return o.key(ctx, discovery, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %w", err)
+	}
+	now := time.Now().Unix()
+	switch {
+	case !claims.VerifyExpiresAt(now, true):
+		return nil, errors.New("invalid id_token: missing or past exp")
+	case !claims.VerifyIssuer(discovery.Issuer, true):
+		return nil, errors.New("invalid id_token: issuer mismatch")
+	case !claims.VerifyAudience(o.cfg.ClientId, true):
+		return nil, errors.New("invalid id_token: audience mismatch")
+	case claims["nonce"] != nonce:
+		return nil, errors.New("invalid id_token: nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("invalid id_token: missing sub")
+	}
+	return claims, nil
+}
+
+// key resolves the verification key of a kid, the jwks is read again when the kid is
+// unknown so key rotations at the provider are picked up
+func (o *OIDC) key(ctx context.Context, discovery *oidcDiscovery, kid string) (crypto.PublicKey, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if key, ok := o.lookup(kid); ok {
+		return key, nil
+	}
+	if time.Since(o.keysAt) < jwksRefresh {
+		return nil, errors.New("unknown signing key " + kid)
+	}
+	o.keysAt = time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discovery.JwksUri, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set JSONWebKeySet
+	if err = fetchJSON(o.client, req, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, errKey := jwk.PublicKey(); errKey == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	o.keys = keys
+	if key, ok := o.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown signing key " + kid)
+}
+
+// lookup finds a cached key, a token without kid is accepted when the set has a single key
+func (o *OIDC) lookup(kid string) (crypto.PublicKey, bool) {
+	if key, ok := o.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(o.keys) == 1 {
+		for _, key := range o.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (o *OIDC) identity(claims jwt.MapClaims) (*Identity, error) {
+	mapping := o.cfg.Claims
+	str := func(name string) string {
+		value, _ := claims[name].(string)
+		return value
+	}
+	identity := &Identity{
+		Provider: o.cfg.Name,
+		Subject:  str("sub"),
+		Name:     str(mapping.Name),
+		Nick:     str(mapping.Nick),
+		Email:    str(mapping.Email),
+		Phone:    str(mapping.Phone),
+		Avatar:   str(mapping.Avatar),
+	}
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		identity.Email = ""
+	}
+	if identity.Name == "" {
+		identity.Name = identity.Subject
+	}
+	if len(o.cfg.Groups) > 0 {
+		identity.Roles = make([]string, 0)
+		for _, group := range groupsOf(claims[mapping.Groups]) {
+			if code, ok := o.cfg.Groups[group]; ok {
+				identity.Roles = append(identity.Roles, code)
+			}
+		}
+	}
+	return identity, nil
+}
+
+func groupsOf(value any) []string {
+	switch groups := value.(type) {
+	case string:
+		return []string{groups}
+	case []any:
+		names := make([]string, 0, len(groups))
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return nil
+}
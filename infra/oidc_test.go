@@ -0,0 +1,196 @@
+package infra
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"golang-ast/conf"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// mockIdP is an in-process openid provider issuing id_tokens signed with an ES256 key
+type mockIdP struct {
+	*httptest.Server
+	key       *ecdsa.PrivateKey
+	challenge string
+	nonce     string
+	// claims edits the id_token claims of the next token response
+	claims func(claims jwt.MapClaims)
+	// signer overrides the key the id_token is signed with
+	signer *ecdsa.PrivateKey
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate idp key: %v", err)
+	}
+	m := &mockIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			UserinfoEndpoint:      m.URL + "/userinfo",
+			JwksUri:               m.URL + "/jwks",
+			TokenAuthMethods:      []string{"client_secret_basic"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk, errKey := NewJSONWebKey("k1", "ES256", &m.key.PublicKey)
+		if errKey != nil {
+			t.Errorf("encode idp key: %v", errKey)
+		}
+		writeJSON(w, JSONWebKeySet{Keys: []JSONWebKey{jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parse token form: %v", err)
+		}
+		id, secret, _ := r.BasicAuth()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		switch {
+		case id != "client" || secret != "secret":
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code") != "code-1":
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		case base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge:
+			writeJSON(w, map[string]string{"error": "invalid_grant", "error_description": "pkce"})
+			return
+		}
+		writeJSON(w, map[string]string{"access_token": "at-1", "token_type": "Bearer", "id_token": m.idToken(t)})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer at-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]any{"sub": "u-1", "email": "alice@example.com", "email_verified": true})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIdP) idToken(t *testing.T) string {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                m.URL,
+		"aud":                "client",
+		"sub":                "u-1",
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Minute).Unix(),
+		"nonce":              m.nonce,
+		"preferred_username": "alice",
+		"name":               "Alice",
+		"groups":             []string{"admins", "unmapped"},
+	}
+	if m.claims != nil {
+		m.claims(claims)
+	}
+	signer := m.key
+	if m.signer != nil {
+		signer = m.signer
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(signer)
+	if err != nil {
+		t.Fatalf("sign id_token: %v", err)
+	}
+	return signed
+}
+
+func newOIDCProviders(m *mockIdP) *Providers {
+	return NewProviders(&conf.AuthConfig{Providers: []conf.ProviderConfig{{
+		Name:         "sso",
+		Type:         "oidc",
+		ClientId:     "client",
+		ClientSecret: "secret",
+		Issuer:       m.URL,
+		Groups:       map[string]string{"admins": "ADMIN"},
+	}}})
+}
+
+// login runs the code flow up to the callback and returns the identity of the exchange
+func (m *mockIdP) login(t *testing.T, p *Providers) (*Identity, error) {
+	state, consent := authorize(t, p, "sso")
+	if consent.Path != "/authorize" || consent.Query().Get("nonce") == "" {
+		t.Errorf("consent url = %v", consent)
+	}
+	m.challenge = consent.Query().Get("code_challenge")
+	m.nonce = consent.Query().Get("nonce")
+	return p.Exchange(context.Background(), "sso", state, "code-1")
+}
+
+func TestOIDCExchange(t *testing.T) {
+	m := newMockIdP(t)
+	identity, err := m.login(t, newOIDCProviders(m))
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	want := &Identity{
+		Provider: "sso",
+		Subject:  "u-1",
+		Name:     "alice",
+		Nick:     "Alice",
+		Email:    "alice@example.com",
+		Roles:    []string{"ADMIN"},
+	}
+	if !reflect.DeepEqual(identity, want) {
+		t.Errorf("Exchange() = %+v, want %+v", identity, want)
+	}
+}
+
+func TestOIDCRejectsIdToken(t *testing.T) {
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tests := []struct {
+		name   string
+		claims func(claims jwt.MapClaims)
+		signer *ecdsa.PrivateKey
+	}{
+		{name: "issuer", claims: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{name: "audience", claims: func(c jwt.MapClaims) { c["aud"] = "another-client" }},
+		{name: "expired", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		{name: "missing exp", claims: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "nonce", claims: func(c jwt.MapClaims) { c["nonce"] = "replayed" }},
+		{name: "missing sub", claims: func(c jwt.MapClaims) { delete(c, "sub") }},
+		{name: "signature", signer: other},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockIdP(t)
+			m.claims, m.signer = tt.claims, tt.signer
+			if identity, err := m.login(t, newOIDCProviders(m)); err == nil {
+				t.Errorf("Exchange() = %+v, want an error", identity)
+			}
+		})
+	}
+}
+
+func TestOIDCPKCE(t *testing.T) {
+	m := newMockIdP(t)
+	p := newOIDCProviders(m)
+	state, consent := authorize(t, p, "sso")
+	m.nonce = consent.Query().Get("nonce")
+	_, other := authorize(t, p, "sso")
+	m.challenge = other.Query().Get("code_challenge")
+	if _, err := p.Exchange(context.Background(), "sso", state, "code-1"); err == nil {
+		t.Error("Exchange() with a mismatching pkce verifier succeeded")
+	}
+}
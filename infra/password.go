@@ -0,0 +1,164 @@
+package infra
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang-ast/conf"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var errHashFormat = errors.New("unknown password hash format")
+
+// PasswordHasher hashes passwords with argon2id or bcrypt. Argon2id hashes are encoded in
+// the PHC string format and bcrypt hashes in their modular crypt format, so every hash
+// names its algorithm and parameters. Passwords are keyed with the pepper by HMAC-SHA256
+// before hashing, changing the pepper invalidates every password
+type PasswordHasher struct {
+	cfg *conf.PasswordConfig
+	// slots bounds the hashes computed at once, further callers wait for a free slot
+	slots chan struct{}
+	// dummy is verified for sign-ins of unknown users, so they take as long as known ones
+	dummy     string
+	dummyOnce sync.Once
+}
+
+func NewPasswordHasher(cfg *conf.PasswordConfig) *PasswordHasher {
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &PasswordHasher{cfg: cfg, slots: make(chan struct{}, concurrency)}
+}
+
+func (h *PasswordHasher) acquire() func() {
+	h.slots <- struct{}{}
+	return func() {
+		<-h.slots
+	}
+}
+
+// Hash encodes a password with the configured algorithm and parameters
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	defer h.acquire()()
+	return h.hash(password)
+}
+
+func (h *PasswordHasher) hash(password string) (string, error) {
+	keyed := h.keyed(password)
+	if h.cfg.Algorithm == "bcrypt" {
+		hash, err := bcrypt.GenerateFromPassword(keyed, h.cfg.BcryptCost)
+		return string(hash), err
+	}
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(keyed, salt, h.cfg.Iterations, h.cfg.Memory, h.cfg.Parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		h.cfg.Memory, h.cfg.Iterations, h.cfg.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify checks a password against an encoded hash in constant time. Rehash reports that
+// the hash was made with another algorithm or parameters, or is a legacy plaintext
+// password, and should be replaced by a new hash of the password
+func (h *PasswordHasher) Verify(encoded, password string) (ok bool, rehash bool) {
+	defer h.acquire()()
+	return h.verify(encoded, password)
+}
+
+// VerifyDummy spends the time of verifying a password against a hash made with the current
+// settings, it always fails
+func (h *PasswordHasher) VerifyDummy(password string) {
+	defer h.acquire()()
+	h.dummyOnce.Do(func() {
+		secret := make([]byte, argon2SaltLength)
+		_, _ = rand.Read(secret)
+		h.dummy, _ = h.hash(base64.RawStdEncoding.EncodeToString(secret))
+	})
+	_, _ = h.verify(h.dummy, password)
+}
+
+func (h *PasswordHasher) verify(encoded, password string) (ok bool, rehash bool) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2(encoded)
+		if err != nil {
+			return false, false
+		}
+		actual := argon2.IDKey(h.keyed(password), salt, params.t, params.m, params.p, uint32(len(key)))
+		if subtle.ConstantTimeCompare(actual, key) != 1 {
+			return false, false
+		}
+		return true, h.cfg.Algorithm != "argon2id" || params.m != h.cfg.Memory ||
+			params.t != h.cfg.Iterations || params.p != h.cfg.Parallelism || len(key) != argon2KeyLength
+	case strings.HasPrefix(encoded, "$2"):
+		if bcrypt.CompareHashAndPassword([]byte(encoded), h.keyed(password)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return true, err != nil || h.cfg.Algorithm != "bcrypt" || cost != h.cfg.BcryptCost
+	case strings.HasPrefix(encoded, "$"):
+		return false, false
+	}
+	// passwords stored before hashing was introduced
+	if encoded == "" || subtle.ConstantTimeCompare([]byte(encoded), []byte(password)) != 1 {
+		return false, false
+	}
+	return true, true
+}
+
+func (h *PasswordHasher) keyed(password string) []byte {
+	mac := hmac.New(sha256.New, []byte(h.cfg.Pepper))
+	mac.Write([]byte(password))
+	// base64 keeps the input of bcrypt free of zero bytes and below its 72 byte limit
+	return []byte(base64.RawStdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+type argon2Params struct {
+	m uint32
+	t uint32
+	p uint8
+}
+
+// decodeArgon2 parses $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+func decodeArgon2(encoded string) (*argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, nil, nil, errHashFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errHashFormat
+	}
+	var params argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.m, &params.t, &params.p); err != nil {
+		return nil, nil, nil, errHashFormat
+	}
+	if params.t == 0 || params.p == 0 {
+		return nil, nil, nil, errHashFormat
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, errHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, errHashFormat
+	}
+	return &params, salt, key, nil
+}
@@ -0,0 +1,61 @@
+package infra
+
+import (
+	_ "embed"
+	"golang-ast/conf"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//go:embed banned_passwords.txt
+var bannedPasswords string
+
+// PasswordPolicy checks new passwords against the configured rules and a list of common
+// passwords, the history of a user is checked by Authorization.CheckPassword
+type PasswordPolicy struct {
+	cfg    *conf.PasswordPolicyConfig
+	banned map[string]bool
+}
+
+func NewPasswordPolicy(cfg *conf.PasswordPolicyConfig) *PasswordPolicy {
+	banned := map[string]bool{}
+	for _, line := range strings.Split(bannedPasswords, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			banned[strings.ToLower(line)] = true
+		}
+	}
+	return &PasswordPolicy{cfg: cfg, banned: banned}
+}
+
+// Check returns every rule the password violates, name is the account it is set for
+func (p *PasswordPolicy) Check(name, password string) []string {
+	var violations []string
+	if utf8.RuneCountInString(password) < p.cfg.MinLength {
+		violations = append(violations, "min="+strconv.Itoa(p.cfg.MinLength))
+	}
+	for _, class := range p.cfg.Classes {
+		if strings.IndexFunc(password, characterClasses[class]) < 0 {
+			violations = append(violations, class)
+		}
+	}
+	lower := strings.ToLower(password)
+	if p.banned[lower] {
+		violations = append(violations, "banned")
+	}
+	if name != "" && strings.Contains(lower, strings.ToLower(name)) {
+		violations = append(violations, "username")
+	}
+	return violations
+}
+
+var characterClasses = map[string]func(rune) bool{
+	"lower": unicode.IsLower,
+	"upper": unicode.IsUpper,
+	"digit": unicode.IsDigit,
+	"symbol": func(r rune) bool {
+		return unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r)
+	},
+}
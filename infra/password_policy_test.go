@@ -0,0 +1,133 @@
+package infra
+
+import (
+	"golang-ast/conf"
+	"golang-ast/db"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := NewPasswordPolicy(&conf.PasswordPolicyConfig{MinLength: 8, Classes: []string{"lower", "upper", "digit"}})
+	symbols := NewPasswordPolicy(&conf.PasswordPolicyConfig{MinLength: 4, Classes: []string{"symbol"}})
+	tests := []struct {
+		name     string
+		policy   *PasswordPolicy
+		password string
+		want     []string
+	}{
+		{name: "valid", policy: policy, password: "Tr0ubadour"},
+		{name: "short", policy: policy, password: "Tr0ub", want: []string{"min=8"}},
+		{name: "length in characters", policy: policy, password: "Äöü1Äöü1"},
+		{name: "missing classes", policy: policy, password: "troubadour", want: []string{"upper", "digit"}},
+		{name: "banned ignoring case", policy: policy, password: "Password123", want: []string{"banned"}},
+		{name: "contains the name", policy: policy, password: "xALICEx99", want: []string{"username"}},
+		{name: "everything", policy: policy, password: "alice", want: []string{"min=8", "upper", "digit", "username"}},
+		{name: "symbol", policy: symbols, password: "ab cd"},
+		{name: "no symbol", policy: symbols, password: "abcd", want: []string{"symbol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Check("alice", tt.password); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Check(%q) = %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func newPolicyAuthorization(t *testing.T, history int) *Authorization {
+	t.Helper()
+	cfg := &conf.AuthConfig{Password: *testPasswordConfig("argon2id")}
+	cfg.Password.Policy = conf.PasswordPolicyConfig{MinLength: 1, History: history}
+	return &Authorization{cfg: cfg, log: zap.NewNop(), db: testDB(t),
+		passwords: NewPasswordHasher(&cfg.Password), policy: NewPasswordPolicy(&cfg.Password.Policy)}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	a := newPolicyAuthorization(t, 2)
+	hash, err := a.HashPassword("first")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+	user, err := a.db.CreateUser(&db.SysUser{Name: "alice", Password: hash, Enable: true, LockBy: "none"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if err = a.RecordPassword(user); err != nil {
+		t.Fatalf("RecordPassword() error = %v", err)
+	}
+	for _, password := range []string{"second", "third"} {
+		if err = a.SetPassword(user, password); err != nil {
+			t.Fatalf("SetPassword(%v) error = %v", password, err)
+		}
+	}
+	if user.PwdChanged == nil || time.Since(*user.PwdChanged) > time.Minute {
+		t.Errorf("SetPassword() pwd changed = %v, want now", user.PwdChanged)
+	}
+	if history, err := a.db.GetPasswordHistory(user.Id, 10); err != nil || len(history) != 2 {
+		t.Errorf("GetPasswordHistory() = %v records, %v, want the last 2", len(history), err)
+	}
+
+	tests := []struct {
+		password string
+		reused   bool
+	}{
+		{password: "third", reused: true},
+		{password: "second", reused: true},
+		// only the last two passwords are kept
+		{password: "first"},
+		{password: "fourth"},
+	}
+	for _, tt := range tests {
+		violations, err := a.CheckPassword(user, tt.password)
+		if err != nil {
+			t.Fatalf("CheckPassword() error = %v", err)
+		}
+		if reused := reflect.DeepEqual(violations, []string{"history=2"}); reused != tt.reused || (!reused && len(violations) > 0) {
+			t.Errorf("CheckPassword(%q) = %v, reused want %v", tt.password, violations, tt.reused)
+		}
+	}
+
+	// a new user has no history yet
+	if violations, _ := a.CheckPassword(&db.SysUser{Name: "bob"}, "third"); len(violations) > 0 {
+		t.Errorf("CheckPassword(new user) = %v, want none", violations)
+	}
+	// neither has a user while the history is disabled, its current password included
+	a.cfg.Password.Policy.History = 0
+	if violations, _ := a.CheckPassword(user, "third"); len(violations) > 0 {
+		t.Errorf("CheckPassword(history 0) = %v, want none", violations)
+	}
+}
+
+func TestPasswordExpired(t *testing.T) {
+	now := time.Now()
+	changed := func(days int) *time.Time {
+		at := now.Add(-time.Duration(days) * 24 * time.Hour)
+		return &at
+	}
+	tests := []struct {
+		name    string
+		maxAge  int
+		user    *db.SysUser
+		expired bool
+	}{
+		{name: "no max age", user: &db.SysUser{Ct: *changed(1000)}},
+		{name: "aged from creation", maxAge: 90, user: &db.SysUser{Ct: *changed(91)}, expired: true},
+		{name: "young from creation", maxAge: 90, user: &db.SysUser{Ct: *changed(89)}},
+		{name: "changed recently", maxAge: 90, user: &db.SysUser{Ct: *changed(1000), PwdChanged: changed(10)}},
+		{name: "changed long ago", maxAge: 90, user: &db.SysUser{Ct: *changed(1000), PwdChanged: changed(120)}, expired: true},
+		{name: "oauth user", maxAge: 90, user: &db.SysUser{Ct: *changed(1000), OpenId: "github:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Authorization{cfg: &conf.AuthConfig{}}
+			a.cfg.Password.Policy.MaxAge = tt.maxAge
+			if got := a.PasswordExpired(tt.user); got != tt.expired {
+				t.Errorf("PasswordExpired() = %v, want %v", got, tt.expired)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package infra
+
+import (
+	"golang-ast/conf"
+	"golang-ast/db"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// testPasswordConfig is the cheapest configuration the validation accepts
+func testPasswordConfig(algorithm string) *conf.PasswordConfig {
+	return &conf.PasswordConfig{
+		Algorithm:   algorithm,
+		Pepper:      "pepper",
+		Memory:      8192,
+		Iterations:  1,
+		Parallelism: 1,
+		BcryptCost:  10,
+		Concurrency: 2,
+	}
+}
+
+func mustHash(t *testing.T, h *PasswordHasher, password string) string {
+	t.Helper()
+	hash, err := h.Hash(password)
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+	return hash
+}
+
+func TestPasswordHasher(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		prefix    string
+	}{
+		{algorithm: "argon2id", prefix: "$argon2id$v=19$m=8192,t=1,p=1$"},
+		{algorithm: "bcrypt", prefix: "$2a$10$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			h := NewPasswordHasher(testPasswordConfig(tt.algorithm))
+			hash := mustHash(t, h, "correct horse")
+			if !strings.HasPrefix(hash, tt.prefix) {
+				t.Errorf("Hash() = %v, want prefix %v", hash, tt.prefix)
+			}
+			if again := mustHash(t, h, "correct horse"); again == hash {
+				t.Error("Hash() twice = the same hash, want a fresh salt")
+			}
+			if ok, rehash := h.Verify(hash, "correct horse"); !ok || rehash {
+				t.Errorf("Verify(right) = %v, %v, want true, false", ok, rehash)
+			}
+			if ok, _ := h.Verify(hash, "correct horse!"); ok {
+				t.Error("Verify(wrong) = true")
+			}
+			peppered := testPasswordConfig(tt.algorithm)
+			peppered.Pepper = "other"
+			if ok, _ := NewPasswordHasher(peppered).Verify(hash, "correct horse"); ok {
+				t.Error("Verify() with another pepper = true")
+			}
+		})
+	}
+}
+
+func TestPasswordRehash(t *testing.T) {
+	argon := NewPasswordHasher(testPasswordConfig("argon2id"))
+	bcrypted := NewPasswordHasher(testPasswordConfig("bcrypt"))
+	stronger := testPasswordConfig("argon2id")
+	stronger.Memory = 16384
+	costlier := testPasswordConfig("bcrypt")
+	costlier.BcryptCost = 11
+
+	tests := []struct {
+		name    string
+		hasher  *PasswordHasher
+		encoded string
+		ok      bool
+		rehash  bool
+	}{
+		{name: "current argon2id", hasher: argon, encoded: mustHash(t, argon, "secret"), ok: true},
+		{name: "argon2id of older memory", hasher: NewPasswordHasher(stronger), encoded: mustHash(t, argon, "secret"), ok: true, rehash: true},
+		{name: "bcrypt under argon2id", hasher: argon, encoded: mustHash(t, bcrypted, "secret"), ok: true, rehash: true},
+		{name: "bcrypt of lower cost", hasher: NewPasswordHasher(costlier), encoded: mustHash(t, bcrypted, "secret"), ok: true, rehash: true},
+		{name: "argon2id under bcrypt", hasher: bcrypted, encoded: mustHash(t, argon, "secret"), ok: true, rehash: true},
+		{name: "legacy plaintext", hasher: argon, encoded: "secret", ok: true, rehash: true},
+		{name: "legacy plaintext mismatch", hasher: argon, encoded: "Secret"},
+		{name: "no password", hasher: argon, encoded: ""},
+		{name: "truncated argon2id", hasher: argon, encoded: "$argon2id$v=19$m=8192,t=1,p=1$c2FsdA"},
+		{name: "other argon2 version", hasher: argon, encoded: strings.Replace(mustHash(t, argon, "secret"), "v=19", "v=16", 1)},
+		{name: "zero iterations", hasher: argon, encoded: strings.Replace(mustHash(t, argon, "secret"), "t=1", "t=0", 1)},
+		{name: "unknown scheme", hasher: argon, encoded: "$5$rounds=5000$salt$hash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash := tt.hasher.Verify(tt.encoded, "secret")
+			if ok != tt.ok || rehash != tt.rehash {
+				t.Errorf("Verify() = %v, %v, want %v, %v", ok, rehash, tt.ok, tt.rehash)
+			}
+		})
+	}
+}
+
+func TestVerifyPasswordUpgrade(t *testing.T) {
+	cfg := &conf.AuthConfig{Password: *testPasswordConfig("argon2id")}
+	a := &Authorization{cfg: cfg, log: zap.NewNop(), db: testDB(t), passwords: NewPasswordHasher(&cfg.Password)}
+	user, err := a.db.CreateUser(&db.SysUser{Name: "alice", Password: "secret", Enable: true, LockBy: "none"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	if a.VerifyPassword(user, "wrong") || user.Password != "secret" {
+		t.Fatalf("VerifyPassword(wrong) upgraded the password to %v", user.Password)
+	}
+	if !a.VerifyPassword(user, "secret") {
+		t.Fatal("VerifyPassword(legacy) = false")
+	}
+	stored, err := a.db.FindUserById(user.Id, false)
+	if err != nil {
+		t.Fatalf("FindUserById() error = %v", err)
+	}
+	if !strings.HasPrefix(stored.Password, "$argon2id$") || stored.Password != user.Password {
+		t.Errorf("stored password = %v, want the argon2id hash %v", stored.Password, user.Password)
+	}
+	if !a.VerifyPassword(stored, "secret") || stored.Password != user.Password {
+		t.Error("VerifyPassword(upgraded) rehashed a current hash")
+	}
+}
+
+func TestPasswordConcurrency(t *testing.T) {
+	cfg := testPasswordConfig("argon2id")
+	cfg.Concurrency = 1
+	h := NewPasswordHasher(cfg)
+	h.VerifyDummy("secret")
+	if h.dummy == "" {
+		t.Fatal("VerifyDummy() left no dummy hash")
+	}
+	if ok, _ := h.Verify(h.dummy, "secret"); ok {
+		t.Error("the dummy hash accepts a password")
+	}
+
+	// with the only slot taken every hash waits for it
+	release := h.acquire()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.VerifyDummy("secret")
+	}()
+	select {
+	case <-done:
+		t.Fatal("VerifyDummy() ran without a free slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("VerifyDummy() still waits after the slot was released")
+	}
+}
@@ -0,0 +1,84 @@
+package infra
+
+import (
+	"context"
+	"golang-ast/conf"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// initPermits builds the first auth trie and starts watching the permit override file,
+// the chain is embedded permit.yml < permit_file < sys_route_permit table
+func (a *Authorization) initPermits() {
+	embedded, err := conf.EmbeddedPermits()
+	if err != nil {
+		a.log.Error("initPermits().EmbeddedPermits() error", zap.Error(err))
+		embedded = a.cfg.Permits
+	}
+	a.embeddedPermits = embedded
+	var ctx context.Context
+	ctx, a.permitCancel = context.WithCancel(context.Background())
+	filePermits, err := conf.WatchPermitFile(ctx, a.cfg.PermitFile, func(permits *conf.PermitConfig) {
+		a.log.Info("permit file changed, reload permits", zap.String("file", a.cfg.PermitFile))
+		a.permitLock.Lock()
+		a.filePermits = permits
+		a.permitLock.Unlock()
+		a.ReloadPermits()
+	})
+	if err != nil {
+		a.log.Error("initPermits().WatchPermitFile() error", zap.String("file", a.cfg.PermitFile), zap.Error(err))
+	}
+	a.permitLock.Lock()
+	// a change the watcher delivered in the meantime is newer than the first read
+	if a.filePermits == nil {
+		a.filePermits = filePermits
+	}
+	a.permitLock.Unlock()
+	if a.cfg.PermitDb {
+		a.permitTicker = time.NewTicker(time.Duration(a.cfg.PermitRefresh) * time.Second)
+	}
+	a.ReloadPermits()
+}
+
+// ReloadPermits merges every permit layer and atomically swaps the auth trie,
+// the last good table rows are kept when the database can't be read
+func (a *Authorization) ReloadPermits() {
+	a.permitLock.Lock()
+	defer a.permitLock.Unlock()
+	if a.cfg.PermitDb {
+		dbPermits, err := a.loadDbPermits()
+		if err != nil {
+			a.log.Error("ReloadPermits().loadDbPermits() error", zap.Error(err))
+		} else {
+			a.dbPermits = dbPermits
+		}
+	}
+	merged := conf.MergePermits(a.embeddedPermits, a.filePermits, a.dbPermits)
+	trie := NewTrie()
+	for _, v := range merged.Authentications {
+		trie.Parse("/api"+v.Url, strings.Split(v.Permit, "|")[0])
+	}
+	for _, k := range merged.WhiteList {
+		url, _ := conf.SplitPermit(k)
+		trie.Parse("/api"+url, "*")
+	}
+	a.trie.Store(trie)
+}
+
+func (a *Authorization) loadDbPermits() (*conf.PermitConfig, error) {
+	rows, err := a.db.GetRoutePermits()
+	if err != nil {
+		return nil, err
+	}
+	permits := &conf.PermitConfig{}
+	for _, row := range rows {
+		if row.WhiteList {
+			permits.WhiteList = append(permits.WhiteList, row.Url)
+			continue
+		}
+		permits.Authentications = append(permits.Authentications, conf.AuthKV{Url: row.Url, Permit: row.Permit})
+	}
+	return permits, nil
+}
@@ -0,0 +1,177 @@
+package infra
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang-ast/conf"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const oauthStateTTL = 10 * time.Minute
+
+var (
+	ErrProviderNotFound  = errors.New("identity provider is not configured")
+	ErrOAuthStateInvalid = errors.New("oauth state is unknown or expired")
+)
+
+// Identity is the account an identity provider vouches for
+type Identity struct {
+	Provider string
+	Subject  string
+	Name     string
+	Nick     string
+	Email    string
+	Phone    string
+	Avatar   string
+	// Roles are the SysRole codes mapped from the provider groups, nil when the
+	// provider doesn't manage roles
+	Roles []string
+}
+
+// OpenId links the identity to a SysUser
+func (i *Identity) OpenId() string {
+	return i.Provider + ":" + i.Subject
+}
+
+// AuthRequest carries the per-login secrets of an authorization code flow
+type AuthRequest struct {
+	State       string
+	Nonce       string
+	Verifier    string
+	RedirectUri string
+}
+
+// Challenge is the PKCE S256 code challenge of the verifier
+func (r *AuthRequest) Challenge() string {
+	sum := sha256.Sum256([]byte(r.Verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// IdentityProvider signs users in through the oauth2 authorization code flow
+type IdentityProvider interface {
+	Name() string
+	// AuthCodeURL returns the consent page address of the provider
+	AuthCodeURL(ctx context.Context, req *AuthRequest) (string, error)
+	// Exchange trades the code returned to the callback for the identity of the user
+	Exchange(ctx context.Context, req *AuthRequest, code string) (*Identity, error)
+}
+
+type pendingAuth struct {
+	provider string
+	req      AuthRequest
+	exp      time.Time
+}
+
+// Providers holds the configured identity providers and the pending logins, a state
+// is single use and expires after ten minutes
+type Providers struct {
+	providers map[string]IdentityProvider
+	lock      sync.Mutex
+	pending   map[string]pendingAuth
+}
+
+func NewProviders(cfg *conf.AuthConfig) *Providers {
+	p := &Providers{
+		providers: map[string]IdentityProvider{},
+		pending:   map[string]pendingAuth{},
+	}
+	// git_id and git_key predate the provider list and still configure github
+	if cfg.GitId != "" && cfg.GitKey != "" {
+		p.providers["github"] = NewGitHub(conf.ProviderConfig{
+			Name:         "github",
+			Type:         "github",
+			ClientId:     cfg.GitId,
+			ClientSecret: cfg.GitKey,
+		})
+	}
+	for _, provider := range cfg.Providers {
+		switch provider.Type {
+		case "github":
+			p.providers[provider.Name] = NewGitHub(provider)
+		case "oidc":
+			p.providers[provider.Name] = NewOIDC(provider)
+		}
+	}
+	return p
+}
+
+// Authorize starts a login with a provider and returns the consent page address and its state
+func (p *Providers) Authorize(ctx context.Context, name, redirectUri string) (string, string, error) {
+	provider, ok := p.providers[name]
+	if !ok {
+		return "", "", ErrProviderNotFound
+	}
+	req := AuthRequest{RedirectUri: redirectUri}
+	for _, secret := range []*string{&req.State, &req.Nonce, &req.Verifier} {
+		value, err := randomToken()
+		if err != nil {
+			return "", "", err
+		}
+		*secret = value
+	}
+	target, err := provider.AuthCodeURL(ctx, &req)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for k, v := range p.pending {
+		if now.After(v.exp) {
+			delete(p.pending, k)
+		}
+	}
+	p.pending[req.State] = pendingAuth{provider: name, req: req, exp: now.Add(oauthStateTTL)}
+	return target, req.State, nil
+}
+
+// Exchange consumes the state of a login and resolves the identity from the callback code
+func (p *Providers) Exchange(ctx context.Context, name, state, code string) (*Identity, error) {
+	p.lock.Lock()
+	pending, ok := p.pending[state]
+	delete(p.pending, state)
+	p.lock.Unlock()
+	if !ok || pending.provider != name || time.Now().After(pending.exp) {
+		return nil, ErrOAuthStateInvalid
+	}
+	provider, ok := p.providers[name]
+	if !ok {
+		return nil, ErrProviderNotFound
+	}
+	return provider.Exchange(ctx, &pending.req, code)
+}
+
+// randomToken returns 256 random bits encoded for urls
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// fetchJSON sends the request and decodes a 200 answer of at most 1MB
+func fetchJSON(client *http.Client, req *http.Request, out any) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v %v answered %v", req.Method, req.URL.Path, resp.Status)
+	}
+	return json.Unmarshal(body, out)
+}
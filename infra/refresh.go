@@ -0,0 +1,111 @@
+package infra
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// maxRotatedTokens bounds how many replaced refresh tokens a session remembers
+const maxRotatedTokens = 16
+
+var (
+	ErrRefreshDisabled     = errors.New("token refresh is disabled")
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, please sign in again")
+)
+
+// TokenPair is what a sign-in or a refresh hands back in refresh mode
+type TokenPair struct {
+	Principal    string
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int
+}
+
+// RefreshEnabled reports whether access tokens are renewed through refresh tokens
+// instead of being re-signed by the auth filter
+func (a *Authorization) RefreshEnabled() bool {
+	return a.cfg.TokenMode == "refresh"
+}
+
+// rotateRefreshToken gives the session a new refresh token, the session id is the token
+// family, every refresh token of one sign-in starts with it
+func (a *Authorization) rotateRefreshToken(session *Session) (string, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	if session.RefreshHash != "" {
+		session.Rotated = append(session.Rotated, session.RefreshHash)
+		if len(session.Rotated) > maxRotatedTokens {
+			session.Rotated = session.Rotated[len(session.Rotated)-maxRotatedTokens:]
+		}
+	}
+	session.RefreshHash = hashToken(secret)
+	return session.Id + "." + secret, nil
+}
+
+// Refresh trades a refresh token for a new token pair. Presenting a token that was already
+// rotated out means it leaked, the whole family is revoked by deleting the session
+func (a *Authorization) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	if !a.RefreshEnabled() {
+		return nil, ErrRefreshDisabled
+	}
+	id, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok || id == "" || secret == "" {
+		return nil, ErrRefreshTokenInvalid
+	}
+	session, err := a.store.GetSession(ctx, id)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the hash is checked and replaced in one swap, of two requests racing with the same
+	// token the second one sees it rotated out and revokes the family. The session keeps
+	// the expiry of its sign-in, refreshing never extends the family
+	hash := hashToken(secret)
+	pair := &TokenPair{ExpiresIn: int(a.jwt.Expires.Seconds())}
+	err = a.updateSession(ctx, session, func(session *Session) error {
+		if session.RefreshHash != hash {
+			for _, rotated := range session.Rotated {
+				if rotated == hash {
+					a.log.Warn("Refresh().refresh token reused, revoking session",
+						zap.String("principal", session.Principal), zap.String("session", session.Id))
+					if err := a.store.DeleteSession(ctx, session.Id); err != nil {
+						return err
+					}
+					return ErrRefreshTokenReused
+				}
+			}
+			return ErrRefreshTokenInvalid
+		}
+		token, err := a.jwt.CreateToken(session.Id, session.Uid, session.Principal, session.Roles, session.Scope)
+		if err != nil {
+			return err
+		}
+		if pair.RefreshToken, err = a.rotateRefreshToken(session); err != nil {
+			return err
+		}
+		pair.Principal, pair.AccessToken = session.Principal, token
+		return nil
+	})
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,162 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"golang-ast/conf"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// newRefreshAuthorization is an Authorization in refresh mode with just a session store
+func newRefreshAuthorization(t *testing.T, store SessionStore) *Authorization {
+	cfg := &conf.AuthConfig{
+		JwtKey:    "0123456789abcdef0123456789abcdef",
+		JwtExp:    24,
+		TokenMode: "refresh",
+		AccessExp: 15,
+	}
+	token, err := NewJWT(cfg)
+	if err != nil {
+		t.Fatalf("NewJWT() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	return &Authorization{jwt: token, cfg: cfg, log: zap.NewNop(), store: store}
+}
+
+// signIn stores the session of a sign-in and returns its first refresh token
+func signIn(t *testing.T, a *Authorization, id string) (*Session, string) {
+	now := time.Now()
+	session := &Session{Id: id, Uid: "uid-1", Principal: "alice", Roles: []string{"ADMIN"},
+		Ct: now, Seen: now, Exp: now.Add(time.Duration(a.cfg.JwtExp) * time.Hour)}
+	refresh, err := a.rotateRefreshToken(session)
+	if err != nil {
+		t.Fatalf("rotateRefreshToken() error = %v", err)
+	}
+	if err = a.store.SaveSession(context.Background(), session); err != nil {
+		t.Fatalf("SaveSession() error = %v", err)
+	}
+	return session, refresh
+}
+
+func refreshStores(t *testing.T) map[string]func() SessionStore {
+	return map[string]func() SessionStore{
+		"memory": func() SessionStore { return NewMemorySessionStore() },
+		"redis": func() SessionStore {
+			return NewRedisSessionStore(redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}), "admin:")
+		},
+	}
+}
+
+func TestRefreshRotation(t *testing.T) {
+	for name, store := range refreshStores(t) {
+		t.Run(name, func(t *testing.T) {
+			a := newRefreshAuthorization(t, store())
+			ctx := context.Background()
+			session, first := signIn(t, a, "family-1")
+
+			pair, err := a.Refresh(ctx, first)
+			if err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			if pair.Principal != "alice" || pair.RefreshToken == first || !strings.HasPrefix(pair.RefreshToken, "family-1.") {
+				t.Errorf("Refresh() = %+v", pair)
+			}
+			claim, err := a.ParseToken(pair.AccessToken)
+			if err != nil || claim.ID != "family-1" || claim.Name != "alice" {
+				t.Errorf("ParseToken(access token) = %+v, %v", claim, err)
+			}
+			second, err := a.Refresh(ctx, pair.RefreshToken)
+			if err != nil {
+				t.Fatalf("Refresh(rotated) error = %v", err)
+			}
+			// the family keeps the expiry of its sign-in
+			stored, err := a.store.GetSession(ctx, "family-1")
+			if err != nil || !stored.Exp.Equal(session.Exp) {
+				t.Errorf("session exp after refresh = %v, %v, want %v", stored.Exp, err, session.Exp)
+			}
+
+			// replaying a rotated token revokes the whole family
+			if _, err = a.Refresh(ctx, first); !errors.Is(err, ErrRefreshTokenReused) {
+				t.Errorf("Refresh(replayed) error = %v, want ErrRefreshTokenReused", err)
+			}
+			if _, err = a.Refresh(ctx, second.RefreshToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+				t.Errorf("Refresh(after revocation) error = %v, want ErrRefreshTokenInvalid", err)
+			}
+		})
+	}
+}
+
+func TestRefreshRejects(t *testing.T) {
+	a := newRefreshAuthorization(t, NewMemorySessionStore())
+	ctx := context.Background()
+	signIn(t, a, "family-1")
+	for _, token := range []string{"", "family-1", "family-1.", ".secret", "family-1.forged", "unknown.secret"} {
+		if _, err := a.Refresh(ctx, token); !errors.Is(err, ErrRefreshTokenInvalid) {
+			t.Errorf("Refresh(%q) error = %v, want ErrRefreshTokenInvalid", token, err)
+		}
+	}
+
+	expired, refresh := signIn(t, a, "family-2")
+	expired.Exp = time.Now().Add(-time.Second)
+	_ = a.store.SaveSession(ctx, expired)
+	if _, err := a.Refresh(ctx, refresh); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("Refresh(expired family) error = %v, want ErrRefreshTokenInvalid", err)
+	}
+
+	a.cfg.TokenMode = "renew"
+	if _, err := a.Refresh(ctx, refresh); !errors.Is(err, ErrRefreshDisabled) {
+		t.Errorf("Refresh(renew mode) error = %v, want ErrRefreshDisabled", err)
+	}
+}
+
+func TestRefreshConcurrentUse(t *testing.T) {
+	for name, store := range refreshStores(t) {
+		t.Run(name, func(t *testing.T) {
+			a := newRefreshAuthorization(t, store())
+			ctx := context.Background()
+			_, refresh := signIn(t, a, "family-1")
+
+			const callers = 8
+			var (
+				wg        sync.WaitGroup
+				lock      sync.Mutex
+				successes int
+			)
+			start := make(chan struct{})
+			for i := 0; i < callers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					_, err := a.Refresh(ctx, refresh)
+					switch {
+					case err == nil:
+						lock.Lock()
+						successes++
+						lock.Unlock()
+					case !errors.Is(err, ErrRefreshTokenReused) && !errors.Is(err, ErrRefreshTokenInvalid):
+						t.Errorf("Refresh() error = %v", err)
+					}
+				}()
+			}
+			close(start)
+			wg.Wait()
+			// one caller wins the swap, the others see the token rotated out and revoke the family
+			if successes != 1 {
+				t.Errorf("successful refreshes = %v, want 1", successes)
+			}
+			if _, err := a.store.GetSession(ctx, "family-1"); !errors.Is(err, ErrSessionNotFound) {
+				t.Errorf("GetSession() after concurrent use error = %v, want ErrSessionNotFound", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package infra
+
+import (
+	"errors"
+	"golang-ast/db"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+const (
+	revocationCacheSize = 10000
+	// revocationSyncOverlap re-reads the revocations around the last sync, rows written by
+	// other replicas may carry a slightly older time than they were committed at
+	revocationSyncOverlap = time.Minute
+	// revocationMissTtl bounds how long a token revoked on another replica is still
+	// accepted here before its row is read again
+	revocationMissTtl = 5 * time.Second
+)
+
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// RevocationList rejects tokens revoked by jwt id or issued before a cutoff of their user.
+// The revocations are kept in the database, a lru of revoked ids sits in front of it and
+// is fed with the revocations of other replicas on every Sync. Ids found not revoked are
+// only remembered for a few seconds
+type RevocationList struct {
+	db      *db.DB
+	cache   *lru.Cache[string, bool]
+	misses  *expirable.LRU[string, bool]
+	lock    sync.RWMutex
+	cutoffs map[string]time.Time
+	synced  time.Time
+}
+
+func NewRevocationList(dbms *db.DB) (*RevocationList, error) {
+	cache, err := lru.New[string, bool](revocationCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	r := &RevocationList{
+		db:      dbms,
+		cache:   cache,
+		misses:  expirable.NewLRU[string, bool](revocationCacheSize, nil, revocationMissTtl),
+		cutoffs: map[string]time.Time{},
+	}
+	return r, r.Sync()
+}
+
+// Revoke rejects the token with the jwt id until exp
+func (r *RevocationList) Revoke(jti, principal, reason string, exp time.Time) error {
+	err := r.db.RevokeToken(&db.SysTokenRevocation{
+		Jti:       jti,
+		Principal: principal,
+		Reason:    reason,
+		Ct:        time.Now(),
+		Exp:       exp,
+	})
+	if err != nil {
+		return err
+	}
+	r.cache.Add(jti, true)
+	r.misses.Remove(jti)
+	return nil
+}
+
+// RevokeBefore rejects the tokens of a principal issued before the second of before, exp
+// is when the last of them expires. The cutoff has the precision of iat, so a token issued
+// within that second, such as a sign-in right after the revocation, stays valid
+func (r *RevocationList) RevokeBefore(principal string, before, exp time.Time) error {
+	before = before.Truncate(time.Second)
+	err := r.db.SaveTokenCutoff(&db.SysTokenCutoff{
+		Principal: principal,
+		Before:    before,
+		Exp:       exp,
+	})
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.cutoffs[principal] = before
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *RevocationList) IsRevoked(claim *JWTClaims) (bool, error) {
+	r.lock.RLock()
+	before, ok := r.cutoffs[claim.Name]
+	r.lock.RUnlock()
+	if ok && claim.IssuedAt != nil && claim.IssuedAt.Before(before) {
+		return true, nil
+	}
+	if _, ok = r.cache.Get(claim.ID); ok {
+		return true, nil
+	}
+	if _, ok = r.misses.Get(claim.ID); ok {
+		return false, nil
+	}
+	revoked, err := r.db.IsTokenRevoked(claim.ID)
+	if err != nil {
+		return false, err
+	}
+	if revoked {
+		r.cache.Add(claim.ID, true)
+	} else {
+		r.misses.Add(claim.ID, false)
+	}
+	return revoked, nil
+}
+
+// Sync caches the revocations made since the last sync and reloads the cutoffs
+func (r *RevocationList) Sync() error {
+	now := time.Now()
+	since := r.synced
+	if !since.IsZero() {
+		since = since.Add(-revocationSyncOverlap)
+	}
+	revocations, err := r.db.GetRevocationsSince(since)
+	if err != nil {
+		return err
+	}
+	for _, revocation := range revocations {
+		r.cache.Add(revocation.Jti, true)
+		r.misses.Remove(revocation.Jti)
+	}
+	cutoffs, err := r.db.GetTokenCutoffs()
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]time.Time, len(cutoffs))
+	for _, cutoff := range cutoffs {
+		loaded[cutoff.Principal] = cutoff.Before
+	}
+	r.lock.Lock()
+	r.cutoffs = loaded
+	r.synced = now
+	r.lock.Unlock()
+	return nil
+}
+
+// Purge drops the revocations of tokens that have all expired
+func (r *RevocationList) Purge() error {
+	return r.db.PurgeRevocations()
+}
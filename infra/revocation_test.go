@@ -0,0 +1,131 @@
+package infra
+
+import (
+	"golang-ast/db"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func newTestRevocationList(t *testing.T, dbms *db.DB) *RevocationList {
+	t.Helper()
+	r, err := NewRevocationList(dbms)
+	if err != nil {
+		t.Fatalf("NewRevocationList() error = %v", err)
+	}
+	return r
+}
+
+func revocationClaim(jti, name string, iat time.Time) *JWTClaims {
+	claim := &JWTClaims{Name: name}
+	claim.ID = jti
+	if !iat.IsZero() {
+		claim.IssuedAt = jwt.NewNumericDate(iat)
+	}
+	return claim
+}
+
+func TestRevocationCutoff(t *testing.T) {
+	r := newTestRevocationList(t, testDB(t))
+	cutoff := time.Now().Truncate(time.Second).Add(-time.Minute)
+	if err := r.RevokeBefore("alice", cutoff.Add(500*time.Millisecond), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RevokeBefore() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		claim   *JWTClaims
+		revoked bool
+	}{
+		{name: "issued before", claim: revocationClaim("jti-1", "alice", cutoff.Add(-time.Second)), revoked: true},
+		{name: "issued in the cutoff second", claim: revocationClaim("jti-2", "alice", cutoff)},
+		{name: "issued after", claim: revocationClaim("jti-3", "alice", cutoff.Add(time.Second))},
+		{name: "no iat", claim: revocationClaim("jti-4", "alice", time.Time{})},
+		{name: "other principal", claim: revocationClaim("jti-5", "bob", cutoff.Add(-time.Hour))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revoked, err := r.IsRevoked(tt.claim)
+			if err != nil {
+				t.Fatalf("IsRevoked() error = %v", err)
+			}
+			if revoked != tt.revoked {
+				t.Errorf("IsRevoked() = %v, want %v", revoked, tt.revoked)
+			}
+		})
+	}
+}
+
+func TestRevocationReplicas(t *testing.T) {
+	dbms := testDB(t)
+	local, remote := newTestRevocationList(t, dbms), newTestRevocationList(t, dbms)
+	claim := revocationClaim("jti-1", "alice", time.Now())
+	isRevoked := func(r *RevocationList, claim *JWTClaims) bool {
+		t.Helper()
+		revoked, err := r.IsRevoked(claim)
+		if err != nil {
+			t.Fatalf("IsRevoked() error = %v", err)
+		}
+		return revoked
+	}
+
+	// the remote replica remembers the id as not revoked
+	if isRevoked(remote, claim) {
+		t.Fatal("IsRevoked() = true before any revocation")
+	}
+	if err := local.Revoke(claim.ID, claim.Name, "sign out", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if !isRevoked(local, claim) {
+		t.Error("IsRevoked() on the revoking replica = false")
+	}
+	if isRevoked(remote, claim) {
+		t.Error("IsRevoked() on the remote replica = true, want the cached miss until the next sync")
+	}
+	// an id never looked up on the remote replica is read from the database
+	other := revocationClaim("jti-2", "alice", time.Now())
+	if err := local.Revoke(other.ID, other.Name, "sign out", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if !isRevoked(remote, other) {
+		t.Error("IsRevoked(uncached) on the remote replica = false")
+	}
+
+	cutoff := revocationClaim("jti-3", "bob", time.Now().Add(-time.Hour))
+	if err := local.RevokeBefore("bob", time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RevokeBefore() error = %v", err)
+	}
+	if isRevoked(remote, cutoff) {
+		t.Error("IsRevoked() on the remote replica = true, want the cutoff unknown until the next sync")
+	}
+
+	if err := remote.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if !isRevoked(remote, claim) || !isRevoked(remote, cutoff) {
+		t.Error("IsRevoked() on the remote replica after Sync() = false")
+	}
+}
+
+func TestRevocationExpiry(t *testing.T) {
+	dbms := testDB(t)
+	r := newTestRevocationList(t, dbms)
+	if err := r.Revoke("jti-1", "alice", "sign out", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if err := r.Revoke("jti-2", "alice", "sign out", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if err := r.Purge(); err != nil {
+		t.Fatalf("Purge() error = %v", err)
+	}
+	for jti, want := range map[string]bool{"jti-1": false, "jti-2": true} {
+		if revoked, err := dbms.IsTokenRevoked(jti); err != nil || revoked != want {
+			t.Errorf("IsTokenRevoked(%v) after Purge() = %v, %v, want %v", jti, revoked, err, want)
+		}
+	}
+	// a new replica loads only the live revocations
+	if revoked, err := newTestRevocationList(t, dbms).IsRevoked(revocationClaim("jti-1", "alice", time.Now())); err != nil || revoked {
+		t.Errorf("IsRevoked(expired) = %v, %v, want false", revoked, err)
+	}
+}
@@ -0,0 +1,246 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"golang-ast/conf"
+	"golang-ast/db"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrSessionNotFound = errors.New("session expired, please sign in again")
+
+// Session is the serialisable state of one signed-in token, it is keyed by the jwt id
+type Session struct {
+	Id        string   `json:"id"`
+	Uid       string   `json:"uid"`
+	Principal string   `json:"principal"`
+	Roles     []string `json:"roles"`
+	// Authorities is nil once a role of the session changed, the next request reloads them
+	Authorities []string  `json:"authorities"`
+	Ip          string    `json:"ip"`
+	Agent       string    `json:"agent"`
+	Ct          time.Time `json:"ct"`
+	// Seen is when the session was last used, it is written at most once a minute
+	Seen time.Time `json:"seen"`
+	Exp  time.Time `json:"exp"`
+	// RefreshHash is the digest of the live refresh token, Rotated keeps the digests of the
+	// tokens it replaced so a replay is told apart from a forgery
+	RefreshHash string   `json:"refresh_hash,omitempty"`
+	Rotated     []string `json:"rotated,omitempty"`
+	// Scope is the scope of the token of a restricted session
+	Scope string `json:"scope,omitempty"`
+	// Version counts the updates of a stored session, see SessionStore.SwapSession
+	Version int64 `json:"version"`
+}
+
+func (s *Session) hasAnyRole(codes []string) bool {
+	for _, role := range s.Roles {
+		for _, code := range codes {
+			if role == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Session) hasAnyAuthority(names []string) bool {
+	for _, authority := range s.Authorities {
+		for _, name := range names {
+			if authority == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SessionStore keeps the sessions, sign-in failures and locks of Authorization, replicas
+// sharing a store agree on who is signed in and who is locked
+type SessionStore interface {
+	SaveSession(ctx context.Context, session *Session) error
+	// SwapSession updates a session read before only if it is still stored at the same
+	// Version and bumps it, false means another writer came first or the session is gone
+	SwapSession(ctx context.Context, session *Session) (bool, error)
+	// GetSession returns ErrSessionNotFound for unknown and expired sessions
+	GetSession(ctx context.Context, id string) (*Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	// Sessions lists the live sessions of a principal, or of everyone when principal is empty
+	Sessions(ctx context.Context, principal string) ([]*Session, error)
+	// IncrFails counts a sign-in failure, the count restarts once window passed since the first one
+	IncrFails(ctx context.Context, identify string, window time.Duration) (int, error)
+	ResetFails(ctx context.Context, identify string) error
+	Lock(ctx context.Context, identify string, until time.Time) error
+	LockedUntil(ctx context.Context, identify string) (time.Time, bool, error)
+	Unlock(ctx context.Context, identify string) error
+	// Purge drops expired records, stores with native expiry do nothing
+	Purge(ctx context.Context) error
+	Close() error
+}
+
+// NewSessionStore creates the store selected by the session config
+func NewSessionStore(cfg *conf.SessionConfig, dbms *db.DB) (SessionStore, error) {
+	switch cfg.Store {
+	case "sql":
+		return NewSqlSessionStore(dbms), nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     cfg.RedisAddr,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDb,
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := client.Ping(ctx).Err(); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+		return NewRedisSessionStore(client, cfg.RedisPrefix), nil
+	}
+	return NewMemorySessionStore(), nil
+}
+
+type memoryCounter struct {
+	count int
+	exp   time.Time
+}
+
+// MemorySessionStore keeps everything in process, it only suits a single instance
+type MemorySessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]Session
+	fails    map[string]memoryCounter
+	locks    map[string]time.Time
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: map[string]Session{},
+		fails:    map[string]memoryCounter{},
+		locks:    map[string]time.Time{},
+	}
+}
+
+func (m *MemorySessionStore) SaveSession(_ context.Context, session *Session) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sessions[session.Id] = *session
+	return nil
+}
+
+func (m *MemorySessionStore) SwapSession(_ context.Context, session *Session) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stored, ok := m.sessions[session.Id]
+	if !ok || time.Now().After(stored.Exp) || stored.Version != session.Version {
+		return false, nil
+	}
+	session.Version++
+	m.sessions[session.Id] = *session
+	return true, nil
+}
+
+func (m *MemorySessionStore) GetSession(_ context.Context, id string) (*Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	session, ok := m.sessions[id]
+	if !ok || time.Now().After(session.Exp) {
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (m *MemorySessionStore) DeleteSession(_ context.Context, id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MemorySessionStore) Sessions(_ context.Context, principal string) ([]*Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	sessions := make([]*Session, 0)
+	for _, session := range m.sessions {
+		if now.Before(session.Exp) && (principal == "" || session.Principal == principal) {
+			session := session
+			sessions = append(sessions, &session)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *MemorySessionStore) IncrFails(_ context.Context, identify string, window time.Duration) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	counter, ok := m.fails[identify]
+	if !ok || now.After(counter.exp) {
+		counter = memoryCounter{exp: now.Add(window)}
+	}
+	counter.count++
+	m.fails[identify] = counter
+	return counter.count, nil
+}
+
+func (m *MemorySessionStore) ResetFails(_ context.Context, identify string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.fails, identify)
+	return nil
+}
+
+func (m *MemorySessionStore) Lock(_ context.Context, identify string, until time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.locks[identify] = until
+	return nil
+}
+
+func (m *MemorySessionStore) LockedUntil(_ context.Context, identify string) (time.Time, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	until, ok := m.locks[identify]
+	if !ok || time.Now().After(until) {
+		return time.Time{}, false, nil
+	}
+	return until, true, nil
+}
+
+func (m *MemorySessionStore) Unlock(_ context.Context, identify string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.locks, identify)
+	return nil
+}
+
+func (m *MemorySessionStore) Purge(context.Context) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	for k, v := range m.sessions {
+		if now.After(v.Exp) {
+			delete(m.sessions, k)
+		}
+	}
+	for k, v := range m.fails {
+		if now.After(v.exp) {
+			delete(m.fails, k)
+		}
+	}
+	for k, v := range m.locks {
+		if now.After(v) {
+			delete(m.locks, k)
+		}
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) Close() error {
+	return nil
+}
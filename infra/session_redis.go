@@ -0,0 +1,217 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisSessionStore keeps the sessions as json strings expiring with the token, each
+// principal has a set indexing its session ids
+type RedisSessionStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func NewRedisSessionStore(client redis.UniversalClient, prefix string) *RedisSessionStore {
+	return &RedisSessionStore{client: client, prefix: prefix}
+}
+
+func (r *RedisSessionStore) sessionKey(id string) string {
+	return r.prefix + "session:" + id
+}
+
+func (r *RedisSessionStore) userKey(principal string) string {
+	return r.prefix + "user:" + principal
+}
+
+func (r *RedisSessionStore) SaveSession(ctx context.Context, session *Session) error {
+	ttl := time.Until(session.Exp)
+	if ttl <= 0 {
+		return r.DeleteSession(ctx, session.Id)
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.sessionKey(session.Id), data, ttl)
+		pipe.SAdd(ctx, r.userKey(session.Principal), session.Id)
+		pipe.Expire(ctx, r.userKey(session.Principal), ttl)
+		return nil
+	})
+	return err
+}
+
+// SwapSession watches the session key, a write of another client in between aborts the transaction
+func (r *RedisSessionStore) SwapSession(ctx context.Context, session *Session) (bool, error) {
+	ttl := time.Until(session.Exp)
+	if ttl <= 0 {
+		return false, nil
+	}
+	key, version := r.sessionKey(session.Id), session.Version
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return redis.TxFailedErr
+		}
+		if err != nil {
+			return err
+		}
+		var stored Session
+		if err = json.Unmarshal(data, &stored); err != nil {
+			return err
+		}
+		if stored.Version != version {
+			return redis.TxFailedErr
+		}
+		session.Version = version + 1
+		if data, err = json.Marshal(session); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, ttl)
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		session.Version = version
+	}
+	if errors.Is(err, redis.TxFailedErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *RedisSessionStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	data, err := r.client.Get(ctx, r.sessionKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session Session
+	if err = json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (r *RedisSessionStore) DeleteSession(ctx context.Context, id string) error {
+	session, err := r.GetSession(ctx, id)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.sessionKey(id))
+		pipe.SRem(ctx, r.userKey(session.Principal), id)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisSessionStore) Sessions(ctx context.Context, principal string) ([]*Session, error) {
+	var keys []string
+	if principal != "" {
+		ids, err := r.client.SMembers(ctx, r.userKey(principal)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			keys = append(keys, r.sessionKey(id))
+		}
+	} else {
+		iter := r.client.Scan(ctx, 0, r.sessionKey("*"), 100).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sessions := make([]*Session, 0, len(keys))
+	if len(keys) == 0 {
+		return sessions, nil
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var stale []any
+	for i, value := range values {
+		data, ok := value.(string)
+		var session Session
+		if !ok || json.Unmarshal([]byte(data), &session) != nil {
+			stale = append(stale, keys[i][len(r.sessionKey("")):])
+			continue
+		}
+		sessions = append(sessions, &session)
+	}
+	// ids of expired sessions linger in the index until the index itself expires
+	if principal != "" && len(stale) > 0 {
+		r.client.SRem(ctx, r.userKey(principal), stale...)
+	}
+	return sessions, nil
+}
+
+func (r *RedisSessionStore) IncrFails(ctx context.Context, identify string, window time.Duration) (int, error) {
+	key := r.prefix + failKeyPrefix + identify
+	count, err := r.client.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		if err = r.client.Expire(ctx, key, window).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return int(count), nil
+}
+
+func (r *RedisSessionStore) ResetFails(ctx context.Context, identify string) error {
+	return r.client.Del(ctx, r.prefix+failKeyPrefix+identify).Err()
+}
+
+func (r *RedisSessionStore) Lock(ctx context.Context, identify string, until time.Time) error {
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		return r.Unlock(ctx, identify)
+	}
+	return r.client.Set(ctx, r.prefix+lockKeyPrefix+identify, until.UnixMilli(), ttl).Err()
+}
+
+func (r *RedisSessionStore) LockedUntil(ctx context.Context, identify string) (time.Time, bool, error) {
+	value, err := r.client.Get(ctx, r.prefix+lockKeyPrefix+identify).Result()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.UnixMilli(millis), true, nil
+}
+
+func (r *RedisSessionStore) Unlock(ctx context.Context, identify string) error {
+	return r.client.Del(ctx, r.prefix+lockKeyPrefix+identify).Err()
+}
+
+func (r *RedisSessionStore) Purge(context.Context) error {
+	return nil
+}
+
+func (r *RedisSessionStore) Close() error {
+	return r.client.Close()
+}
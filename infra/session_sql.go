@@ -0,0 +1,129 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"golang-ast/db"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	failKeyPrefix = "fail:"
+	lockKeyPrefix = "lock:"
+)
+
+// SqlSessionStore keeps the sessions in the sys_session table and the failures and
+// locks in sys_auth_counter of the application database
+type SqlSessionStore struct {
+	db *db.DB
+}
+
+func NewSqlSessionStore(dbms *db.DB) *SqlSessionStore {
+	return &SqlSessionStore{db: dbms}
+}
+
+func (s *SqlSessionStore) SaveSession(_ context.Context, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return s.db.SaveSession(&db.SysSession{
+		Id:        session.Id,
+		Principal: session.Principal,
+		Data:      string(data),
+		Exp:       session.Exp,
+		Version:   session.Version,
+	})
+}
+
+func (s *SqlSessionStore) SwapSession(_ context.Context, session *Session) (bool, error) {
+	version := session.Version
+	session.Version++
+	data, err := json.Marshal(session)
+	if err != nil {
+		session.Version = version
+		return false, err
+	}
+	swapped, err := s.db.SwapSession(&db.SysSession{
+		Id:      session.Id,
+		Data:    string(data),
+		Exp:     session.Exp,
+		Version: session.Version,
+	}, version)
+	if !swapped {
+		session.Version = version
+	}
+	return swapped, err
+}
+
+func (s *SqlSessionStore) GetSession(_ context.Context, id string) (*Session, error) {
+	row, err := s.db.GetSession(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session Session
+	if err = json.Unmarshal([]byte(row.Data), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *SqlSessionStore) DeleteSession(_ context.Context, id string) error {
+	return s.db.DeleteSession(id)
+}
+
+func (s *SqlSessionStore) Sessions(_ context.Context, principal string) ([]*Session, error) {
+	rows, err := s.db.GetSessions(principal)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*Session, 0, len(rows))
+	for _, row := range rows {
+		var session Session
+		if json.Unmarshal([]byte(row.Data), &session) == nil {
+			sessions = append(sessions, &session)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *SqlSessionStore) IncrFails(_ context.Context, identify string, window time.Duration) (int, error) {
+	return s.db.IncrCounter(failKeyPrefix+identify, window)
+}
+
+func (s *SqlSessionStore) ResetFails(_ context.Context, identify string) error {
+	return s.db.DeleteCounter(failKeyPrefix + identify)
+}
+
+func (s *SqlSessionStore) Lock(_ context.Context, identify string, until time.Time) error {
+	return s.db.SetCounter(lockKeyPrefix+identify, 0, until)
+}
+
+func (s *SqlSessionStore) LockedUntil(_ context.Context, identify string) (time.Time, bool, error) {
+	counter, err := s.db.GetCounter(lockKeyPrefix + identify)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return counter.Exp, true, nil
+}
+
+func (s *SqlSessionStore) Unlock(_ context.Context, identify string) error {
+	return s.db.DeleteCounter(lockKeyPrefix + identify)
+}
+
+func (s *SqlSessionStore) Purge(context.Context) error {
+	return s.db.PurgeExpired()
+}
+
+func (s *SqlSessionStore) Close() error {
+	return nil
+}
@@ -0,0 +1,211 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"golang-ast/db"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, NewMemorySessionStore())
+}
+
+// testDB migrates a fresh sqlite database in the temp dir of the test
+func testDB(t *testing.T) *db.DB {
+	t.Helper()
+	orm, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "admin.db")), &gorm.Config{
+		DisableForeignKeyConstraintWhenMigrating: true,
+		Logger:                                   logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	dbms, err := db.New(orm, zap.NewNop())
+	if err != nil {
+		t.Fatalf("migrate sqlite: %v", err)
+	}
+	return dbms
+}
+
+func TestSqlSessionStore(t *testing.T) {
+	testSessionStore(t, NewSqlSessionStore(testDB(t)))
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	testSessionStore(t, NewRedisSessionStore(redis.NewClient(&redis.Options{Addr: server.Addr()}), "admin:"))
+}
+
+// testSessionStore checks the behaviour every SessionStore implementation has to share
+func testSessionStore(t *testing.T, store SessionStore) {
+	ctx := context.Background()
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	now := time.Now()
+	session := func(id, principal string, exp time.Time) *Session {
+		return &Session{
+			Id:          id,
+			Uid:         "uid-" + principal,
+			Principal:   principal,
+			Roles:       []string{"ADMIN"},
+			Authorities: []string{"USER_ADD"},
+			Ip:          "10.0.0.1",
+			Ct:          now,
+			Seen:        now,
+			Exp:         exp,
+		}
+	}
+
+	t.Run("sessions", func(t *testing.T) {
+		for _, s := range []*Session{
+			session("s1", "alice", now.Add(time.Hour)),
+			session("s2", "alice", now.Add(time.Hour)),
+			session("s3", "bob", now.Add(time.Hour)),
+			session("s4", "alice", now.Add(-time.Minute)),
+		} {
+			if err := store.SaveSession(ctx, s); err != nil {
+				t.Fatalf("SaveSession(%v) error = %v", s.Id, err)
+			}
+		}
+		got, err := store.GetSession(ctx, "s1")
+		if err != nil {
+			t.Fatalf("GetSession() error = %v", err)
+		}
+		if got.Principal != "alice" || got.Uid != "uid-alice" || len(got.Authorities) != 1 || !got.Exp.Equal(now.Add(time.Hour)) {
+			t.Errorf("GetSession() = %+v", got)
+		}
+		if _, err = store.GetSession(ctx, "s4"); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("GetSession(expired) error = %v, want ErrSessionNotFound", err)
+		}
+		if _, err = store.GetSession(ctx, "missing"); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("GetSession(missing) error = %v, want ErrSessionNotFound", err)
+		}
+
+		assertSessionIds(t, store, "alice", "s1", "s2")
+		assertSessionIds(t, store, "", "s1", "s2", "s3")
+
+		// a session saved again keeps its id and replaces the previous state
+		got.Authorities = nil
+		if err = store.SaveSession(ctx, got); err != nil {
+			t.Fatalf("SaveSession() error = %v", err)
+		}
+		if got, err = store.GetSession(ctx, "s1"); err != nil || got.Authorities != nil {
+			t.Errorf("GetSession() after save = %+v, %v", got, err)
+		}
+
+		if err = store.DeleteSession(ctx, "s1"); err != nil {
+			t.Fatalf("DeleteSession() error = %v", err)
+		}
+		if _, err = store.GetSession(ctx, "s1"); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("GetSession(deleted) error = %v, want ErrSessionNotFound", err)
+		}
+		assertSessionIds(t, store, "alice", "s2")
+		if err = store.Purge(ctx); err != nil {
+			t.Errorf("Purge() error = %v", err)
+		}
+		assertSessionIds(t, store, "", "s2", "s3")
+	})
+
+	t.Run("swap", func(t *testing.T) {
+		if err := store.SaveSession(ctx, session("w1", "carol", now.Add(time.Hour))); err != nil {
+			t.Fatalf("SaveSession() error = %v", err)
+		}
+		first, _ := store.GetSession(ctx, "w1")
+		second, _ := store.GetSession(ctx, "w1")
+		first.RefreshHash = "first"
+		if swapped, err := store.SwapSession(ctx, first); err != nil || !swapped || first.Version != 1 {
+			t.Fatalf("SwapSession() = %v, %v, version %v", swapped, err, first.Version)
+		}
+		// the second writer read the session before the first one swapped it
+		second.RefreshHash = "second"
+		if swapped, err := store.SwapSession(ctx, second); err != nil || swapped || second.Version != 0 {
+			t.Errorf("SwapSession(stale) = %v, %v, version %v", swapped, err, second.Version)
+		}
+		if got, err := store.GetSession(ctx, "w1"); err != nil || got.RefreshHash != "first" || got.Version != 1 {
+			t.Errorf("GetSession() after swap = %+v, %v", got, err)
+		}
+		missing := session("w2", "carol", now.Add(time.Hour))
+		if swapped, err := store.SwapSession(ctx, missing); err != nil || swapped {
+			t.Errorf("SwapSession(missing) = %v, %v", swapped, err)
+		}
+	})
+
+	t.Run("fails", func(t *testing.T) {
+		for want := 1; want <= 3; want++ {
+			count, err := store.IncrFails(ctx, "alice", time.Hour)
+			if err != nil || count != want {
+				t.Fatalf("IncrFails() = %v, %v, want %v", count, err, want)
+			}
+		}
+		if count, err := store.IncrFails(ctx, "bob", time.Hour); err != nil || count != 1 {
+			t.Errorf("IncrFails(other) = %v, %v, want 1", count, err)
+		}
+		if err := store.ResetFails(ctx, "alice"); err != nil {
+			t.Fatalf("ResetFails() error = %v", err)
+		}
+		if count, err := store.IncrFails(ctx, "alice", time.Hour); err != nil || count != 1 {
+			t.Errorf("IncrFails() after reset = %v, %v, want 1", count, err)
+		}
+	})
+
+	t.Run("locks", func(t *testing.T) {
+		if _, locked, err := store.LockedUntil(ctx, "alice"); err != nil || locked {
+			t.Errorf("LockedUntil(unlocked) = %v, %v", locked, err)
+		}
+		until := now.Add(time.Hour)
+		if err := store.Lock(ctx, "alice", until); err != nil {
+			t.Fatalf("Lock() error = %v", err)
+		}
+		got, locked, err := store.LockedUntil(ctx, "alice")
+		if err != nil || !locked || got.Sub(until).Abs() > time.Second {
+			t.Errorf("LockedUntil() = %v, %v, %v, want %v", got, locked, err, until)
+		}
+		if err = store.Lock(ctx, "bob", now.Add(-time.Minute)); err != nil {
+			t.Fatalf("Lock(past) error = %v", err)
+		}
+		if _, locked, err = store.LockedUntil(ctx, "bob"); err != nil || locked {
+			t.Errorf("LockedUntil(past lock) = %v, %v", locked, err)
+		}
+		if err = store.Unlock(ctx, "alice"); err != nil {
+			t.Fatalf("Unlock() error = %v", err)
+		}
+		if _, locked, err = store.LockedUntil(ctx, "alice"); err != nil || locked {
+			t.Errorf("LockedUntil(unlocked) = %v, %v", locked, err)
+		}
+	})
+}
+
+func assertSessionIds(t *testing.T, store SessionStore, principal string, want ...string) {
+	t.Helper()
+	sessions, err := store.Sessions(context.Background(), principal)
+	if err != nil {
+		t.Fatalf("Sessions(%q) error = %v", principal, err)
+	}
+	ids := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		ids = append(ids, s.Id)
+	}
+	sort.Strings(ids)
+	if len(ids) != len(want) {
+		t.Errorf("Sessions(%q) = %v, want %v", principal, ids, want)
+		return
+	}
+	for i := range ids {
+		if ids[i] != want[i] {
+			t.Errorf("Sessions(%q) = %v, want %v", principal, ids, want)
+			return
+		}
+	}
+}
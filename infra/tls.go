@@ -0,0 +1,185 @@
+package infra
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"golang-ast/conf"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"request":         tls.RequestClientCert,
+	"verify_if_given": tls.VerifyClientCertIfGiven,
+	"require":         tls.RequireAndVerifyClientCert,
+}
+
+// CertReloader serves the listener certificate and client CA pool from disk and swaps
+// them when the files change, so rotations don't need a restart
+type CertReloader struct {
+	cfg     *conf.AppConfig
+	log     *zap.Logger
+	cert    atomic.Pointer[tls.Certificate]
+	pool    atomic.Pointer[x509.CertPool]
+	watcher *fsnotify.Watcher
+	quit    chan struct{}
+	once    sync.Once
+}
+
+func NewCertReloader(cfg *conf.AppConfig, log *zap.Logger) (*CertReloader, error) {
+	r := &CertReloader{
+		cfg:  cfg,
+		log:  log,
+		quit: make(chan struct{}),
+	}
+	// resolved before loading, so a swap racing the first load still triggers a reload
+	resolved := r.resolve()
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]bool{}
+	for _, file := range r.files() {
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return nil, err
+		}
+	}
+	r.watcher = watcher
+	go r.watch(resolved)
+	return r, nil
+}
+
+// TLSConfig builds a TLS 1.2+ server config resolving the certificate and client CAs per handshake
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: r.getCertificate,
+			}
+			if pool := r.pool.Load(); pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = clientAuthTypes[r.cfg.ClientAuth]
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// Close stops watching the certificate files, it is safe to call more than once
+func (r *CertReloader) Close() {
+	r.once.Do(func() {
+		close(r.quit)
+	})
+}
+
+func (r *CertReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+func (r *CertReloader) files() []string {
+	files := []string{r.cfg.TlsCert, r.cfg.TlsKey}
+	if r.cfg.ClientCa != "" {
+		files = append(files, r.cfg.ClientCa)
+	}
+	for i, file := range files {
+		if abs, err := filepath.Abs(file); err == nil {
+			files[i] = abs
+		}
+	}
+	return files
+}
+
+func (r *CertReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.cfg.TlsCert, r.cfg.TlsKey)
+	if err != nil {
+		return err
+	}
+	if r.cfg.ClientCa != "" {
+		caBytes, errCa := os.ReadFile(r.cfg.ClientCa)
+		if errCa != nil {
+			return errCa
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return errors.New("no certificate found in " + r.cfg.ClientCa)
+		}
+		r.pool.Store(pool)
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+// resolve follows the symlinks of every watched file, Kubernetes mounts secrets as links
+// through a ..data directory link that is swapped atomically on update
+func (r *CertReloader) resolve() map[string]string {
+	resolved := map[string]string{}
+	for _, file := range r.files() {
+		if real, err := filepath.EvalSymlinks(file); err == nil {
+			resolved[file] = real
+		}
+	}
+	return resolved
+}
+
+func (r *CertReloader) watch(resolved map[string]string) {
+	defer r.watcher.Close()
+	targets := map[string]bool{}
+	for _, file := range r.files() {
+		targets[file] = true
+	}
+	// cert and key are usually replaced together, wait for both before reloading
+	debounce := time.NewTimer(time.Second)
+	debounce.Stop()
+	defer debounce.Stop()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if targets[filepath.Clean(event.Name)] {
+				debounce.Reset(time.Second)
+				continue
+			}
+			// the target names never change on a symlink swap, only where they point to
+			if current := r.resolve(); !reflect.DeepEqual(current, resolved) {
+				resolved = current
+				debounce.Reset(time.Second)
+			}
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			r.log.Error("watch() certificate watcher error", zap.Error(err))
+		case <-debounce.C:
+			if err := r.reload(); err != nil {
+				r.log.Error("watch().reload() keep serving the previous certificate", zap.Error(err))
+				continue
+			}
+			r.log.Info("certificate reloaded", zap.String("cert", r.cfg.TlsCert))
+		}
+	}
+}
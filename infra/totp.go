@@ -0,0 +1,106 @@
+package infra
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew also accepts the codes of the neighbouring time steps for clock drift
+	totpSkew       = 1
+	totpSecretSize = 20
+	// recoveryCodeSize is the number of base32 characters of a recovery code, 50 bits
+	recoveryCodeSize = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTotpSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode is the HOTP value of RFC 4226 with the time step of RFC 6238 as counter
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	code := strconv.FormatUint(uint64(value), 10)
+	if len(code) > totpDigits {
+		code = code[len(code)-totpDigits:]
+	}
+	return strings.Repeat("0", totpDigits-len(code)) + code
+}
+
+// matchTotp returns the time step a code of the base32 secret belongs to
+func matchTotp(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth uri authenticator apps enroll a secret from
+func totpURI(issuer, account, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + query.Encode()
+}
+
+// newRecoveryCodes returns the codes handed to the user and the digests to store
+func newRecoveryCodes(count int) ([]string, []string, error) {
+	codes, hashes := make([]string, 0, count), make([]string, 0, count)
+	raw := make([]byte, totpSecretSize)
+	for i := 0; i < count; i++ {
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw)[:recoveryCodeSize])
+		codes = append(codes, fmt.Sprintf("%s-%s", code[:recoveryCodeSize/2], code[recoveryCodeSize/2:]))
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode digests a recovery code however it was typed, the codes are random
+// enough for a plain sha256
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
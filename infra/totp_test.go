@@ -0,0 +1,106 @@
+package infra
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the sha1 key of the test vectors in appendix B of RFC 6238
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTotpCode(t *testing.T) {
+	// the vectors are 8 digits, a 6 digit code is their last 6
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1111111111, code: "050471"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+		{unix: 20000000000, code: "353130"},
+	}
+	for _, tt := range tests {
+		at := time.Unix(tt.unix, 0)
+		if got := totpCode([]byte("12345678901234567890"), totpStep(at)); got != tt.code {
+			t.Errorf("totpCode(%v) = %v, want %v", tt.unix, got, tt.code)
+		}
+		step, ok := matchTotp(rfc6238Secret, tt.code, at)
+		if !ok || step != totpStep(at) {
+			t.Errorf("matchTotp(%v) = %v, %v, want step %v", tt.unix, step, ok, totpStep(at))
+		}
+	}
+}
+
+func TestMatchTotp(t *testing.T) {
+	// the code of 1111111109 is of step 37037036
+	at := time.Unix(1111111109, 0)
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		now    time.Time
+		step   int64
+		ok     bool
+	}{
+		{name: "current step", secret: rfc6238Secret, code: "081804", now: at, step: 37037036, ok: true},
+		{name: "clock behind", secret: rfc6238Secret, code: "081804", now: at.Add(-totpPeriod * time.Second), step: 37037036, ok: true},
+		{name: "clock ahead", secret: rfc6238Secret, code: "081804", now: at.Add(totpPeriod * time.Second), step: 37037036, ok: true},
+		{name: "beyond the skew", secret: rfc6238Secret, code: "081804", now: at.Add(2 * totpPeriod * time.Second)},
+		{name: "wrong code", secret: rfc6238Secret, code: "081805", now: at},
+		{name: "8 digits", secret: rfc6238Secret, code: "07081804", now: at},
+		{name: "bad secret", secret: "not base32!", code: "081804", now: at},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := matchTotp(tt.secret, tt.code, tt.now)
+			if ok != tt.ok || step != tt.step {
+				t.Errorf("matchTotp() = %v, %v, want %v, %v", step, ok, tt.step, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTotpURI(t *testing.T) {
+	uri, err := url.Parse(totpURI("Admin Console", "alice@example.com", rfc6238Secret))
+	if err != nil {
+		t.Fatalf("url.Parse() error = %v", err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Admin Console:alice@example.com" {
+		t.Errorf("totpURI() = %v, want otpauth://totp/<issuer>:<account>", uri)
+	}
+	query := uri.Query()
+	for key, want := range map[string]string{
+		"secret": rfc6238Secret, "issuer": "Admin Console", "algorithm": "SHA1", "digits": "6", "period": "30",
+	} {
+		if got := query.Get(key); got != want {
+			t.Errorf("totpURI() %v = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("newRecoveryCodes() error = %v", err)
+	}
+	if len(codes) != 10 || len(hashes) != 10 {
+		t.Fatalf("newRecoveryCodes() = %v codes, %v hashes, want 10", len(codes), len(hashes))
+	}
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if len(code) != recoveryCodeSize+1 || code[recoveryCodeSize/2] != '-' || seen[code] {
+			t.Errorf("recovery code %q, want unique xxxxx-xxxxx", code)
+		}
+		seen[code] = true
+		// codes are accepted however they are typed
+		for _, typed := range []string{code, strings.ToUpper(code), strings.ReplaceAll(code, "-", ""), " " + strings.ReplaceAll(code, "-", " ")} {
+			if got := hashRecoveryCode(typed); got != hashes[i] {
+				t.Errorf("hashRecoveryCode(%q) = %v, want %v", typed, got, hashes[i])
+			}
+		}
+	}
+}
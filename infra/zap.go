@@ -10,18 +10,25 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+// logLevel is shared by every core of the logger so it can change at runtime
+var logLevel = zap.NewAtomicLevel()
+
 func InitLogger(cfg *conf.LogConfig) *zap.Logger {
 	writeSyncer := getLogWriter(cfg.Filename, cfg.MaxSize, cfg.MaxBackups, cfg.MaxAge)
 	encoder := getEncoder()
-	var l = new(zapcore.Level)
-	_ = l.UnmarshalText([]byte(cfg.Level))
-	core := zapcore.NewCore(encoder, writeSyncer, l)
-	coreConsole := zapcore.NewCore(encoder, zapcore.AddSync(os.Stdout), l)
+	_ = SetLogLevel(cfg.Level)
+	core := zapcore.NewCore(encoder, writeSyncer, logLevel)
+	coreConsole := zapcore.NewCore(encoder, zapcore.AddSync(os.Stdout), logLevel)
 	logger := zap.New(zapcore.NewTee(core, coreConsole), zap.AddCaller())
 	zap.ReplaceGlobals(logger) // 替换zap包中全局的logger实例，后续在其他包中只需使用zap.L()调用即可
 	return logger
 }
 
+// SetLogLevel changes the level of the logger created by InitLogger
+func SetLogLevel(level string) error {
+	return logLevel.UnmarshalText([]byte(level))
+}
+
 func getEncoder() zapcore.Encoder {
 	config := zapcore.EncoderConfig{
 		MessageKey:     "message",
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"golang-ast/conf"
 	"golang-ast/db"
@@ -18,19 +18,31 @@ import (
 
 var cfgFile string
 
+// flagOverrides maps the command line flags overriding common config keys to their yaml path,
+// secrets such as app.db_conn have no flag since the command line is visible to every user
+var flagOverrides = map[string]string{
+	"http-addr": "app.http_addr",
+	"log-level": "log.level",
+}
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "storm-admin-server",
 	Short: "Storm Admin Server",
-	Long:  `Storm Admin Server.`,
-	// Uncomment the following line if your bare application
-	// has an action associated with it:
+	Long: `Storm Admin Server.
+
+Configuration is read from --config, then overridden by ADMIN_* environment variables
+named after the upper-cased yaml path (app.http_addr -> ADMIN_APP_HTTP_ADDR),
+then by command line flags.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		confFile, err := cmd.Flags().GetString("config")
-		if err != nil {
-			return
+		var overrides []conf.Override
+		for flag, key := range flagOverrides {
+			if cmd.Flags().Changed(flag) {
+				value, _ := cmd.Flags().GetString(flag)
+				overrides = append(overrides, conf.Override{Key: key, Value: value, Flag: flag})
+			}
 		}
-		start(confFile)
+		start(cfgFile, overrides)
 	},
 }
 
@@ -41,43 +53,25 @@ func Execute() {
 }
 
 func init() {
-	cobra.OnInitialize(initConfig)
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "conf/conf.yml", "config file (default is conf/conf.yml)")
-	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
-}
-
-// initConfig reads in config file and ENV variables if set.
-func initConfig() {
-	if cfgFile != "" {
-		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
-	} else {
-		// Find home directory.
-		home, err := os.Getwd()
-		cobra.CheckErr(err)
-		// Search config in home directory with name ".gin-test" (without extension).
-		viper.AddConfigPath(home)
-		viper.SetConfigName("conf")
-	}
-
-	viper.AutomaticEnv() // read in environment variables that match
-
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		_, _ = fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
-	}
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "conf/conf.yml", "config file")
+	rootCmd.Flags().String("http-addr", "", "override app.http_addr")
+	rootCmd.Flags().String("log-level", "", "override log.level")
 }
 
 var app *server.AdminServer
 
-func start(confFile string) {
-	confIns, err := conf.InitConf(confFile, func(config interface{}) {
+func start(confFile string, overrides []conf.Override) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	confIns, err := conf.InitConf(ctx, confFile, overrides, func(config interface{}) {
 	})
 	if err != nil {
 		fmt.Printf("init conf failed, err:%v\n", err)
 		return
 	}
+	defer confIns.Hot().Close()
 	logger := infra.InitLogger(confIns.LogCfg)
+	go followConfig(confIns, logger)
 	dbms, err := db.Init(confIns, logger)
 	if err != nil {
 		logger.Error("db init failed, err", zap.Error(err))
@@ -93,7 +87,20 @@ func start(confFile string) {
 	handleProcessSignal(logger)
 }
 
-var signChan = make(chan os.Signal)
+// followConfig applies the keys that take effect without a restart from every reloaded
+// snapshot, until the config watcher stops
+func followConfig(cfg *conf.GConfig, log *zap.Logger) {
+	for snapshot := range cfg.Hot().Changes() {
+		level := snapshot.(*conf.GConfig).LogCfg.Level
+		if err := infra.SetLogLevel(level); err != nil {
+			log.Error("followConfig().SetLogLevel error", zap.String("level", level), zap.Error(err))
+			continue
+		}
+		log.Info("config reloaded", zap.String("log.level", level))
+	}
+}
+
+var signChan = make(chan os.Signal, 1)
 
 func handleProcessSignal(log *zap.Logger) {
 	var sig os.Signal
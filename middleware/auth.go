@@ -1,50 +1,65 @@
 package middleware
 
 import (
+	"errors"
 	"golang-ast/infra"
 	"net/http"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
 )
 
-var signInPath = "/api/auth/sign"
+const apiKeyHeader = "X-API-Key"
+
 var signOutPath = "/api/auth/logout"
 
-func NewAuthFilter() fiber.Handler {
+// scopePaths are the only paths a scoped token of an unfinished sign-in is accepted on
+var scopePaths = map[string][]string{
+	infra.ScopePasswordChange: {"/api/users/pwd/edit"},
+	infra.ScopeMfa:            {"/api/mfa/verify"},
+	infra.ScopeMfaSetup:       {"/api/mfa/enroll", "/api/mfa/confirm"},
+}
+
+func NewAuthFilter(log *zap.Logger) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		authHandler := infra.GetAuthHandler()
 		match, permit, _ := authHandler.TrieSearch(c.Path())
+		apiKey, isKey := extractApiKey(c)
 		tokenStr, ok := extractToken(c)
 		if match && permit == "*" || !match {
-			// block dup login
-			if c.Path() == signInPath && ok {
-				claimUser, err := authHandler.ParseToken(tokenStr)
-				if err == nil && authHandler.IsAlreadyLogin(claimUser.Name) {
-					return infra.OkWithMessage("already login", c)
-				}
-			}
 			// handle logout
 			if c.Path() == signOutPath && ok {
 				claimUser, err := authHandler.ParseToken(tokenStr)
-				if err == nil && authHandler.IsAlreadyLogin(claimUser.Name) {
+				if err == nil {
 					return authHandler.OnSignOutHandler(claimUser, c)
 				}
 			}
 			// request continue when url don't need token
 			return c.Next()
 		}
+		if isKey {
+			authentication, err := authHandler.AuthenticateApiKey(apiKey, c.IP())
+			if errors.Is(err, infra.ErrApiKeyInvalid) || errors.Is(err, infra.ErrApiKeyAddress) {
+				return infra.FailWithMessage(http.StatusUnauthorized, err.Error(), c)
+			}
+			if err != nil {
+				log.Error("AuthFilter().AuthenticateApiKey error", zap.Error(err))
+				return infra.Fail(http.StatusInternalServerError, c)
+			}
+			return authorize(c, authentication, permit)
+		}
 		if ok {
 			claim, err := authHandler.ParseToken(tokenStr)
 			if err != nil {
-				// token expire renewal
-				if err == infra.ErrTokenExpired {
+				// token expire renewal, in refresh mode clients renew through /api/auth/refresh
+				if err == infra.ErrTokenExpired && !authHandler.RefreshEnabled() {
 					tokenNew, errTk := authHandler.RefreshToken(tokenStr)
 					if errTk != nil {
 						return infra.FailWithMessage(http.StatusUnauthorized, errTk.Error(), c)
 					}
 					claim, errTk = authHandler.ParseToken(tokenNew)
-					if err != nil {
+					if errTk != nil {
 						return infra.FailWithMessage(http.StatusUnauthorized, errTk.Error(), c)
 					}
 					c.Set("Authorization", "Bearer "+tokenNew)
@@ -54,35 +69,70 @@ func NewAuthFilter() fiber.Handler {
 					return infra.FailWithMessage(http.StatusUnauthorized, err.Error(), c)
 				}
 			}
+			// reject signed out and revoked tokens
+			revoked, err := authHandler.IsRevoked(claim)
+			if err != nil {
+				log.Error("AuthFilter().IsRevoked error", zap.Error(err))
+				return infra.Fail(http.StatusInternalServerError, c)
+			}
+			if revoked {
+				return infra.FailWithMessage(http.StatusUnauthorized, infra.ErrTokenRevoked.Error(), c)
+			}
+			// a scoped token only takes the next step of its sign-in, whatever the permits
+			scoped := claim.Scope != ""
+			if scoped && !scopeAllows(claim.Scope, c.Path()) {
+				return infra.FailWithMessage(http.StatusForbidden, "sign-in incomplete: "+claim.Scope, c)
+			}
 			// get user authentication
 			authentication, err := authHandler.GetAuthentication(claim)
 			if err != nil {
 				return infra.FailWithMessage(http.StatusUnauthorized, err.Error(), c)
 			}
 
-			// request continue when url don't need permit
-			if permit == "any" && match {
-				// prepare user auth context
-				if authentication != nil {
-					c.Locals("auth", authentication)
-				}
-				return c.Next()
-			}
-			// check user permit
-			if !authentication.Authorities().Contains(permit) {
-				return infra.FailWithMessage(http.StatusForbidden, "not authorized", c)
-			}
-			// prepare user auth context
-			if authentication != nil {
+			// a scoped token skips the permits of its paths
+			if scoped {
 				c.Locals("auth", authentication)
+				return c.Next()
 			}
-			return c.Next()
+			return authorize(c, authentication, permit)
 		}
 		// request block when url need token, but token not found in header
 		return infra.FailWithMessage(http.StatusUnauthorized, "not authorized", c)
 	}
 }
 
+// authorize checks the permit of the url and prepares the user auth context
+func authorize(c *fiber.Ctx, authentication *infra.Authentication, permit any) error {
+	// request continue when url don't need permit
+	if permit != "any" && !authentication.Authorities().Contains(permit) {
+		return infra.FailWithMessage(http.StatusForbidden, "not authorized", c)
+	}
+	c.Locals("auth", authentication)
+	return c.Next()
+}
+
+func scopeAllows(scope, path string) bool {
+	for _, allowed := range scopePaths[scope] {
+		if path == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// extractApiKey reads a personal access token from X-API-Key or a bearer token with its prefix
+func extractApiKey(req *fiber.Ctx) (string, bool) {
+	if key := req.Get(apiKeyHeader); key != "" {
+		return key, true
+	}
+	tokenHeader := req.Get("Authorization")
+	if len(tokenHeader) > 7 && strings.EqualFold(tokenHeader[:7], "bearer ") &&
+		strings.HasPrefix(tokenHeader[7:], infra.ApiKeyPrefix) {
+		return tokenHeader[7:], true
+	}
+	return "", false
+}
+
 func extractToken(req *fiber.Ctx) (string, bool) {
 	tokenHeader := req.Get("Authorization")
 	// The usual convention is for "Bearer" to be title-cased. However, there's no
@@ -16,7 +16,7 @@ func Use(server *fiber.App, logger *zap.Logger, authCfg *conf.AuthConfig) *zap.L
 	server.Use(rcp.New())
 	server.Use(cors.New(cors.Config{
 		AllowOrigins:     "*",
-		AllowHeaders:     "Authorization, Origin, X-Requested-With, Content-Type, Accept",
+		AllowHeaders:     "Authorization, X-API-Key, Origin, X-Requested-With, Content-Type, Accept",
 		AllowCredentials: true,
 	}))
 	server.Use(pprof.New())
@@ -29,7 +29,7 @@ func Use(server *fiber.App, logger *zap.Logger, authCfg *conf.AuthConfig) *zap.L
 		OpLogCfg: authCfg,
 	}))
 
-	server.Use(NewAuthFilter())
+	server.Use(NewAuthFilter(logger))
 	server.Get("/monitor", monitor.New())
 
 	return logger
@@ -3,6 +3,8 @@ package server
 import (
 	"crypto/tls"
 	_ "embed"
+	"errors"
+	"github.com/go-sql-driver/mysql"
 	"github.com/gofiber/fiber/v2"
 	jsoniter "github.com/json-iterator/go"
 	"go.uber.org/zap"
@@ -10,6 +12,10 @@ import (
 	"golang-ast/db"
 	"golang-ast/infra"
 	"golang-ast/middleware"
+	"gorm.io/gorm"
+	"net"
+	"net/http"
+	"path/filepath"
 )
 
 var json = jsoniter.Config{
@@ -19,11 +25,14 @@ var json = jsoniter.Config{
 }.Froze()
 
 type AdminServer struct {
-	app  *fiber.App
-	cfg  *conf.GConfig
-	auth *infra.Authorization
-	log  *zap.Logger
-	cert tls.Certificate
+	app       *fiber.App
+	cfg       *conf.GConfig
+	auth      *infra.Authorization
+	db        *db.DB
+	log       *zap.Logger
+	certs     *infra.CertReloader
+	redirect  *http.Server
+	providers *infra.Providers
 }
 
 func NewServer(conf *conf.GConfig, logger *zap.Logger, dbms *db.DB) (*AdminServer, error) {
@@ -35,29 +44,94 @@ func NewServer(conf *conf.GConfig, logger *zap.Logger, dbms *db.DB) (*AdminServe
 		JSONDecoder:       json.Unmarshal,
 	})
 	middleware.Use(engine, logger.Named("\u001B[33m[Engine]\u001B[0m"), conf.AuthCfg)
-	infra.NewAuthorization(conf.AuthCfg, dbms, logger.Named("[AUTH]"))
+	if err := infra.NewAuthorization(conf.AuthCfg, dbms, logger.Named("[AUTH]")); err != nil {
+		return nil, err
+	}
 
 	srv := &AdminServer{
-		app:  engine,
-		cfg:  conf,
-		auth: infra.GetAuthHandler(),
-		log:  logger.Named("\u001B[32m[Server]\u001B[0m"),
+		app:       engine,
+		cfg:       conf,
+		auth:      infra.GetAuthHandler(),
+		db:        dbms,
+		log:       logger.Named("\u001B[32m[Server]\u001B[0m"),
+		providers: infra.NewProviders(conf.AuthCfg),
+	}
+	// a certificate that can't be loaded fails the startup instead of the listener goroutine
+	if conf.AppCfg.TlsCert != "" {
+		certs, err := infra.NewCertReloader(conf.AppCfg, srv.log.Named("[TLS]"))
+		if err != nil {
+			srv.auth.Close()
+			return nil, err
+		}
+		srv.certs = certs
+		// built here so Close, called from another goroutine, sees it without a race
+		if conf.AppCfg.RedirectAddr != "" {
+			srv.redirect = srv.newRedirectServer()
+		}
 	}
+	engine.Static(avatarPath, filepath.Join(conf.AppCfg.UploadDir, avatarPath))
+	engine.Get(jwksPath, srv.JWKS)
 	root := engine.Group("/api")
 	srv.Register(root)
 	return srv, nil
 }
 
 func (srv *AdminServer) StartHttpServer() {
-	err := srv.app.Listen(srv.cfg.AppCfg.HttpAddr)
+	appCfg := srv.cfg.AppCfg
+	if srv.certs == nil {
+		err := srv.app.Listen(appCfg.HttpAddr)
+		if err != nil {
+			srv.log.Error("start admin server http err:", zap.Error(err))
+		}
+		return
+	}
+	ln, err := net.Listen("tcp", appCfg.HttpAddr)
 	if err != nil {
-		srv.log.Error("start admin server http err:", zap.Error(err))
+		srv.log.Error("start admin server https err:", zap.Error(err))
 		return
 	}
+	if srv.redirect != nil {
+		go srv.serveRedirect()
+	}
+	err = srv.app.Listener(tls.NewListener(ln, srv.certs.TLSConfig()))
+	if err != nil {
+		srv.log.Error("start admin server https err:", zap.Error(err))
+	}
+}
+
+// newRedirectServer answers plain HTTP on redirect_addr with a permanent redirect to HTTPS
+func (srv *AdminServer) newRedirectServer() *http.Server {
+	_, httpsPort, _ := net.SplitHostPort(srv.cfg.AppCfg.HttpAddr)
+	return &http.Server{
+		Addr: srv.cfg.AppCfg.RedirectAddr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = r.Host
+			}
+			if httpsPort != "443" {
+				host = net.JoinHostPort(host, httpsPort)
+			}
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+		}),
+	}
+}
+
+func (srv *AdminServer) serveRedirect() {
+	err := srv.redirect.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		srv.log.Error("start admin server redirect err:", zap.Error(err))
+	}
 }
 
 func (srv *AdminServer) Close() {
 	srv.auth.Close()
+	if srv.certs != nil {
+		srv.certs.Close()
+	}
+	if srv.redirect != nil {
+		_ = srv.redirect.Close()
+	}
 	err := srv.app.Shutdown()
 	if err != nil {
 		srv.log.Error("stop admin server err:", zap.Error(err))
@@ -71,3 +145,26 @@ type ErrorResponse struct {
 	Rule        string
 	ErrValue    interface{}
 }
+
+const mysqlDuplicateEntry = 1062
+
+// bodyInvalid answers 400 with the fields of the request body that failed a rule
+func bodyInvalid(ctx *fiber.Ctx, errs ...*ErrorResponse) error {
+	return infra.FailWithMessage(http.StatusBadRequest, errs, ctx)
+}
+
+// dbFailed maps a db error to the response status, not found and unique key conflicts
+// are the caller's fault, everything else is logged as a server error. Driver messages
+// name tables and keys, so only generic messages reach the client
+func (srv *AdminServer) dbFailed(ctx *fiber.Ctx, err error) error {
+	var mysqlErr *mysql.MySQLError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return infra.FailWithMessage(http.StatusNotFound, "record not found", ctx)
+	case errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry:
+		srv.log.Info("db duplicate entry", zap.String("path", ctx.Path()), zap.Error(err))
+		return infra.FailWithMessage(http.StatusConflict, "record already exists", ctx)
+	}
+	srv.log.Error("db operation failed", zap.String("path", ctx.Path()), zap.Error(err))
+	return infra.Fail(http.StatusInternalServerError, ctx)
+}
@@ -2,6 +2,53 @@ package server
 
 import "github.com/gofiber/fiber/v2"
 
+func (srv *AdminServer) apikeysRegister(root fiber.Router) {
+	root.Get("/mine", srv.GetMyApiKeys)
+	root.Post("/mine/add", srv.NewMyApiKey)
+	root.Put("/mine/edit", srv.UpdateMyApiKey)
+	root.Put("/mine/revoke/:id", srv.RevokeMyApiKey)
+	root.Delete("/mine/del/:id", srv.DeleteMyApiKey)
+	root.Get("/query", srv.QueryApiKeys)
+	root.Post("/key/add", srv.NewApiKey)
+	root.Put("/key/edit", srv.UpdateApiKey)
+	root.Put("/key/revoke/:id", srv.RevokeApiKey)
+	root.Delete("/key/del/:id", srv.DeleteApiKey)
+	root.Post("/service/add", srv.NewServiceAccount)
+}
+func (srv *AdminServer) authRegister(root fiber.Router) {
+	root.Post("/sign", srv.SignIn)
+	root.Post("/logout", srv.SignOut)
+	root.Post("/refresh", srv.RefreshToken)
+	root.Get("/oauth/:provider", srv.OAuthAuthorize)
+	root.Get("/oauth/:provider/callback", srv.OAuthCallback)
+	root.Get("/me", srv.GetMe)
+}
+func (srv *AdminServer) debugRegister(root fiber.Router) {
+	root.Get("/config", srv.ExplainConfig)
+}
+func (srv *AdminServer) lockoutRegister(root fiber.Router) {
+	root.Get("/events", srv.QueryLockEvents)
+	root.Put("/unlock", srv.UnlockIdentify)
+}
+func (srv *AdminServer) menusRegister(root fiber.Router) {
+	root.Get("/tree", srv.GetMenuTree)
+	root.Get("/query", srv.QueryMenus)
+	root.Get("/mine", srv.GetMyMenus)
+	root.Post("/menu/add", srv.CreateMenu)
+	root.Put("/menu/edit", srv.UpdateMenu)
+	root.Put("/menu/move", srv.MoveMenu)
+	root.Put("/menu/hidden/:id", srv.ToggleMenuHidden)
+	root.Delete("/menu/del/:id", srv.DeleteMenu)
+}
+func (srv *AdminServer) mfaRegister(root fiber.Router) {
+	root.Get("/status", srv.GetMfaStatus)
+	root.Post("/enroll", srv.EnrollMfa)
+	root.Post("/confirm", srv.ConfirmMfa)
+	root.Post("/verify", srv.VerifyMfa)
+	root.Post("/recovery", srv.RenewRecoveryCodes)
+	root.Post("/disable", srv.DisableMfa)
+	root.Delete("/user/:name", srv.ResetUserMfa)
+}
 func (srv *AdminServer) permitsRegister(root fiber.Router) {
 	root.Get("/all", srv.GetPermissions)
 	root.Get("/query", srv.QueryPermissions)
@@ -9,19 +56,55 @@ func (srv *AdminServer) permitsRegister(root fiber.Router) {
 	root.Put("/permit/edit", srv.UpdatePermission)
 	root.Delete("/permit/del/:id", srv.DeletePermission)
 }
+func (srv *AdminServer) rolesRegister(root fiber.Router) {
+	root.Get("/all", srv.GetRoles)
+	root.Get("/query", srv.QueryRoles)
+	root.Post("/role/add", srv.CreateRole)
+	root.Put("/role/edit", srv.UpdateRole)
+	root.Put("/role/permits", srv.UpdateRolePermissions)
+	root.Put("/role/menus", srv.UpdateRoleMenus)
+	root.Delete("/role/del/:id", srv.DeleteRole)
+}
+func (srv *AdminServer) sessionsRegister(root fiber.Router) {
+	root.Get("/online", srv.GetOnlineUsers)
+	root.Get("/user/:name", srv.GetUserSessions)
+	root.Get("/mine", srv.GetMySessions)
+	root.Delete("/kick/session/:id", srv.KickSession)
+	root.Delete("/kick/mine/:id", srv.KickMySession)
+	root.Delete("/kick/user/:name", srv.KickUser)
+}
 func (srv *AdminServer) usersRegister(root fiber.Router) {
 	root.Get("/all", srv.GetAllUser)
 	root.Get("/query", srv.QueryUsers)
 	root.Post("/user/add", srv.NewUser)
 	root.Put("/user/edit", srv.UpdateUserInfo)
 	root.Put("/pwd/edit", srv.UpdateUserPass)
+	root.Put("/pwd/reset", srv.ResetUserPass)
 	root.Post("/avatar/edit", srv.ChangeAvatar)
 	root.Delete("/user/id/:id", srv.DeleteUserById)
 	root.Delete("/user/name/:name", srv.DeleteUserByName)
+	root.Delete("/tokens/id/:id", srv.RevokeUserTokensById)
+	root.Delete("/tokens/name/:name", srv.RevokeUserTokensByName)
 }
 func (srv *AdminServer) Register(root fiber.Router) {
+	apikeys := root.Group("/apikeys")
+	auth := root.Group("/auth")
+	debug := root.Group("/debug")
+	lockout := root.Group("/lockout")
+	menus := root.Group("/menus")
+	mfa := root.Group("/mfa")
 	permits := root.Group("/permits")
+	roles := root.Group("/roles")
+	sessions := root.Group("/sessions")
 	users := root.Group("/users")
+	srv.apikeysRegister(apikeys)
+	srv.authRegister(auth)
+	srv.debugRegister(debug)
+	srv.lockoutRegister(lockout)
+	srv.menusRegister(menus)
+	srv.mfaRegister(mfa)
 	srv.permitsRegister(permits)
+	srv.rolesRegister(roles)
+	srv.sessionsRegister(sessions)
 	srv.usersRegister(users)
 }
@@ -0,0 +1,364 @@
+// go:controller(path="/apikeys",name="apikeys")
+package server
+
+import (
+	"errors"
+	"golang-ast/db"
+	"golang-ast/infra"
+	"golang-ast/utils"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// serviceGrant marks the accounts that only call the api through their api keys
+const serviceGrant = "service"
+
+type apiKeyForm struct {
+	Id       string     `json:"id"`
+	Owner    string     `json:"owner"`
+	Name     string     `json:"name"`
+	Permits  []string   `json:"permits"`
+	AllowIps []string   `json:"allow_ips"`
+	Exp      *time.Time `json:"exp"`
+}
+
+type serviceForm struct {
+	Name  string `json:"name"`
+	Nick  string `json:"nick"`
+	Roles []int  `json:"roles"`
+}
+
+// createdApiKey carries the token of a new key, it is never shown again
+type createdApiKey struct {
+	Token string        `json:"token"`
+	Key   *db.SysApiKey `json:"key"`
+}
+
+// go:interface(method="GET",path="/mine",auth="any",opLog="查询我的API密钥")
+func (srv *AdminServer) GetMyApiKeys(ctx *fiber.Ctx) error {
+	user, err := srv.apiKeyOperator(ctx)
+	if user == nil {
+		return err
+	}
+	return srv.queryApiKeys(ctx, user.Name)
+}
+
+// go:interface(method="POST",path="/mine/add",auth="any",opLog="创建我的API密钥")
+func (srv *AdminServer) NewMyApiKey(ctx *fiber.Ctx) error {
+	user, err := srv.apiKeyOperator(ctx)
+	if user == nil {
+		return err
+	}
+	var form apiKeyForm
+	if err = ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	return srv.createApiKey(ctx, user, &form)
+}
+
+// go:interface(method="PUT",path="/mine/edit",auth="any",opLog="修改我的API密钥")
+func (srv *AdminServer) UpdateMyApiKey(ctx *fiber.Ctx) error {
+	user, err := srv.apiKeyOperator(ctx)
+	if user == nil {
+		return err
+	}
+	var form apiKeyForm
+	if err = ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	key, err := srv.ownApiKey(ctx, user, form.Id)
+	if key == nil {
+		return err
+	}
+	return srv.updateApiKey(ctx, user, key, &form)
+}
+
+// go:interface(method="PUT",path="/mine/revoke/:id",auth="any",opLog="吊销我的API密钥")
+func (srv *AdminServer) RevokeMyApiKey(ctx *fiber.Ctx) error {
+	user, err := srv.apiKeyOperator(ctx)
+	if user == nil {
+		return err
+	}
+	key, err := srv.ownApiKey(ctx, user, ctx.Params("id"))
+	if key == nil {
+		return err
+	}
+	return srv.revokeApiKey(ctx, key)
+}
+
+// go:interface(method="DELETE",path="/mine/del/:id",auth="any",opLog="删除我的API密钥")
+func (srv *AdminServer) DeleteMyApiKey(ctx *fiber.Ctx) error {
+	user, err := srv.apiKeyOperator(ctx)
+	if user == nil {
+		return err
+	}
+	key, err := srv.ownApiKey(ctx, user, ctx.Params("id"))
+	if key == nil {
+		return err
+	}
+	return srv.deleteApiKey(ctx, key)
+}
+
+// go:interface(method="GET",path="/query",auth="APIKEY_QUERY",opLog="查询API密钥")
+func (srv *AdminServer) QueryApiKeys(ctx *fiber.Ctx) error {
+	if user, err := srv.apiKeyOperator(ctx); user == nil {
+		return err
+	}
+	return srv.queryApiKeys(ctx, strings.TrimSpace(ctx.Query("owner")))
+}
+
+// go:interface(method="POST",path="/key/add",auth="APIKEY_ADD",opLog="创建API密钥")
+func (srv *AdminServer) NewApiKey(ctx *fiber.Ctx) error {
+	if user, err := srv.apiKeyOperator(ctx); user == nil {
+		return err
+	}
+	var form apiKeyForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	if form.Owner == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "owner", Rule: "required"})
+	}
+	owner, err := srv.db.FindUserByIdentify(form.Owner, true)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return srv.createApiKey(ctx, owner, &form)
+}
+
+// go:interface(method="PUT",path="/key/edit",auth="APIKEY_UPDATE",opLog="修改API密钥")
+func (srv *AdminServer) UpdateApiKey(ctx *fiber.Ctx) error {
+	if user, err := srv.apiKeyOperator(ctx); user == nil {
+		return err
+	}
+	var form apiKeyForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	key, err := srv.findApiKey(ctx, form.Id)
+	if key == nil {
+		return err
+	}
+	owner, err := srv.db.FindUserById(key.Uid, true)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return srv.updateApiKey(ctx, owner, key, &form)
+}
+
+// go:interface(method="PUT",path="/key/revoke/:id",auth="APIKEY_REVOKE",opLog="吊销API密钥")
+func (srv *AdminServer) RevokeApiKey(ctx *fiber.Ctx) error {
+	if user, err := srv.apiKeyOperator(ctx); user == nil {
+		return err
+	}
+	key, err := srv.findApiKey(ctx, ctx.Params("id"))
+	if key == nil {
+		return err
+	}
+	return srv.revokeApiKey(ctx, key)
+}
+
+// go:interface(method="DELETE",path="/key/del/:id",auth="APIKEY_DEL",opLog="删除API密钥")
+func (srv *AdminServer) DeleteApiKey(ctx *fiber.Ctx) error {
+	if user, err := srv.apiKeyOperator(ctx); user == nil {
+		return err
+	}
+	key, err := srv.findApiKey(ctx, ctx.Params("id"))
+	if key == nil {
+		return err
+	}
+	return srv.deleteApiKey(ctx, key)
+}
+
+// go:interface(method="POST",path="/service/add",auth="SERVICE_ADD",opLog="新增服务账户")
+func (srv *AdminServer) NewServiceAccount(ctx *fiber.Ctx) error {
+	if user, err := srv.apiKeyOperator(ctx); user == nil {
+		return err
+	}
+	var form serviceForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	if errs := validateUser(&userForm{Name: form.Name, Nick: form.Nick}); len(errs) > 0 {
+		return bodyInvalid(ctx, errs...)
+	}
+	form.Name = strings.TrimSpace(form.Name)
+	if exist, _ := srv.db.QueryUserBy(form.Name, "", ""); exist != nil {
+		return infra.FailWithMessage(http.StatusConflict, "user name already in use", ctx)
+	}
+	roles, err := srv.db.GetRolesByIds(form.Roles)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	// a service account never signs in, nobody knows its password
+	password, err := srv.auth.HashPassword(utils.MustNanoId())
+	if err != nil {
+		srv.log.Error("NewServiceAccount().HashPassword error", zap.Error(err))
+		return infra.Fail(http.StatusInternalServerError, ctx)
+	}
+	created, err := srv.db.CreateUser(&db.SysUser{
+		Name:     form.Name,
+		Password: password,
+		Nick:     form.Nick,
+		Enable:   true,
+		GrantBy:  serviceGrant,
+		LockBy:   "none",
+		Roles:    roles,
+	})
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	created.Password = ""
+	return infra.OkWithMessage(created, ctx)
+}
+
+func (srv *AdminServer) queryApiKeys(ctx *fiber.Ctx, owner string) error {
+	size, errSize := queryInt(ctx, "size", defaultPageSize)
+	page, errPage := queryInt(ctx, "page", 0)
+	if errSize != nil || size <= 0 || size > maxPageSize {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "size", Rule: "min=1,max=200", ErrValue: ctx.Query("size")})
+	}
+	if errPage != nil || page < 0 {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "page", Rule: "min=0", ErrValue: ctx.Query("page")})
+	}
+	keys, err := srv.db.QueryApiKeys(db.ApiKeyFilter{Owner: owner}, int32(size), int32(page))
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(keys, ctx)
+}
+
+func (srv *AdminServer) createApiKey(ctx *fiber.Ctx, owner *db.SysUser, form *apiKeyForm) error {
+	if errs := srv.validateApiKey(form, owner); len(errs) > 0 {
+		return bodyInvalid(ctx, errs...)
+	}
+	key := &db.SysApiKey{
+		Name:     form.Name,
+		Permits:  form.Permits,
+		AllowIps: form.AllowIps,
+		Exp:      form.Exp,
+	}
+	token, err := srv.auth.CreateApiKey(owner, key)
+	if errors.Is(err, infra.ErrTooManyApiKeys) {
+		return infra.FailWithMessage(http.StatusConflict, err.Error(), ctx)
+	}
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(createdApiKey{Token: token, Key: key}, ctx)
+}
+
+func (srv *AdminServer) updateApiKey(ctx *fiber.Ctx, owner *db.SysUser, key *db.SysApiKey, form *apiKeyForm) error {
+	if errs := srv.validateApiKey(form, owner); len(errs) > 0 {
+		return bodyInvalid(ctx, errs...)
+	}
+	key.Name, key.Permits, key.AllowIps, key.Exp = form.Name, form.Permits, form.AllowIps, form.Exp
+	if err := srv.db.UpdateApiKey(key); err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(key, ctx)
+}
+
+func (srv *AdminServer) revokeApiKey(ctx *fiber.Ctx, key *db.SysApiKey) error {
+	revoked, err := srv.db.RevokeApiKey(key.Id)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if !revoked {
+		return infra.FailWithMessage(http.StatusConflict, "api key already revoked", ctx)
+	}
+	return infra.Ok(ctx)
+}
+
+func (srv *AdminServer) deleteApiKey(ctx *fiber.Ctx, key *db.SysApiKey) error {
+	if err := srv.db.DeleteApiKey(key.Id); err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.Ok(ctx)
+}
+
+// apiKeyOperator loads the signed in user with its authorities, api keys can't manage api
+// keys so a leaked key can't outlive its revocation, a nil user means the response is
+// already written
+func (srv *AdminServer) apiKeyOperator(ctx *fiber.Ctx) (*db.SysUser, error) {
+	authentication := currentAuth(ctx)
+	if authentication == nil {
+		return nil, infra.FailWithMessage(http.StatusUnauthorized, "not signed in", ctx)
+	}
+	if authentication.ApiKeyId() != "" {
+		return nil, infra.FailWithMessage(http.StatusForbidden, "api keys can not manage api keys", ctx)
+	}
+	user, err := srv.db.FindUserByIdentify(authentication.Principal(), true)
+	if err != nil {
+		return nil, srv.dbFailed(ctx, err)
+	}
+	return user, nil
+}
+
+func (srv *AdminServer) findApiKey(ctx *fiber.Ctx, id string) (*db.SysApiKey, error) {
+	if id == "" {
+		return nil, bodyInvalid(ctx, &ErrorResponse{FailedField: "id", Rule: "required"})
+	}
+	key, err := srv.db.FindApiKey(id)
+	if err != nil {
+		return nil, srv.dbFailed(ctx, err)
+	}
+	return key, nil
+}
+
+// ownApiKey loads a key of the user, the keys of other users look the same as unknown ones
+func (srv *AdminServer) ownApiKey(ctx *fiber.Ctx, user *db.SysUser, id string) (*db.SysApiKey, error) {
+	key, err := srv.findApiKey(ctx, id)
+	if key == nil {
+		return nil, err
+	}
+	if key.Uid != user.Id {
+		return nil, infra.FailWithMessage(http.StatusNotFound, "record not found", ctx)
+	}
+	return key, nil
+}
+
+// validateApiKey checks a key form against the owner, a key never holds a permit its
+// owner lacks and never lives longer than the configured max age
+func (srv *AdminServer) validateApiKey(form *apiKeyForm, owner *db.SysUser) []*ErrorResponse {
+	var errs []*ErrorResponse
+	form.Name = strings.TrimSpace(form.Name)
+	if form.Name == "" || len([]rune(form.Name)) > 50 {
+		errs = append(errs, &ErrorResponse{FailedField: "name", Rule: "required,max=50", ErrValue: form.Name})
+	}
+	held := make(map[string]bool, len(owner.Authorities))
+	for _, permit := range owner.Authorities {
+		held[permit] = true
+	}
+	length := 0
+	for _, permit := range form.Permits {
+		length += len(permit) + 3
+		if !held[permit] {
+			errs = append(errs, &ErrorResponse{FailedField: "permits", Rule: "owned", ErrValue: permit})
+		}
+	}
+	if length > 1900 {
+		errs = append(errs, &ErrorResponse{FailedField: "permits", Rule: "max=1900", ErrValue: length})
+	}
+	if len(form.AllowIps) > 20 {
+		errs = append(errs, &ErrorResponse{FailedField: "allow_ips", Rule: "max=20", ErrValue: len(form.AllowIps)})
+	}
+	for _, entry := range form.AllowIps {
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			errs = append(errs, &ErrorResponse{FailedField: "allow_ips", Rule: "ip|cidr", ErrValue: entry})
+		}
+	}
+	now := time.Now()
+	limit := now.AddDate(0, 0, srv.cfg.AuthCfg.ApiKey.MaxAge)
+	if form.Exp == nil {
+		form.Exp = &limit
+	} else if form.Exp.Before(now) || form.Exp.After(limit) {
+		errs = append(errs, &ErrorResponse{FailedField: "exp", Rule: "future,max_age", ErrValue: form.Exp})
+	}
+	return errs
+}
@@ -0,0 +1,292 @@
+// go:controller(path="/auth",name="auth")
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"golang-ast/db"
+	"golang-ast/infra"
+	"golang-ast/utils"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	oauthStateCookie = "oauth_state"
+	oauthCookiePath  = "/api/auth/oauth"
+	jwksPath         = "/.well-known/jwks.json"
+)
+
+var errBadCredentials = errors.New("用户名或密码错误")
+
+type signForm struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type refreshForm struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type meResponse struct {
+	User        *db.SysUser `json:"user"`
+	Roles       []string    `json:"roles"`
+	Authorities []string    `json:"authorities"`
+	Menus       []*Route    `json:"menus"`
+}
+
+// go:interface(method="POST",path="/sign",opLog="用户登录")
+func (srv *AdminServer) SignIn(ctx *fiber.Ctx) error {
+	var form signForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	form.Username = strings.TrimSpace(form.Username)
+	if form.Username == "" || form.Password == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "username|password", Rule: "required"})
+	}
+	if exp, locked := srv.auth.LockedUntil(form.Username, ctx.IP()); locked {
+		return lockedFailed(ctx, exp)
+	}
+	user, err := srv.db.FindUserByIdentify(form.Username, true)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return srv.dbFailed(ctx, err)
+	}
+	// unknown users, accounts created by an oauth login and service accounts have no usable
+	// password, a dummy hash is verified instead so they fail as slowly as a wrong password
+	if err != nil || user.OpenId != "" || user.GrantBy == serviceGrant {
+		srv.auth.VerifyUnknownPassword(form.Password)
+		return srv.auth.OnAuthFailedHandler(form.Username, errBadCredentials, ctx)
+	}
+	if !srv.auth.VerifyPassword(user, form.Password) {
+		return srv.auth.OnAuthFailedHandler(form.Username, errBadCredentials, ctx)
+	}
+	// checked after the password so the state of an account isn't disclosed to guessers
+	srv.auth.ReleaseExpiredLock(user)
+	if !user.Enable || user.LockBy != "none" {
+		return infra.FailWithMessage(http.StatusForbidden, "账户已禁用", ctx)
+	}
+	return srv.auth.OnAuthSuccessHandler(user, ctx)
+}
+
+// lockedFailed refuses a sign-in step while the account or the client address is locked
+func lockedFailed(ctx *fiber.Ctx, exp time.Time) error {
+	remain := int(math.Ceil(time.Until(exp).Seconds()))
+	return infra.FailWithMessage(http.StatusUnauthorized, "错误次数过多，账户已锁定，"+strconv.Itoa(remain)+"秒后解锁", ctx)
+}
+
+// go:interface(method="POST",path="/logout",opLog="用户登出")
+func (srv *AdminServer) SignOut(ctx *fiber.Ctx) error {
+	// a valid session is signed out by the auth filter, only stale tokens reach here
+	tokenHeader := ctx.Get(fiber.HeaderAuthorization)
+	if len(tokenHeader) > 7 && strings.EqualFold(tokenHeader[:7], "bearer ") {
+		if claim, err := srv.auth.ParseToken(tokenHeader[7:]); err == nil {
+			return srv.auth.OnSignOutHandler(claim, ctx)
+		}
+	}
+	return infra.FailWithMessage(http.StatusUnauthorized, "not signed in", ctx)
+}
+
+// go:interface(method="POST",path="/refresh",opLog="刷新令牌")
+func (srv *AdminServer) RefreshToken(ctx *fiber.Ctx) error {
+	var form refreshForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	if form.RefreshToken == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "refresh_token", Rule: "required"})
+	}
+	pair, err := srv.auth.Refresh(ctx.UserContext(), form.RefreshToken)
+	switch {
+	case errors.Is(err, infra.ErrRefreshDisabled):
+		return infra.FailWithMessage(http.StatusNotFound, err.Error(), ctx)
+	case errors.Is(err, infra.ErrRefreshTokenInvalid), errors.Is(err, infra.ErrRefreshTokenReused):
+		return infra.FailWithMessage(http.StatusUnauthorized, err.Error(), ctx)
+	case err != nil:
+		srv.log.Error("RefreshToken().Refresh error", zap.Error(err))
+		return infra.Fail(http.StatusInternalServerError, ctx)
+	}
+	return infra.OkWithMessage(map[string]any{
+		"username":      pair.Principal,
+		"tk":            pair.AccessToken,
+		"refresh_token": pair.RefreshToken,
+		"expires_in":    pair.ExpiresIn,
+	}, ctx)
+}
+
+// go:interface(method="GET",path="/oauth/:provider",opLog="第三方登录")
+func (srv *AdminServer) OAuthAuthorize(ctx *fiber.Ctx) error {
+	provider := ctx.Params("provider")
+	target, state, err := srv.providers.Authorize(ctx.UserContext(), provider, srv.oauthCallback(ctx, provider))
+	if errors.Is(err, infra.ErrProviderNotFound) {
+		return infra.FailWithMessage(http.StatusNotFound, err.Error(), ctx)
+	}
+	if err != nil {
+		srv.log.Error("oauth authorize failed", zap.String("provider", provider), zap.Error(err))
+		return infra.FailWithMessage(http.StatusBadGateway, "identity provider unavailable", ctx)
+	}
+	// the state is also bound to the browser, a callback started elsewhere is refused
+	ctx.Cookie(&fiber.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     oauthCookiePath,
+		MaxAge:   600,
+		Secure:   ctx.Protocol() == "https",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	return ctx.Redirect(target)
+}
+
+// go:interface(method="GET",path="/oauth/:provider/callback",opLog="第三方登录回调")
+func (srv *AdminServer) OAuthCallback(ctx *fiber.Ctx) error {
+	provider := ctx.Params("provider")
+	state := ctx.Query("state")
+	cookie := ctx.Cookies(oauthStateCookie)
+	ctx.Cookie(&fiber.Cookie{Name: oauthStateCookie, Path: oauthCookiePath, MaxAge: -1})
+	if state == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+		return srv.oauthFailed(ctx, infra.ErrOAuthStateInvalid)
+	}
+	if reason := ctx.Query("error"); reason != "" {
+		return srv.oauthFailed(ctx, errors.New(ctx.Query("error_description", reason)))
+	}
+	identity, err := srv.providers.Exchange(ctx.UserContext(), provider, state, ctx.Query("code"))
+	if err != nil {
+		return srv.oauthFailed(ctx, err)
+	}
+	user, err := srv.oauthUser(identity)
+	if err != nil {
+		return srv.oauthFailed(ctx, err)
+	}
+	if !user.Enable || user.LockBy != "none" {
+		return srv.oauthFailed(ctx, errors.New("账户已禁用"))
+	}
+	return srv.auth.OnAuthSuccessHandler(user, ctx)
+}
+
+// go:interface(method="GET",path="/me",auth="any",opLog="查询当前用户")
+func (srv *AdminServer) GetMe(ctx *fiber.Ctx) error {
+	authentication := currentAuth(ctx)
+	if authentication == nil {
+		return infra.FailWithMessage(http.StatusUnauthorized, "not signed in", ctx)
+	}
+	user, err := srv.db.FindUserByIdentify(authentication.Principal(), false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	routes, err := srv.userRoutes(authentication)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	authorities := make([]string, 0, authentication.Authorities().Size())
+	for _, permit := range authentication.Authorities().Values() {
+		authorities = append(authorities, permit.(string))
+	}
+	sort.Strings(authorities)
+	user.Password = ""
+	return infra.OkWithMessage(meResponse{
+		User:        user,
+		Roles:       authentication.Roles(),
+		Authorities: authorities,
+		Menus:       routes,
+	}, ctx)
+}
+
+// JWKS publishes the token verification keys in the standard jwks format, it is served
+// outside /api so it carries no response envelope
+func (srv *AdminServer) JWKS(ctx *fiber.Ctx) error {
+	set, err := srv.auth.JWKS()
+	if err != nil {
+		srv.log.Error("JWKS().encode key error", zap.Error(err))
+		return infra.Fail(http.StatusInternalServerError, ctx)
+	}
+	ctx.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return ctx.JSON(set)
+}
+
+// oauthCallback is the redirect_uri of a provider, derived from the request unless configured
+func (srv *AdminServer) oauthCallback(ctx *fiber.Ctx, provider string) string {
+	for _, cfg := range srv.cfg.AuthCfg.Providers {
+		if cfg.Name == provider && cfg.CallbackUrl != "" {
+			return cfg.CallbackUrl
+		}
+	}
+	return ctx.BaseURL() + oauthCookiePath + "/" + provider + "/callback"
+}
+
+// oauthUser finds the user linked to an identity, the first login creates it, and
+// aligns its roles with the provider groups when the provider maps them
+func (srv *AdminServer) oauthUser(identity *infra.Identity) (*db.SysUser, error) {
+	user, err := srv.db.FindUserByOpenId(identity.OpenId(), true)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		user, err = srv.createOAuthUser(identity)
+	}
+	if err != nil || identity.Roles == nil {
+		return user, err
+	}
+	roles, err := srv.db.GetRolesByCodes(identity.Roles)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = srv.db.UpdateUserWithId(user, map[string]any{"id": user.Id}, roles); err != nil {
+		return nil, err
+	}
+	return srv.db.FindUserById(user.Id, true)
+}
+
+func (srv *AdminServer) createOAuthUser(identity *infra.Identity) (*db.SysUser, error) {
+	name := identity.Name
+	if len([]rune(name)) > 40 {
+		name = string([]rune(name)[:40])
+	}
+	if exist, _ := srv.db.QueryUserBy(name, "", ""); exist != nil {
+		name += "-" + utils.MustNanoId()[:6]
+	}
+	// an email or phone already used by another account would make sign-in ambiguous
+	email, phone := identity.Email, identity.Phone
+	if exist, _ := srv.db.QueryUserBy("", email, ""); email != "" && exist != nil {
+		email = ""
+	}
+	if exist, _ := srv.db.QueryUserBy("", "", phone); phone != "" && exist != nil {
+		phone = ""
+	}
+	// the account signs in through the provider only, nobody knows its password
+	password, err := srv.auth.HashPassword(utils.MustNanoId())
+	if err != nil {
+		return nil, err
+	}
+	created, err := srv.db.CreateUser(&db.SysUser{
+		Name:     name,
+		Password: password,
+		Nick:     identity.Nick,
+		Email:    email,
+		Phone:    phone,
+		Enable:   true,
+		GrantBy:  identity.Provider,
+		LockBy:   "none",
+		Header:   identity.Avatar,
+		OpenId:   identity.OpenId(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return srv.db.FindUserById(created.Id, true)
+}
+
+// oauthFailed sends the browser back to the front end with the reason the oauth login failed
+func (srv *AdminServer) oauthFailed(ctx *fiber.Ctx, err error) error {
+	srv.log.Warn("oauth login failed", zap.String("provider", ctx.Params("provider")), zap.Error(err))
+	if srv.cfg.AuthCfg.RedirectUrl == "" {
+		return infra.FailWithMessage(http.StatusUnauthorized, err.Error(), ctx)
+	}
+	return ctx.Redirect(srv.cfg.AuthCfg.RedirectUrl + "?grant=" + url.QueryEscape(ctx.Params("provider")) + "&error=" + url.QueryEscape(err.Error()))
+}
@@ -0,0 +1,13 @@
+// go:controller(path="/debug",name="debug")
+package server
+
+import (
+	"golang-ast/infra"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// go:interface(method="GET",path="/config",auth="CONFIG_QUERY",opLog="查看配置来源")
+func (srv *AdminServer) ExplainConfig(ctx *fiber.Ctx) error {
+	return infra.OkWithMessage(srv.cfg.Explain(), ctx)
+}
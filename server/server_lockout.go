@@ -0,0 +1,64 @@
+// go:controller(path="/lockout",name="lockout")
+package server
+
+import (
+	"golang-ast/db"
+	"golang-ast/infra"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+type unlockForm struct {
+	Identify string `json:"identify"`
+	Ip       string `json:"ip"`
+}
+
+// go:interface(method="GET",path="/events",auth="LOCK_QUERY",opLog="查询锁定记录")
+func (srv *AdminServer) QueryLockEvents(ctx *fiber.Ctx) error {
+	size, errSize := queryInt(ctx, "size", defaultPageSize)
+	page, errPage := queryInt(ctx, "page", 0)
+	if errSize != nil || size <= 0 || size > maxPageSize {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "size", Rule: "min=1,max=200", ErrValue: ctx.Query("size")})
+	}
+	if errPage != nil || page < 0 {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "page", Rule: "min=0", ErrValue: ctx.Query("page")})
+	}
+	filter := db.LockEventFilter{
+		Identify: strings.TrimSpace(ctx.Query("identify")),
+		Action:   strings.TrimSpace(ctx.Query("action")),
+	}
+	events, err := srv.db.QueryLockEvents(filter, int32(size), int32(page))
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(events, ctx)
+}
+
+// go:interface(method="PUT",path="/unlock",auth="LOCK_UNLOCK",opLog="解除锁定")
+func (srv *AdminServer) UnlockIdentify(ctx *fiber.Ctx) error {
+	var form unlockForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	form.Identify = strings.TrimSpace(form.Identify)
+	form.Ip = strings.TrimSpace(form.Ip)
+	if form.Identify == "" && form.Ip == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "identify|ip", Rule: "required"})
+	}
+	if form.Ip != "" && net.ParseIP(form.Ip) == nil {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "ip", Rule: "ip", ErrValue: form.Ip})
+	}
+	operator := ""
+	if authentication := currentAuth(ctx); authentication != nil {
+		operator = authentication.Principal()
+	}
+	if err := srv.auth.Unlock(form.Identify, form.Ip, operator); err != nil {
+		srv.log.Error("UnlockIdentify().Unlock error", zap.Error(err))
+		return infra.Fail(http.StatusInternalServerError, ctx)
+	}
+	return infra.Ok(ctx)
+}
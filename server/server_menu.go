@@ -0,0 +1,295 @@
+// go:controller(path="/menus",name="menus")
+package server
+
+import (
+	"golang-ast/db"
+	"golang-ast/infra"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type moveForm struct {
+	Id   int `json:"id"`
+	Pid  int `json:"pid"`
+	Sort int `json:"sort"`
+}
+
+// RouteMeta and Route are the navigation shape consumed by vue-router and react-router
+type RouteMeta struct {
+	Title  string `json:"title"`
+	Icon   string `json:"icon"`
+	Hidden bool   `json:"hidden"`
+	Iframe bool   `json:"iframe"`
+}
+
+type Route struct {
+	Path      string    `json:"path"`
+	Name      string    `json:"name"`
+	Component string    `json:"component"`
+	Meta      RouteMeta `json:"meta"`
+	Children  []*Route  `json:"children,omitempty"`
+}
+
+// go:interface(method="GET",path="/tree",auth="MENU_QUERY",opLog="查询菜单树")
+func (srv *AdminServer) GetMenuTree(ctx *fiber.Ctx) error {
+	pid, err := queryInt(ctx, "pid", 0)
+	if err != nil || pid < 0 {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "pid", Rule: "min=0", ErrValue: ctx.Query("pid")})
+	}
+	menus, err := srv.db.GetMenuTree(pid)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(menus, ctx)
+}
+
+// go:interface(method="GET",path="/query",auth="MENU_QUERY",opLog="搜索菜单")
+func (srv *AdminServer) QueryMenus(ctx *fiber.Ctx) error {
+	filter := db.MenuFilter{
+		Name:   strings.TrimSpace(ctx.Query("name")),
+		Hidden: ctx.Query("hidden") == "true",
+	}
+	menus, err := srv.db.QueryMenus(filter)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(menus, ctx)
+}
+
+// go:interface(method="GET",path="/mine",auth="any",opLog="查询个人菜单")
+func (srv *AdminServer) GetMyMenus(ctx *fiber.Ctx) error {
+	authentication := currentAuth(ctx)
+	if authentication == nil {
+		return infra.FailWithMessage(http.StatusUnauthorized, "not signed in", ctx)
+	}
+	routes, err := srv.userRoutes(authentication)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(routes, ctx)
+}
+
+// go:interface(method="POST",path="/menu/add",auth="MENU_ADD",opLog="创建菜单")
+func (srv *AdminServer) CreateMenu(ctx *fiber.Ctx) error {
+	var menu db.SysMenu
+	if err := ctx.BodyParser(&menu); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	menu.Id, menu.Children = 0, nil
+	errs := validateMenu(&menu)
+	if menu.Pid < 0 {
+		errs = append(errs, &ErrorResponse{FailedField: "pid", Rule: "min=0", ErrValue: menu.Pid})
+	}
+	if len(errs) > 0 {
+		return bodyInvalid(ctx, errs...)
+	}
+	if menu.Pid > 0 {
+		if _, err := srv.db.GetMenuById(menu.Pid, false); err != nil {
+			return srv.dbFailed(ctx, err)
+		}
+	}
+	created, err := srv.db.CreateMenu(&menu)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(created, ctx)
+}
+
+// go:interface(method="PUT",path="/menu/edit",auth="MENU_UPDATE",opLog="修改菜单")
+func (srv *AdminServer) UpdateMenu(ctx *fiber.Ctx) error {
+	var menu db.SysMenu
+	if err := ctx.BodyParser(&menu); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	menu.Children = nil
+	errs := validateMenu(&menu)
+	if menu.Id <= 0 {
+		errs = append(errs, &ErrorResponse{FailedField: "id", Rule: "required", ErrValue: menu.Id})
+	}
+	if len(errs) > 0 {
+		return bodyInvalid(ctx, errs...)
+	}
+	origin, err := srv.db.GetMenuById(menu.Id, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	// the position of a node only changes through /menu/move
+	menu.Pid, menu.Sort, menu.Ct = origin.Pid, origin.Sort, origin.Ct
+	updated, err := srv.db.UpdateMenu(&menu)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(updated, ctx)
+}
+
+// go:interface(method="PUT",path="/menu/move",auth="MENU_UPDATE",opLog="移动菜单")
+func (srv *AdminServer) MoveMenu(ctx *fiber.Ctx) error {
+	var form moveForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	var errs []*ErrorResponse
+	if form.Id <= 0 {
+		errs = append(errs, &ErrorResponse{FailedField: "id", Rule: "required", ErrValue: form.Id})
+	}
+	if form.Pid < 0 {
+		errs = append(errs, &ErrorResponse{FailedField: "pid", Rule: "min=0", ErrValue: form.Pid})
+	}
+	if len(errs) > 0 {
+		return bodyInvalid(ctx, errs...)
+	}
+	menu, err := srv.db.GetMenuById(form.Id, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if form.Pid != menu.Pid {
+		menus, errAll := srv.db.GetAllMenus()
+		if errAll != nil {
+			return srv.dbFailed(ctx, errAll)
+		}
+		parents := make(map[int]int, len(menus))
+		for _, m := range menus {
+			parents[m.Id] = m.Pid
+		}
+		if _, ok := parents[form.Pid]; form.Pid > 0 && !ok {
+			return infra.FailWithMessage(http.StatusNotFound, "parent menu not found", ctx)
+		}
+		if isDescendant(parents, form.Pid, menu.Id) {
+			return infra.FailWithMessage(http.StatusConflict, "menu can not be moved under itself or its children", ctx)
+		}
+	}
+	menu.Pid, menu.Sort = form.Pid, form.Sort
+	updated, err := srv.db.UpdateMenu(menu)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(updated, ctx)
+}
+
+// go:interface(method="PUT",path="/menu/hidden/:id",auth="MENU_UPDATE",opLog="切换菜单显示")
+func (srv *AdminServer) ToggleMenuHidden(ctx *fiber.Ctx) error {
+	id, err := ctx.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "id", Rule: "number", ErrValue: ctx.Params("id")})
+	}
+	menu, err := srv.db.GetMenuById(id, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	menu.Hidden = !menu.Hidden
+	updated, err := srv.db.UpdateMenu(menu)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(updated, ctx)
+}
+
+// go:interface(method="DELETE",path="/menu/del/:id",auth="MENU_DEL",opLog="删除菜单")
+func (srv *AdminServer) DeleteMenu(ctx *fiber.Ctx) error {
+	id, err := ctx.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "id", Rule: "number", ErrValue: ctx.Params("id")})
+	}
+	// children are loaded so the whole subtree is deleted with the node
+	menu, err := srv.db.GetMenuById(id, true)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if err = srv.db.DeleteMenuById(menu); err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.Ok(ctx)
+}
+
+// userRoutes builds the navigation tree of the menus granted to the roles of a user, the
+// ancestors of a granted menu are kept so the tree stays connected
+func (srv *AdminServer) userRoutes(authentication *infra.Authentication) ([]*Route, error) {
+	granted, err := srv.db.GetMenusByRoleCodes(authentication.Roles())
+	if err != nil {
+		return nil, err
+	}
+	menus, err := srv.db.GetAllMenus()
+	if err != nil {
+		return nil, err
+	}
+	byId := make(map[int]*db.SysMenu, len(menus))
+	for i := range menus {
+		byId[menus[i].Id] = &menus[i]
+	}
+	visible := make(map[int]bool, len(granted))
+	for _, menu := range granted {
+		for id := menu.Id; id > 0 && !visible[id]; {
+			visible[id] = true
+			parent, ok := byId[id]
+			if !ok {
+				break
+			}
+			id = parent.Pid
+		}
+	}
+	routes := make(map[int]*Route, len(visible))
+	for _, menu := range menus {
+		if visible[menu.Id] {
+			routes[menu.Id] = menuRoute(&menu)
+		}
+	}
+	// menus are sorted, appending in that order keeps the siblings sorted
+	tree := make([]*Route, 0)
+	for _, menu := range menus {
+		route, ok := routes[menu.Id]
+		if !ok {
+			continue
+		}
+		if parent, hasParent := routes[menu.Pid]; hasParent {
+			parent.Children = append(parent.Children, route)
+		} else {
+			tree = append(tree, route)
+		}
+	}
+	return tree, nil
+}
+
+func menuRoute(menu *db.SysMenu) *Route {
+	return &Route{
+		Path:      menu.Path,
+		Name:      menu.ComName,
+		Component: menu.Com,
+		Meta: RouteMeta{
+			Title:  menu.Name,
+			Icon:   menu.Icon,
+			Hidden: menu.Hidden,
+			Iframe: menu.Iframe,
+		},
+	}
+}
+
+// isDescendant reports whether node is id itself or lies below it, walking up the parent links
+func isDescendant(parents map[int]int, node, id int) bool {
+	seen := map[int]bool{}
+	for node > 0 && !seen[node] {
+		if node == id {
+			return true
+		}
+		seen[node] = true
+		node = parents[node]
+	}
+	return false
+}
+
+func validateMenu(menu *db.SysMenu) []*ErrorResponse {
+	var errs []*ErrorResponse
+	menu.Name = strings.TrimSpace(menu.Name)
+	menu.Path = strings.TrimSpace(menu.Path)
+	if menu.Name == "" || len([]rune(menu.Name)) > 255 {
+		errs = append(errs, &ErrorResponse{FailedField: "name", Rule: "required,max=255", ErrValue: menu.Name})
+	}
+	if len(menu.Path) > 255 {
+		errs = append(errs, &ErrorResponse{FailedField: "path", Rule: "max=255", ErrValue: menu.Path})
+	}
+	if len(menu.Com) > 255 || len(menu.ComName) > 255 || len(menu.Icon) > 255 {
+		errs = append(errs, &ErrorResponse{FailedField: "com|com_name|icon", Rule: "max=255"})
+	}
+	return errs
+}
@@ -0,0 +1,217 @@
+// go:controller(path="/mfa",name="mfa")
+package server
+
+import (
+	"errors"
+	"golang-ast/db"
+	"golang-ast/infra"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var errBadMfaCode = errors.New("验证码错误")
+
+type mfaCodeForm struct {
+	Code string `json:"code"`
+}
+
+type mfaStatus struct {
+	Enabled       bool  `json:"enabled"`
+	Required      bool  `json:"required"`
+	RecoveryCodes int64 `json:"recovery_codes"`
+}
+
+// go:interface(method="GET",path="/status",auth="any",opLog="查询双因素认证")
+func (srv *AdminServer) GetMfaStatus(ctx *fiber.Ctx) error {
+	user, err := srv.mfaUser(ctx)
+	if user == nil {
+		return err
+	}
+	status := mfaStatus{Enabled: user.MfaEnabled, Required: srv.auth.MfaRequired(user)}
+	if user.MfaEnabled {
+		if status.RecoveryCodes, err = srv.db.CountRecoveryCodes(user.Id); err != nil {
+			return srv.dbFailed(ctx, err)
+		}
+	}
+	return infra.OkWithMessage(status, ctx)
+}
+
+// go:interface(method="POST",path="/enroll",auth="any",opLog="绑定双因素认证")
+func (srv *AdminServer) EnrollMfa(ctx *fiber.Ctx) error {
+	user, err := srv.mfaUser(ctx)
+	if user == nil {
+		return err
+	}
+	enrollment, err := srv.auth.EnrollMfa(user)
+	if err != nil {
+		return srv.mfaFailed(ctx, err)
+	}
+	return infra.OkWithMessage(enrollment, ctx)
+}
+
+// go:interface(method="POST",path="/confirm",auth="any",opLog="确认双因素认证")
+func (srv *AdminServer) ConfirmMfa(ctx *fiber.Ctx) error {
+	form, err := parseMfaCode(ctx)
+	if form == nil {
+		return err
+	}
+	user, err := srv.mfaUser(ctx)
+	if user == nil {
+		return err
+	}
+	codes, err := srv.auth.ConfirmMfa(user, form.Code)
+	if err != nil {
+		return srv.mfaFailed(ctx, err)
+	}
+	// a sign-in that had to enroll first ends here, the user signs in again with the code
+	if authentication := currentAuth(ctx); authentication.Scope() == infra.ScopeMfaSetup {
+		if _, err = srv.auth.KickSession(authentication.SessionId(), "mfa enrolled"); err != nil &&
+			!errors.Is(err, infra.ErrSessionNotFound) {
+			return srv.sessionFailed(ctx, err)
+		}
+	}
+	return infra.OkWithMessage(codes, ctx)
+}
+
+// go:interface(method="POST",path="/verify",auth="any",opLog="双因素认证登录")
+func (srv *AdminServer) VerifyMfa(ctx *fiber.Ctx) error {
+	form, err := parseMfaCode(ctx)
+	if form == nil {
+		return err
+	}
+	authentication := currentAuth(ctx)
+	if authentication == nil || authentication.Scope() != infra.ScopeMfa {
+		return infra.FailWithMessage(http.StatusBadRequest, "no sign-in waits for a second factor", ctx)
+	}
+	if exp, locked := srv.auth.LockedUntil(authentication.Principal(), ctx.IP()); locked {
+		return lockedFailed(ctx, exp)
+	}
+	user, err := srv.mfaUser(ctx)
+	if user == nil {
+		return err
+	}
+	ok, err := srv.auth.VerifyMfa(user, form.Code)
+	if err != nil {
+		return srv.mfaFailed(ctx, err)
+	}
+	// wrong codes count towards the lockout like wrong passwords
+	if !ok {
+		return srv.auth.OnAuthFailedHandler(user.Name, errBadMfaCode, ctx)
+	}
+	// the pending session is replaced by the one of the completed sign-in
+	if _, err = srv.auth.KickSession(authentication.SessionId(), "mfa verified"); err != nil &&
+		!errors.Is(err, infra.ErrSessionNotFound) {
+		return srv.sessionFailed(ctx, err)
+	}
+	srv.auth.ReleaseExpiredLock(user)
+	if !user.Enable || user.LockBy != "none" {
+		return infra.FailWithMessage(http.StatusForbidden, "账户已禁用", ctx)
+	}
+	return srv.auth.OnMfaSuccessHandler(user, ctx)
+}
+
+// go:interface(method="POST",path="/recovery",auth="any",opLog="重新生成恢复码")
+func (srv *AdminServer) RenewRecoveryCodes(ctx *fiber.Ctx) error {
+	user, err := srv.verifiedMfaUser(ctx)
+	if user == nil {
+		return err
+	}
+	codes, err := srv.auth.RenewRecoveryCodes(user)
+	if err != nil {
+		return srv.mfaFailed(ctx, err)
+	}
+	return infra.OkWithMessage(codes, ctx)
+}
+
+// go:interface(method="POST",path="/disable",auth="any",opLog="关闭双因素认证")
+func (srv *AdminServer) DisableMfa(ctx *fiber.Ctx) error {
+	user, err := srv.verifiedMfaUser(ctx)
+	if user == nil {
+		return err
+	}
+	if srv.auth.MfaRequired(user) {
+		return infra.FailWithMessage(http.StatusForbidden, "a role of the account requires a second factor", ctx)
+	}
+	if err = srv.auth.ResetMfa(user); err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.Ok(ctx)
+}
+
+// go:interface(method="DELETE",path="/user/:name",auth="MFA_RESET",opLog="重置用户双因素认证")
+func (srv *AdminServer) ResetUserMfa(ctx *fiber.Ctx) error {
+	name := ctx.Params("name")
+	if name == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "name", Rule: "required"})
+	}
+	if isCurrentUser(ctx, name) {
+		return infra.FailWithMessage(http.StatusBadRequest, "disable your own second factor with a code", ctx)
+	}
+	user, err := srv.db.FindUserByIdentify(name, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if err = srv.auth.ResetMfa(user); err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(user.Name, ctx)
+}
+
+// mfaUser loads the signed in user with its roles, a nil user means the response is already written
+func (srv *AdminServer) mfaUser(ctx *fiber.Ctx) (*db.SysUser, error) {
+	authentication := currentAuth(ctx)
+	if authentication == nil {
+		return nil, infra.FailWithMessage(http.StatusUnauthorized, "not signed in", ctx)
+	}
+	user, err := srv.db.FindUserByIdentify(authentication.Principal(), true)
+	if err != nil {
+		return nil, srv.dbFailed(ctx, err)
+	}
+	return user, nil
+}
+
+// verifiedMfaUser loads the signed in user after checking a code of its second factor,
+// wrong codes count towards the lockout like in the sign-in step
+func (srv *AdminServer) verifiedMfaUser(ctx *fiber.Ctx) (*db.SysUser, error) {
+	form, err := parseMfaCode(ctx)
+	if form == nil {
+		return nil, err
+	}
+	user, err := srv.mfaUser(ctx)
+	if user == nil {
+		return nil, err
+	}
+	if exp, locked := srv.auth.LockedUntil(user.Name, ctx.IP()); locked {
+		return nil, lockedFailed(ctx, exp)
+	}
+	ok, err := srv.auth.VerifyMfa(user, form.Code)
+	if err != nil {
+		return nil, srv.mfaFailed(ctx, err)
+	}
+	if !ok {
+		return nil, srv.auth.OnAuthFailedHandler(user.Name, errBadMfaCode, ctx)
+	}
+	return user, nil
+}
+
+func parseMfaCode(ctx *fiber.Ctx) (*mfaCodeForm, error) {
+	var form mfaCodeForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return nil, infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	if form.Code == "" || len(form.Code) > 20 {
+		return nil, bodyInvalid(ctx, &ErrorResponse{FailedField: "code", Rule: "required,max=20"})
+	}
+	return &form, nil
+}
+
+func (srv *AdminServer) mfaFailed(ctx *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, infra.ErrMfaEnrolled):
+		return infra.FailWithMessage(http.StatusConflict, err.Error(), ctx)
+	case errors.Is(err, infra.ErrMfaNotEnrolled), errors.Is(err, infra.ErrMfaCodeInvalid):
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	return srv.dbFailed(ctx, err)
+}
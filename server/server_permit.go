@@ -2,30 +2,115 @@
 package server
 
 import (
+	"golang-ast/db"
+	"golang-ast/infra"
+	"net/http"
+	"strings"
+
 	"github.com/gofiber/fiber/v2"
 )
 
 // go:interface(method="GET",path="/all",auth="RIGHTS_QUERY",opLog="查询权限列表")
 func (srv *AdminServer) GetPermissions(ctx *fiber.Ctx) error {
-	return nil
+	permits, err := srv.db.GetPermissions(true)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(permits, ctx)
 }
 
 // go:interface(method="GET",path="/query",auth="RIGHTS_QUERY",opLog="搜索权限")
 func (srv *AdminServer) QueryPermissions(ctx *fiber.Ctx) error {
-	return nil
+	filter := db.PermitFilter{
+		Blurry: strings.TrimSpace(ctx.Query("blurry")),
+	}
+	permits, err := srv.db.QueryPermission(filter, true)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(permits, ctx)
 }
 
 // go:interface(method="POST",path="/permit/add",auth="RIGHTS_ADD",opLog="创建权限")
 func (srv *AdminServer) CreatePermission(ctx *fiber.Ctx) error {
-	return nil
+	var permit db.SysPermission
+	if err := ctx.BodyParser(&permit); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	permit.Id = 0
+	if errs := validatePermit(&permit); len(errs) > 0 {
+		return bodyInvalid(ctx, errs...)
+	}
+	if exist, _ := srv.db.GetPermissionByName(permit.Name, false); exist != nil {
+		return infra.FailWithMessage(http.StatusConflict, "permission "+permit.Name+" already exists", ctx)
+	}
+	created, err := srv.db.CreatePermission(&permit)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(created, ctx)
 }
 
 // go:interface(method="PUT",path="/permit/edit",auth="RIGHTS_UPDATE",opLog="修改权限")
 func (srv *AdminServer) UpdatePermission(ctx *fiber.Ctx) error {
-	return nil
+	var permit db.SysPermission
+	if err := ctx.BodyParser(&permit); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	errs := validatePermit(&permit)
+	if permit.Id <= 0 {
+		errs = append(errs, &ErrorResponse{FailedField: "id", Rule: "required", ErrValue: permit.Id})
+	}
+	if len(errs) > 0 {
+		return bodyInvalid(ctx, errs...)
+	}
+	origin, err := srv.db.GetPermissionById(permit.Id, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if exist, _ := srv.db.GetPermissionByName(permit.Name, false); exist != nil && exist.Id != permit.Id {
+		return infra.FailWithMessage(http.StatusConflict, "permission "+permit.Name+" already exists", ctx)
+	}
+	permit.Ct = origin.Ct
+	updated, err := srv.db.UpdatePermit(&permit)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	// sessions hold the permissions by name
+	if origin.Name != updated.Name {
+		srv.auth.InvalidateAuthorities(origin.Name)
+	}
+	return infra.OkWithMessage(updated, ctx)
 }
 
 // go:interface(method="DELETE",path="/permit/del/:id",auth="RIGHTS_DEL",opLog="删除权限")
 func (srv *AdminServer) DeletePermission(ctx *fiber.Ctx) error {
-	return nil
+	id, err := ctx.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "id", Rule: "number", ErrValue: ctx.Params("id")})
+	}
+	permit, err := srv.db.GetPermissionById(id, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if err = srv.db.DeletePermitById(permit); err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	srv.auth.InvalidateAuthorities(permit.Name)
+	return infra.Ok(ctx)
+}
+
+func validatePermit(permit *db.SysPermission) []*ErrorResponse {
+	var errs []*ErrorResponse
+	permit.Name = strings.TrimSpace(permit.Name)
+	if permit.Name == "" || len(permit.Name) > 50 {
+		errs = append(errs, &ErrorResponse{FailedField: "name", Rule: "required,max=50", ErrValue: permit.Name})
+	}
+	if len([]rune(permit.Description)) > 45 {
+		errs = append(errs, &ErrorResponse{FailedField: "description", Rule: "max=45", ErrValue: permit.Description})
+	}
+	if len(permit.Scope) > 20 {
+		errs = append(errs, &ErrorResponse{FailedField: "scope", Rule: "max=20", ErrValue: permit.Scope})
+	}
+	return errs
 }
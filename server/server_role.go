@@ -0,0 +1,189 @@
+// go:controller(path="/roles",name="roles")
+package server
+
+import (
+	"golang-ast/db"
+	"golang-ast/infra"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// relationForm replaces every related record of a role with the given ids
+type relationForm struct {
+	Id  int   `json:"id"`
+	Ids []int `json:"ids"`
+}
+
+// go:interface(method="GET",path="/all",auth="ROLE_QUERY",opLog="查询角色列表")
+func (srv *AdminServer) GetRoles(ctx *fiber.Ctx) error {
+	roles, err := srv.db.GetRoles(true)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(roles, ctx)
+}
+
+// go:interface(method="GET",path="/query",auth="ROLE_QUERY",opLog="搜索角色")
+func (srv *AdminServer) QueryRoles(ctx *fiber.Ctx) error {
+	filter := db.RoleFilter{
+		Blurry: strings.TrimSpace(ctx.Query("blurry")),
+	}
+	roles, err := srv.db.QueryRoles(filter, true)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(roles, ctx)
+}
+
+// go:interface(method="POST",path="/role/add",auth="ROLE_ADD",opLog="创建角色")
+func (srv *AdminServer) CreateRole(ctx *fiber.Ctx) error {
+	var role db.SysRole
+	if err := ctx.BodyParser(&role); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	// relations are assigned through /role/permits and /role/menus
+	role.Id, role.Menus, role.Permissions = 0, nil, nil
+	if errs := validateRole(&role); len(errs) > 0 {
+		return bodyInvalid(ctx, errs...)
+	}
+	if exist, _ := srv.db.GetRoleByCode(role.Code); exist != nil {
+		return infra.FailWithMessage(http.StatusConflict, "role "+role.Code+" already exists", ctx)
+	}
+	created, err := srv.db.CreateRole(&role)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(created, ctx)
+}
+
+// go:interface(method="PUT",path="/role/edit",auth="ROLE_UPDATE",opLog="修改角色")
+func (srv *AdminServer) UpdateRole(ctx *fiber.Ctx) error {
+	var role db.SysRole
+	if err := ctx.BodyParser(&role); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	role.Menus, role.Permissions = nil, nil
+	errs := validateRole(&role)
+	if role.Id <= 0 {
+		errs = append(errs, &ErrorResponse{FailedField: "id", Rule: "required", ErrValue: role.Id})
+	}
+	if len(errs) > 0 {
+		return bodyInvalid(ctx, errs...)
+	}
+	origin, err := srv.db.GetRoleById(role.Id, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if exist, _ := srv.db.GetRoleByCode(role.Code); exist != nil && exist.Id != role.Id {
+		return infra.FailWithMessage(http.StatusConflict, "role "+role.Code+" already exists", ctx)
+	}
+	role.Ct = origin.Ct
+	updated, err := srv.db.UpdateRole(&role)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if origin.Code != updated.Code {
+		srv.auth.InvalidateRoles(origin.Code)
+	}
+	return infra.OkWithMessage(updated, ctx)
+}
+
+// go:interface(method="PUT",path="/role/permits",auth="ROLE_UPDATE",opLog="分配角色权限")
+func (srv *AdminServer) UpdateRolePermissions(ctx *fiber.Ctx) error {
+	role, form, err := srv.parseRelation(ctx)
+	if role == nil {
+		return err
+	}
+	permits, err := srv.db.GetPermissionsByIds(form.Ids)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if len(permits) != len(unique(form.Ids)) {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "ids", Rule: "exists", ErrValue: form.Ids})
+	}
+	updated, err := srv.db.UpdateRoleRelations(role, "Permissions", permits)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	srv.auth.InvalidateRoles(role.Code)
+	return infra.OkWithMessage(updated, ctx)
+}
+
+// go:interface(method="PUT",path="/role/menus",auth="ROLE_UPDATE",opLog="分配角色菜单")
+func (srv *AdminServer) UpdateRoleMenus(ctx *fiber.Ctx) error {
+	role, form, err := srv.parseRelation(ctx)
+	if role == nil {
+		return err
+	}
+	menus, err := srv.db.GetMenusByIds(form.Ids)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if len(menus) != len(unique(form.Ids)) {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "ids", Rule: "exists", ErrValue: form.Ids})
+	}
+	updated, err := srv.db.UpdateRoleRelations(role, "Menus", menus)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(updated, ctx)
+}
+
+// go:interface(method="DELETE",path="/role/del/:id",auth="ROLE_DEL",opLog="删除角色")
+func (srv *AdminServer) DeleteRole(ctx *fiber.Ctx) error {
+	id, err := ctx.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "id", Rule: "number", ErrValue: ctx.Params("id")})
+	}
+	role, err := srv.db.GetRoleById(id, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if err = srv.db.DeleteRoleById(role.Id); err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	srv.auth.InvalidateRoles(role.Code)
+	return infra.Ok(ctx)
+}
+
+// parseRelation loads the role of a relation form, a nil role means the response is already written
+func (srv *AdminServer) parseRelation(ctx *fiber.Ctx) (*db.SysRole, *relationForm, error) {
+	var form relationForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return nil, nil, infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	if form.Id <= 0 {
+		return nil, nil, bodyInvalid(ctx, &ErrorResponse{FailedField: "id", Rule: "required", ErrValue: form.Id})
+	}
+	role, err := srv.db.GetRoleById(form.Id, false)
+	if err != nil {
+		return nil, nil, srv.dbFailed(ctx, err)
+	}
+	return role, &form, nil
+}
+
+func validateRole(role *db.SysRole) []*ErrorResponse {
+	var errs []*ErrorResponse
+	role.Code = strings.TrimSpace(role.Code)
+	role.Name = strings.TrimSpace(role.Name)
+	if role.Code == "" || len(role.Code) > 20 {
+		errs = append(errs, &ErrorResponse{FailedField: "code", Rule: "required,max=20", ErrValue: role.Code})
+	}
+	if role.Name == "" || len([]rune(role.Name)) > 45 {
+		errs = append(errs, &ErrorResponse{FailedField: "name", Rule: "required,max=45", ErrValue: role.Name})
+	}
+	if role.Level < 0 {
+		errs = append(errs, &ErrorResponse{FailedField: "level", Rule: "min=0", ErrValue: role.Level})
+	}
+	return errs
+}
+
+func unique(ids []int) map[int]bool {
+	set := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
@@ -0,0 +1,162 @@
+// go:controller(path="/sessions",name="sessions")
+package server
+
+import (
+	"errors"
+	"golang-ast/infra"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// sessionInfo is the device view of a session, it leaves out the authorities and tokens
+type sessionInfo struct {
+	Id        string    `json:"id"`
+	Principal string    `json:"principal"`
+	Ip        string    `json:"ip"`
+	Agent     string    `json:"agent"`
+	Ct        time.Time `json:"ct"`
+	Seen      time.Time `json:"seen"`
+	Exp       time.Time `json:"exp"`
+	Current   bool      `json:"current"`
+}
+
+type onlineUser struct {
+	Name     string    `json:"name"`
+	Sessions int       `json:"sessions"`
+	Seen     time.Time `json:"seen"`
+}
+
+// go:interface(method="GET",path="/online",auth="SESSION_QUERY",opLog="在线用户")
+func (srv *AdminServer) GetOnlineUsers(ctx *fiber.Ctx) error {
+	sessions, err := srv.auth.Sessions("")
+	if err != nil {
+		return srv.sessionFailed(ctx, err)
+	}
+	users := make([]*onlineUser, 0)
+	index := map[string]*onlineUser{}
+	for _, session := range sessions {
+		user, ok := index[session.Principal]
+		if !ok {
+			user = &onlineUser{Name: session.Principal}
+			index[session.Principal] = user
+			users = append(users, user)
+		}
+		user.Sessions++
+		if session.Seen.After(user.Seen) {
+			user.Seen = session.Seen
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Seen.After(users[j].Seen)
+	})
+	return infra.OkWithMessage(users, ctx)
+}
+
+// go:interface(method="GET",path="/user/:name",auth="SESSION_QUERY",opLog="查询用户会话")
+func (srv *AdminServer) GetUserSessions(ctx *fiber.Ctx) error {
+	name := ctx.Params("name")
+	if name == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "name", Rule: "required"})
+	}
+	return srv.listSessions(ctx, name)
+}
+
+// go:interface(method="GET",path="/mine",auth="any",opLog="查询我的会话")
+func (srv *AdminServer) GetMySessions(ctx *fiber.Ctx) error {
+	authentication := currentAuth(ctx)
+	if authentication == nil {
+		return infra.FailWithMessage(http.StatusUnauthorized, "not signed in", ctx)
+	}
+	return srv.listSessions(ctx, authentication.Principal())
+}
+
+// go:interface(method="DELETE",path="/kick/session/:id",auth="SESSION_KICK",opLog="强制下线会话")
+func (srv *AdminServer) KickSession(ctx *fiber.Ctx) error {
+	id := ctx.Params("id")
+	if id == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "id", Rule: "required"})
+	}
+	session, err := srv.auth.KickSession(id, "kicked")
+	if err != nil {
+		return srv.sessionFailed(ctx, err)
+	}
+	return infra.OkWithMessage(session.Principal, ctx)
+}
+
+// go:interface(method="DELETE",path="/kick/mine/:id",auth="any",opLog="下线我的会话")
+func (srv *AdminServer) KickMySession(ctx *fiber.Ctx) error {
+	id := ctx.Params("id")
+	if id == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "id", Rule: "required"})
+	}
+	authentication := currentAuth(ctx)
+	if authentication == nil {
+		return infra.FailWithMessage(http.StatusUnauthorized, "not signed in", ctx)
+	}
+	// the sessions of other users look the same as unknown ones
+	sessions, err := srv.auth.Sessions(authentication.Principal())
+	if err != nil {
+		return srv.sessionFailed(ctx, err)
+	}
+	for _, session := range sessions {
+		if session.Id == id {
+			if _, err = srv.auth.KickSession(id, "signed out"); err != nil {
+				return srv.sessionFailed(ctx, err)
+			}
+			return infra.Ok(ctx)
+		}
+	}
+	return srv.sessionFailed(ctx, infra.ErrSessionNotFound)
+}
+
+// go:interface(method="DELETE",path="/kick/user/:name",auth="SESSION_KICK",opLog="强制下线用户")
+func (srv *AdminServer) KickUser(ctx *fiber.Ctx) error {
+	name := ctx.Params("name")
+	if name == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "name", Rule: "required"})
+	}
+	if isCurrentUser(ctx, name) {
+		return infra.FailWithMessage(http.StatusBadRequest, "can not kick yourself", ctx)
+	}
+	if err := srv.auth.RevokeUser(name); err != nil {
+		return srv.sessionFailed(ctx, err)
+	}
+	return infra.OkWithMessage(name, ctx)
+}
+
+func (srv *AdminServer) listSessions(ctx *fiber.Ctx, name string) error {
+	sessions, err := srv.auth.Sessions(name)
+	if err != nil {
+		return srv.sessionFailed(ctx, err)
+	}
+	current := ""
+	if authentication := currentAuth(ctx); authentication != nil {
+		current = authentication.SessionId()
+	}
+	infos := make([]*sessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, &sessionInfo{
+			Id:        session.Id,
+			Principal: session.Principal,
+			Ip:        session.Ip,
+			Agent:     session.Agent,
+			Ct:        session.Ct,
+			Seen:      session.Seen,
+			Exp:       session.Exp,
+			Current:   session.Id == current,
+		})
+	}
+	return infra.OkWithMessage(infos, ctx)
+}
+
+func (srv *AdminServer) sessionFailed(ctx *fiber.Ctx, err error) error {
+	if errors.Is(err, infra.ErrSessionNotFound) {
+		return infra.FailWithMessage(http.StatusNotFound, "session not found", ctx)
+	}
+	srv.log.Error("session store error", zap.Error(err))
+	return infra.Fail(http.StatusInternalServerError, ctx)
+}
@@ -2,45 +2,510 @@
 package server
 
 import (
+	"errors"
+	"golang-ast/db"
+	"golang-ast/infra"
+	"golang-ast/utils"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPageSize = 10
+	maxPageSize     = 200
+	maxAvatarSize   = 2 << 20
+	avatarPath      = "/avatar"
 )
 
+var errOldPassword = errors.New("old password mismatch")
+
+// userOrders whitelists the columns a user query can be sorted by
+var userOrders = map[string]bool{
+	"name":        true,
+	"nick":        true,
+	"email":       true,
+	"phone":       true,
+	"enable":      true,
+	"login_times": true,
+	"ct":          true,
+	"ut":          true,
+}
+
+var avatarTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+type userForm struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Nick     string `json:"nick"`
+	Email    string `json:"email"`
+	Phone    string `json:"phone"`
+	Enable   *bool  `json:"enable"`
+	Roles    []int  `json:"roles"`
+}
+
+type passForm struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+type resetPassForm struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
 // go:interface(method="GET",path="/all",auth="USER_QUERY",opLog="用户目录")
 func (srv *AdminServer) GetAllUser(ctx *fiber.Ctx) error {
-	return nil
+	users, err := srv.db.FindAllUsers()
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(users, ctx)
 }
 
 // go:interface(method="GET",path="/query",auth="USER_QUERY",opLog="用户搜索")
 func (srv *AdminServer) QueryUsers(ctx *fiber.Ctx) error {
-	return nil
+	size, errSize := queryInt(ctx, "size", defaultPageSize)
+	page, errPage := queryInt(ctx, "page", 0)
+	if errSize != nil || size <= 0 || size > maxPageSize {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "size", Rule: "min=1,max=200", ErrValue: ctx.Query("size")})
+	}
+	if errPage != nil || page < 0 {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "page", Rule: "min=0", ErrValue: ctx.Query("page")})
+	}
+	order, ok := parseOrder(ctx.Query("order"), userOrders)
+	if !ok {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "order", Rule: "column[,asc|desc]", ErrValue: ctx.Query("order")})
+	}
+	filter := db.UserFilter{
+		Name: strings.TrimSpace(ctx.Query("name")),
+	}
+	for _, id := range strings.Split(ctx.Query("idx"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			filter.Idx = append(filter.Idx, id)
+		}
+	}
+	users, err := srv.db.QueryUsers(filter, int32(size), int32(page), order)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return infra.OkWithMessage(users, ctx)
 }
 
 // go:interface(method="POST",path="/user/add",auth="USER_ADD",opLog="新增用户")
 func (srv *AdminServer) NewUser(ctx *fiber.Ctx) error {
-	return nil
+	var form userForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	errs := validateUser(&form)
+	if form.Password == "" || len(form.Password) > 200 {
+		errs = append(errs, &ErrorResponse{FailedField: "password", Rule: "required,max=200"})
+	} else {
+		violations, err := srv.passwordViolations(&db.SysUser{Name: form.Name}, "password", form.Password)
+		if err != nil {
+			return srv.dbFailed(ctx, err)
+		}
+		errs = append(errs, violations...)
+	}
+	if len(errs) > 0 {
+		return bodyInvalid(ctx, errs...)
+	}
+	if exist, _ := srv.db.QueryUserBy(form.Name, form.Email, form.Phone); exist != nil {
+		return infra.FailWithMessage(http.StatusConflict, "user name, email or phone already in use", ctx)
+	}
+	roles, err := srv.db.GetRolesByIds(form.Roles)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	hash, err := srv.auth.HashPassword(form.Password)
+	if err != nil {
+		srv.log.Error("NewUser().HashPassword error", zap.Error(err))
+		return infra.Fail(http.StatusInternalServerError, ctx)
+	}
+	now := time.Now()
+	user := &db.SysUser{
+		Name:       form.Name,
+		Password:   hash,
+		Nick:       form.Nick,
+		Email:      form.Email,
+		Phone:      form.Phone,
+		Enable:     form.Enable == nil || *form.Enable,
+		GrantBy:    "local",
+		LockBy:     "none",
+		Roles:      roles,
+		PwdChanged: &now,
+	}
+	created, err := srv.db.CreateUser(user)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if err = srv.auth.RecordPassword(created); err != nil {
+		srv.log.Error("NewUser().RecordPassword error", zap.Error(err))
+	}
+	created.Password = ""
+	return infra.OkWithMessage(created, ctx)
 }
 
 // go:interface(method="PUT",path="/user/edit",auth="USER_INFO_EDIT",opLog="修改用户信息")
 func (srv *AdminServer) UpdateUserInfo(ctx *fiber.Ctx) error {
-	return nil
+	var form userForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	errs := validateUser(&form)
+	if form.Id == "" {
+		errs = append(errs, &ErrorResponse{FailedField: "id", Rule: "required", ErrValue: form.Id})
+	}
+	if len(errs) > 0 {
+		return bodyInvalid(ctx, errs...)
+	}
+	origin, err := srv.db.FindUserById(form.Id, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if exist, _ := srv.db.QueryUserBy(form.Name, form.Email, form.Phone); exist != nil && exist.Id != origin.Id {
+		return infra.FailWithMessage(http.StatusConflict, "user name, email or phone already in use", ctx)
+	}
+	// the password is only changed through /pwd/edit
+	fields := map[string]any{
+		"id":    origin.Id,
+		"name":  form.Name,
+		"nick":  form.Nick,
+		"email": form.Email,
+		"phone": form.Phone,
+	}
+	if form.Nick == "" {
+		fields["nick"] = form.Name
+	}
+	if form.Enable != nil {
+		fields["enable"] = *form.Enable
+	}
+	var aso any
+	if form.Roles != nil {
+		roles, errRole := srv.db.GetRolesByIds(form.Roles)
+		if errRole != nil {
+			return srv.dbFailed(ctx, errRole)
+		}
+		aso = roles
+	}
+	updated, err := srv.db.UpdateUserWithId(origin, fields, aso)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	// sessions hold the name and authorities of the user, make it sign in again
+	if origin.Name != updated.Name || !updated.Enable || aso != nil {
+		srv.auth.RemoveAuthentication(origin.Name)
+	}
+	updated.Password = ""
+	return infra.OkWithMessage(updated, ctx)
 }
 
 // go:interface(method="PUT",path="/pwd/edit",auth="USER_UPDATE",opLog="修改用户密码")
 func (srv *AdminServer) UpdateUserPass(ctx *fiber.Ctx) error {
-	return nil
+	var form passForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	if form.NewPassword == "" || len(form.NewPassword) > 200 {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "new_password", Rule: "required,max=200"})
+	}
+	authentication := currentAuth(ctx)
+	if authentication == nil {
+		return infra.FailWithMessage(http.StatusUnauthorized, "not signed in", ctx)
+	}
+	user, err := srv.db.FindUserByIdentify(authentication.Principal(), false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	// a session is no licence to guess the password, wrong ones count towards the lockout
+	if exp, locked := srv.auth.LockedUntil(user.Name, ctx.IP()); locked {
+		return lockedFailed(ctx, exp)
+	}
+	if !srv.auth.VerifyPassword(user, form.OldPassword) {
+		return srv.auth.OnAuthFailedHandler(user.Name, errOldPassword, ctx)
+	}
+	violations, err := srv.passwordViolations(user, "new_password", form.NewPassword)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if len(violations) > 0 {
+		return bodyInvalid(ctx, violations...)
+	}
+	if err = srv.auth.SetPassword(user, form.NewPassword); err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	// the session of an expired password ends here, the user signs in with the new one,
+	// any other session of the user ends in either case
+	if authentication.Scope() == infra.ScopePasswordChange {
+		return srv.revokeUserTokens(ctx, user.Name)
+	}
+	if err = srv.auth.KickOtherSessions(user.Name, authentication.SessionId(), "password changed"); err != nil {
+		srv.log.Error("UpdateUserPass().KickOtherSessions error", zap.Error(err))
+		return infra.Fail(http.StatusInternalServerError, ctx)
+	}
+	return infra.Ok(ctx)
+}
+
+// go:interface(method="PUT",path="/pwd/reset",auth="USER_PWD_RESET",opLog="重置用户密码")
+func (srv *AdminServer) ResetUserPass(ctx *fiber.Ctx) error {
+	var form resetPassForm
+	if err := ctx.BodyParser(&form); err != nil {
+		return infra.FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	if form.Name == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "name", Rule: "required"})
+	}
+	if form.Password == "" || len(form.Password) > 200 {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "password", Rule: "required,max=200"})
+	}
+	user, err := srv.db.FindUserByIdentify(form.Name, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if isCurrentUser(ctx, user.Name) {
+		return infra.FailWithMessage(http.StatusBadRequest, "change your own password with the old one", ctx)
+	}
+	if user.OpenId != "" {
+		return infra.FailWithMessage(http.StatusBadRequest, "oauth accounts have no password", ctx)
+	}
+	violations, err := srv.passwordViolations(user, "password", form.Password)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if len(violations) > 0 {
+		return bodyInvalid(ctx, violations...)
+	}
+	if err = srv.auth.SetPassword(user, form.Password); err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	// whoever knew the old password is signed out
+	return srv.revokeUserTokens(ctx, user.Name)
 }
 
 // go:interface(method="POST",path="/avatar/edit",auth="USER_INFO_EDIT",opLog="修改用户头像")
 func (srv *AdminServer) ChangeAvatar(ctx *fiber.Ctx) error {
-	return nil
+	file, err := ctx.FormFile("file")
+	if err != nil {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "file", Rule: "required"})
+	}
+	if file.Size > maxAvatarSize {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "file", Rule: "max=2MB", ErrValue: file.Size})
+	}
+	// the type is sniffed from the content, the file is served with the type of its extension
+	contentType, err := sniffContentType(file)
+	if err != nil {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "file", Rule: "required"})
+	}
+	ext, ok := avatarTypes[contentType]
+	if !ok {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "file", Rule: "image", ErrValue: contentType})
+	}
+	// admins may pass the id of another user, otherwise the avatar of the caller changes
+	var user *db.SysUser
+	if uid := ctx.FormValue("id"); uid != "" {
+		user, err = srv.db.FindUserById(uid, false)
+	} else if authentication := currentAuth(ctx); authentication != nil {
+		user, err = srv.db.FindUserByIdentify(authentication.Principal(), false)
+	} else {
+		return infra.FailWithMessage(http.StatusUnauthorized, "not signed in", ctx)
+	}
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	dir := filepath.Join(srv.cfg.AppCfg.UploadDir, avatarPath)
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		srv.log.Error("ChangeAvatar().MkdirAll error", zap.Error(err))
+		return infra.Fail(http.StatusInternalServerError, ctx)
+	}
+	name := user.Id + "-" + utils.MustNanoId() + ext
+	if err = ctx.SaveFile(file, filepath.Join(dir, name)); err != nil {
+		srv.log.Error("ChangeAvatar().SaveFile error", zap.Error(err))
+		return infra.Fail(http.StatusInternalServerError, ctx)
+	}
+	updated, err := srv.db.UpdateUserWithId(user, map[string]any{"id": user.Id, "header": path.Join(avatarPath, name)}, nil)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	// the previous avatar is ours only when it was uploaded here
+	if strings.HasPrefix(user.Header, avatarPath+"/") {
+		_ = os.Remove(filepath.Join(dir, path.Base(user.Header)))
+	}
+	updated.Password = ""
+	return infra.OkWithMessage(updated, ctx)
 }
 
 // go:interface(method="DELETE",path="/user/id/:id",auth="USER_DEL",opLog="通过ID删除用户")
 func (srv *AdminServer) DeleteUserById(ctx *fiber.Ctx) error {
-	return nil
+	uid := ctx.Params("id")
+	if uid == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "id", Rule: "required"})
+	}
+	if user, err := srv.db.FindUserById(uid, false); err == nil && isCurrentUser(ctx, user.Name) {
+		return infra.FailWithMessage(http.StatusBadRequest, "can not delete yourself", ctx)
+	}
+	name, err := srv.db.DeleteUserById(uid)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	srv.auth.RemoveAuthentication(name)
+	return infra.Ok(ctx)
 }
 
 // go:interface(method="DELETE",path="/user/name/:name",auth="USER_DEL",opLog="通过用户名删除用户")
 func (srv *AdminServer) DeleteUserByName(ctx *fiber.Ctx) error {
+	name := ctx.Params("name")
+	if name == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "name", Rule: "required"})
+	}
+	// the param may be an email or phone, the guard and the sessions go by the user name
+	user, err := srv.db.FindUserByIdentify(name, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	if isCurrentUser(ctx, user.Name) {
+		return infra.FailWithMessage(http.StatusBadRequest, "can not delete yourself", ctx)
+	}
+	if err = srv.db.DeleteUserByName(user.Name); err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	srv.auth.RemoveAuthentication(user.Name)
+	return infra.Ok(ctx)
+}
+
+// go:interface(method="DELETE",path="/tokens/id/:id",auth="USER_REVOKE",opLog="通过ID吊销用户令牌")
+func (srv *AdminServer) RevokeUserTokensById(ctx *fiber.Ctx) error {
+	uid := ctx.Params("id")
+	if uid == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "id", Rule: "required"})
+	}
+	user, err := srv.db.FindUserById(uid, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return srv.revokeUserTokens(ctx, user.Name)
+}
+
+// go:interface(method="DELETE",path="/tokens/name/:name",auth="USER_REVOKE",opLog="通过用户名吊销用户令牌")
+func (srv *AdminServer) RevokeUserTokensByName(ctx *fiber.Ctx) error {
+	name := ctx.Params("name")
+	if name == "" {
+		return bodyInvalid(ctx, &ErrorResponse{FailedField: "name", Rule: "required"})
+	}
+	user, err := srv.db.FindUserByIdentify(name, false)
+	if err != nil {
+		return srv.dbFailed(ctx, err)
+	}
+	return srv.revokeUserTokens(ctx, user.Name)
+}
+
+func (srv *AdminServer) revokeUserTokens(ctx *fiber.Ctx, name string) error {
+	if err := srv.auth.RevokeUser(name); err != nil {
+		srv.log.Error("revokeUserTokens().RevokeUser error", zap.Error(err))
+		return infra.Fail(http.StatusInternalServerError, ctx)
+	}
+	return infra.OkWithMessage(name, ctx)
+}
+
+// sniffContentType detects the media type of an uploaded file from its first bytes
+func sniffContentType(file *multipart.FileHeader) (string, error) {
+	f, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// passwordViolations reports every rule of the password policy a new password violates
+func (srv *AdminServer) passwordViolations(user *db.SysUser, field, password string) ([]*ErrorResponse, error) {
+	rules, err := srv.auth.CheckPassword(user, password)
+	if err != nil {
+		return nil, err
+	}
+	errs := make([]*ErrorResponse, 0, len(rules))
+	for _, rule := range rules {
+		errs = append(errs, &ErrorResponse{FailedField: field, Rule: rule})
+	}
+	return errs, nil
+}
+
+func validateUser(form *userForm) []*ErrorResponse {
+	var errs []*ErrorResponse
+	form.Name = strings.TrimSpace(form.Name)
+	form.Email = strings.TrimSpace(form.Email)
+	form.Phone = strings.TrimSpace(form.Phone)
+	if form.Name == "" || len([]rune(form.Name)) > 50 {
+		errs = append(errs, &ErrorResponse{FailedField: "name", Rule: "required,max=50", ErrValue: form.Name})
+	}
+	if len([]rune(form.Nick)) > 50 {
+		errs = append(errs, &ErrorResponse{FailedField: "nick", Rule: "max=50", ErrValue: form.Nick})
+	}
+	if len(form.Email) > 50 || form.Email != "" && !strings.Contains(form.Email, "@") {
+		errs = append(errs, &ErrorResponse{FailedField: "email", Rule: "email,max=50", ErrValue: form.Email})
+	}
+	if len(form.Phone) > 20 {
+		errs = append(errs, &ErrorResponse{FailedField: "phone", Rule: "max=20", ErrValue: form.Phone})
+	}
+	return errs
+}
+
+// parseOrder turns "column" or "column,desc" into an order clause when the column is allowed
+func parseOrder(order string, allowed map[string]bool) (string, bool) {
+	if order == "" {
+		return "", true
+	}
+	column, direction, _ := strings.Cut(order, ",")
+	column = strings.TrimSpace(column)
+	direction = strings.ToLower(strings.TrimSpace(direction))
+	if !allowed[column] {
+		return "", false
+	}
+	switch direction {
+	case "":
+		return column, true
+	case "asc", "desc":
+		return column + " " + direction, true
+	}
+	return "", false
+}
+
+func queryInt(ctx *fiber.Ctx, key string, defaultValue int) (int, error) {
+	value := ctx.Query(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func currentAuth(ctx *fiber.Ctx) *infra.Authentication {
+	if authentication, ok := ctx.Locals("auth").(*infra.Authentication); ok {
+		return authentication
+	}
 	return nil
 }
+
+func isCurrentUser(ctx *fiber.Ctx, name string) bool {
+	authentication := currentAuth(ctx)
+	return authentication != nil && authentication.Principal() == name
+}